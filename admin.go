@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
+	log "github.com/sirupsen/logrus"
+)
+
+// adminResponse is returned by every admin endpoint, Err is empty on success
+type adminResponse struct {
+	Err string `json:",omitempty"`
+}
+
+// renameRequest renames a volume
+type renameRequest struct {
+	Name    string
+	NewName string
+}
+
+// mountsRequest lists where a volume is mounted
+type mountsRequest struct {
+	Name string
+}
+
+// volumeMount is a mount of a volume in a mount namespace on the host
+type volumeMount struct {
+	Namespace  string
+	Pid        int
+	MountPoint string
+	// Root is the directory of the volume mounted, / unless it is a bind mount of a subdirectory
+	Root string
+}
+
+// mountsResponse is the response to a mountsRequest
+type mountsResponse struct {
+	Mounts []*volumeMount
+}
+
+// statusRequest gets the detail of a volume
+type statusRequest struct {
+	Name string
+}
+
+// statusResponse is the response to a statusRequest
+type statusResponse struct {
+	Name  string
+	Image string
+	// Device and Mountpoint are empty if the volume is not mapped or mounted on this host
+	Device     string
+	Mountpoint string
+	Status     *rbd.ImageStatus
+	Usage      *rbd.DiskUsage
+	// Error is the last error from a health probe of the volume
+	Error string `json:",omitempty"`
+	// Containers are the containers on this host using the volume, running or not
+	Containers []*volumeContainer `json:",omitempty"`
+}
+
+// benchRequest benchmarks a volume
+type benchRequest struct {
+	Name    string
+	Mode    string
+	Size    string
+	Pattern string
+	// AllowWrite must be set for write benchmarks, which overwrite the volume's data
+	AllowWrite bool
+}
+
+// groupSnapshotRequest snapshots the volumes of a group together
+type groupSnapshotRequest struct {
+	Group string
+	// Volumes are added to the group, which is created if needed. If empty, the group must already exist.
+	Volumes []string
+	// Snapshot is the name of the snapshot, the current time if empty
+	Snapshot string
+}
+
+// groupSnapshotResponse is the response to a groupSnapshotRequest
+type groupSnapshotResponse struct {
+	Snapshot string
+	Volumes  []string
+}
+
+// adminHandler returns the handler for operations that are not part of the docker volume api
+func (rd *RbdDriver) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/Volume.Rename", adminEndpoint(func(dec *json.Decoder) (interface{}, error) {
+		req := &renameRequest{}
+		if err := dec.Decode(req); err != nil {
+			return nil, err
+		}
+		return nil, rd.Rename(req)
+	}))
+	mux.HandleFunc("/Volume.Mounts", adminEndpoint(func(dec *json.Decoder) (interface{}, error) {
+		req := &mountsRequest{}
+		if err := dec.Decode(req); err != nil {
+			return nil, err
+		}
+		return rd.Mounts(req)
+	}))
+	mux.HandleFunc("/Volume.Status", adminEndpoint(func(dec *json.Decoder) (interface{}, error) {
+		req := &statusRequest{}
+		if err := dec.Decode(req); err != nil {
+			return nil, err
+		}
+		return rd.Status(req)
+	}))
+	mux.HandleFunc("/Volume.Bench", adminEndpoint(func(dec *json.Decoder) (interface{}, error) {
+		req := &benchRequest{}
+		if err := dec.Decode(req); err != nil {
+			return nil, err
+		}
+		return rd.Bench(req)
+	}))
+	mux.HandleFunc("/Volume.GroupSnapshot", adminEndpoint(func(dec *json.Decoder) (interface{}, error) {
+		req := &groupSnapshotRequest{}
+		if err := dec.Decode(req); err != nil {
+			return nil, err
+		}
+		return rd.GroupSnapshot(req)
+	}))
+	return mux
+}
+
+// adminEndpoint decodes requests with f and encodes its result, or its error as an adminResponse
+func adminEndpoint(f func(*json.Decoder) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		resp, err := f(json.NewDecoder(r.Body))
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			log.WithField("path", r.URL.Path).WithError(err).Debug("admin request failed")
+			w.WriteHeader(http.StatusInternalServerError)
+			resp = &adminResponse{Err: err.Error()}
+		}
+		if resp == nil {
+			resp = &adminResponse{}
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.WithError(err).Error("error encoding admin response")
+		}
+	}
+}
+
+// listenAdmin listens on the admin unix socket, replacing a stale socket file
+func listenAdmin(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error removing old admin socket %v: %w", path, err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on admin socket %v: %w", path, err)
+	}
+	return l, os.Chmod(path, 0600)
+}
+
+// adminCall posts req to an admin endpoint on the daemon and decodes the response into resp
+func adminCall(socket, endpoint string, req, resp interface{}) error {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := client.Post("http://rbd/"+endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error calling %v on %v: %w", endpoint, socket, err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		errResp := &adminResponse{}
+		if err = json.NewDecoder(r.Body).Decode(errResp); err != nil || errResp.Err == "" {
+			return fmt.Errorf("%v returned %v", endpoint, r.Status)
+		}
+		return fmt.Errorf("%v", errResp.Err)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
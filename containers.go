@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/docker"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrVolumeInUse is returned when removing a volume which containers on this host use
+var ErrVolumeInUse = errors.New("volume is in use by containers")
+
+// volumeContainer is a container using a volume
+type volumeContainer struct {
+	ID    string
+	Name  string
+	State string
+}
+
+// containerCacheTTL is how long the containers listed for Get are used before they are listed again
+const containerCacheTTL = 10 * time.Second
+
+// containersUsing returns the containers on this host which use the volume, including stopped containers if all
+// is set. Volumes of other drivers with the same name are not included. It returns none if the docker api is disabled.
+func (rd *RbdDriver) containersUsing(name string, all bool) ([]*volumeContainer, error) {
+	if rd.docker == nil {
+		return nil, nil
+	}
+	containers, err := rd.docker.ContainersUsing(rd.driverName, name, "", all)
+	if err != nil {
+		return nil, err
+	}
+	return volumeContainers(containers), nil
+}
+
+// cachedContainersUsing returns the containers, running or not, which used the volume when they were last listed,
+// without waiting for docker. A list older than containerCacheTTL is refreshed in the background.
+func (rd *RbdDriver) cachedContainersUsing(name string) []*volumeContainer {
+	if rd.docker == nil {
+		return nil
+	}
+	rd.ctrCacheMutex.Lock()
+	defer rd.ctrCacheMutex.Unlock()
+	if time.Since(rd.ctrCacheTime) >= containerCacheTTL && !rd.ctrRefreshing {
+		rd.ctrRefreshing = true
+		go rd.refreshContainerCache()
+	}
+	return volumeContainers(docker.Using(rd.ctrCache, rd.driverName, name, ""))
+}
+
+// refreshContainerCache lists the containers for cachedContainersUsing. If docker can't be reached none are shown
+// until the next refresh.
+func (rd *RbdDriver) refreshContainerCache() {
+	containers, err := rd.docker.Containers(true)
+	if err != nil {
+		log.WithError(err).Warn("error listing containers")
+	}
+	rd.ctrCacheMutex.Lock()
+	defer rd.ctrCacheMutex.Unlock()
+	rd.ctrCache, rd.ctrCacheTime, rd.ctrRefreshing = containers, time.Now(), false
+}
+
+// volumeContainers converts the containers from the docker api
+func volumeContainers(containers []*docker.Container) []*volumeContainer {
+	r := make([]*volumeContainer, 0, len(containers))
+	for _, ctr := range containers {
+		r = append(r, &volumeContainer{ID: ctr.ID, Name: containerName(ctr), State: ctr.State})
+	}
+	return r
+}
+
+// containerName returns the name of a container without the leading /, or its short id if it has none
+func containerName(ctr *docker.Container) string {
+	if len(ctr.Names) > 0 {
+		return strings.TrimPrefix(ctr.Names[0], "/")
+	}
+	if len(ctr.ID) > 12 {
+		return ctr.ID[:12]
+	}
+	return ctr.ID
+}
+
+// containerNames returns the names of containers
+func containerNames(containers []*volumeContainer) []string {
+	names := make([]string, 0, len(containers))
+	for _, c := range containers {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// checkNotInUse returns ErrVolumeInUse if any container on this host, running or not, uses the volume
+func (rd *RbdDriver) checkNotInUse(name string) error {
+	containers, err := rd.containersUsing(name, true)
+	if err != nil {
+		return err
+	}
+	if len(containers) > 0 {
+		return fmt.Errorf("%v is used by %v: %w", name, strings.Join(containerNames(containers), ", "), ErrVolumeInUse)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// Package docker is a minimal client for the parts of the docker engine api used by the plugin and tools
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
+)
+
+// DefaultSocket is the default docker engine api socket
+const DefaultSocket = "/var/run/docker.sock"
+
+const requestTimeout = 30 * time.Second
+
+// Client talks to the docker engine api over a unix socket
+type Client struct {
+	http *http.Client
+}
+
+// Mount is a mount in a container
+type Mount struct {
+	Type        string
+	Name        string
+	Source      string
+	Destination string
+	Driver      string
+}
+
+// Container is a container from the container list
+type Container struct {
+	ID     string `json:"Id"`
+	Names  []string
+	State  string
+	Labels map[string]string
+	Mounts []*Mount
+}
+
+// Volume is a volume from the volume list
+type Volume struct {
+	Name       string
+	Driver     string
+	Mountpoint string
+	Labels     map[string]string
+}
+
+// NewClient returns a client for the docker engine listening on socket
+func NewClient(socket string) *Client {
+	return &Client{http: &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}}
+}
+
+// do sends a request to the engine and decodes the response into v if v is not nil
+func (c *Client) do(method, path string, query url.Values, v interface{}) error {
+	u := "http://docker" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling docker %v %v: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := struct{ Message string }{}
+		if err = json.NewDecoder(resp.Body).Decode(&msg); err != nil || msg.Message == "" {
+			msg.Message = resp.Status
+		}
+		return fmt.Errorf("docker %v %v: %v", method, path, msg.Message)
+	}
+	if v == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Containers returns the running and paused containers, and stopped containers if all is set
+func (c *Client) Containers(all bool) ([]*Container, error) {
+	query := url.Values{}
+	if all {
+		query.Set("all", "1")
+	}
+	containers := []*Container{}
+	return containers, c.do(http.MethodGet, "/containers/json", query, &containers)
+}
+
+// labelFilter returns the query filtering a list by label, either key or key=value
+func labelFilter(label string) (url.Values, error) {
+	if label == "" {
+		return url.Values{}, nil
+	}
+	f, err := json.Marshal(map[string][]string{"label": {label}})
+	if err != nil {
+		return nil, err
+	}
+	return url.Values{"filters": {string(f)}}, nil
+}
+
+// ContainersWithLabel returns every container with label, either key or key=value, whether it is running or not
+func (c *Client) ContainersWithLabel(label string) ([]*Container, error) {
+	query, err := labelFilter(label)
+	if err != nil {
+		return nil, err
+	}
+	query.Set("all", "1")
+	containers := []*Container{}
+	return containers, c.do(http.MethodGet, "/containers/json", query, &containers)
+}
+
+// Volumes returns the volumes with label, either key or key=value, or every volume if label is empty
+func (c *Client) Volumes(label string) ([]*Volume, error) {
+	query, err := labelFilter(label)
+	if err != nil {
+		return nil, err
+	}
+	resp := &struct{ Volumes []*Volume }{}
+	if err = c.do(http.MethodGet, "/volumes", query, resp); err != nil {
+		return nil, err
+	}
+	return resp.Volumes, nil
+}
+
+// ContainersUsing returns the containers which use the volume of driver or mountpoint, see Using,
+// including stopped containers if all is set
+func (c *Client) ContainersUsing(driver, volume, mountpoint string, all bool) ([]*Container, error) {
+	containers, err := c.Containers(all)
+	if err != nil {
+		return nil, err
+	}
+	return Using(containers, driver, volume, mountpoint), nil
+}
+
+// Using returns the containers which mount the volume of driver, or a path at or beneath mountpoint.
+// volume may be empty to match only by path, mountpoint to match only by volume.
+// driver may be empty to match a volume of any driver with the name.
+func Using(containers []*Container, driver, volume, mountpoint string) []*Container {
+	r := []*Container{}
+	for _, ctr := range containers {
+		for _, m := range ctr.Mounts {
+			if (volume != "" && isVolume(m, driver, volume)) || (mountpoint != "" && rbd.IsUnder(m.Source, mountpoint)) {
+				r = append(r, ctr)
+				break
+			}
+		}
+	}
+	return r
+}
+
+// isVolume returns true if m is the volume of driver named volume, driver may be empty to match any driver
+func isVolume(m *Mount, driver, volume string) bool {
+	return m.Type == "volume" && m.Name == volume && (driver == "" || m.Driver == driver)
+}
+
+// Pause pauses a container
+func (c *Client) Pause(id string) error {
+	return c.do(http.MethodPost, "/containers/"+url.PathEscape(id)+"/pause", nil, nil)
+}
+
+// Unpause unpauses a container
+func (c *Client) Unpause(id string) error {
+	return c.do(http.MethodPost, "/containers/"+url.PathEscape(id)+"/unpause", nil, nil)
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/TrilliumIT/docker-rbd-plugin/docker"
 	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
 	"github.com/docker/go-plugins-helpers/volume"
 	log "github.com/sirupsen/logrus"
@@ -17,16 +23,166 @@ import (
 type RbdDriver struct {
 	volume.Driver
 	pool              *rbd.Pool
-	defaultSize       string
+	defaultSize       rbd.Size
 	defaultFileSystem string
+	defaultFeatures   []string
+	defaultDataPool   string
 	mountpoint        string
+	listUsage         bool
+	inspectUsage      bool
+	listCacheTTL      time.Duration
+	listCacheMutex    *sync.Mutex
+	inFlight          *sync.WaitGroup
+	listCache         []*rbd.Image
+	listCacheTime     time.Time
+	hostname          string
+	clusterLockTTL    time.Duration
+	clusterLockWait   time.Duration
+	volErrMutex       *sync.Mutex
+	volErrs           map[string]error
+	probeTimeout      time.Duration
+	probeFence        bool
+	probeMutex        *sync.Mutex
+	probeFSErrors     map[probeKey]int64
+	flattenClones     bool
+	lockWait          time.Duration
+	growOnResize      bool
+	watchMutex        *sync.Mutex
+	watches           map[string]*resizeWatch
+	docker            *docker.Client
+	driverName        string
+	ctrCacheMutex     *sync.Mutex
+	ctrCache          []*docker.Container
+	ctrCacheTime      time.Time
+	ctrRefreshing     bool
+	requestedMutex    *sync.Mutex
+	requested         map[string]struct{}
+	ctx               context.Context
+	cancel            context.CancelFunc
+}
+
+// RbdDriverOptions are the options for NewRbdDriver
+type RbdDriverOptions struct {
+	Pool              string
+	Namespace         string
+	DefaultSize       string
+	DefaultFileSystem string
+	DefaultFeatures   string
+	DefaultDataPool   string
+	Mountpoint        string
+	ListCacheTTL      time.Duration
+	ListUsage         bool
+	// InspectUsage reports the provisioned and used bytes of the image in volume inspect
+	InspectUsage bool
+	// ClusterLockTTL enables cluster wide image locks when greater than 0
+	ClusterLockTTL  time.Duration
+	ClusterLockWait time.Duration
+	ProbeTimeout    time.Duration
+	// ProbeFence kills the rbd-nbd process of devices that fail a probe
+	ProbeFence bool
+	// FlattenClones flattens volumes created with clone-from in the background by default
+	FlattenClones bool
+	// LockWait is how long Mount waits for another client to release the exclusive lock
+	LockWait time.Duration
+	// GrowOnResize watches mounted images and grows their filesystem when another client resizes them
+	GrowOnResize bool
+	// DockerSocket is the docker engine api socket used to find the containers using volumes, empty to disable
+	DockerSocket string
+	// DriverName is the name docker knows the plugin by, to tell its volumes from those of other drivers
+	DriverName string
 }
 
 //NewRbdDriver returns a new RbdDriver
-func NewRbdDriver(pool, defaultSize, defaultFileSystem, mountpoint string) (*RbdDriver, error) {
+func NewRbdDriver(opts *RbdDriverOptions) (*RbdDriver, error) {
 	log.Debug("Creating new RbdDriver.")
 
-	return &RbdDriver{pool: rbd.GetPool(pool), defaultSize: defaultSize, defaultFileSystem: defaultFileSystem, mountpoint: mountpoint}, nil
+	if err := rbd.ValidateFeatures("nbd", withFeature(rbd.ParseFeatures(opts.DefaultFeatures), string(rbd.FeatureExclusiveLock))...); err != nil {
+		return nil, fmt.Errorf("invalid default features: %w", err)
+	}
+
+	defaultSize, err := rbd.ParseSize(opts.DefaultSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default size: %w", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("error getting hostname: %w", err)
+	}
+
+	// every command run for the driver is killed when it is drained
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var dockerClient *docker.Client
+	if opts.DockerSocket != "" {
+		dockerClient = docker.NewClient(opts.DockerSocket)
+	}
+
+	return &RbdDriver{
+		pool:              rbd.GetPool(opts.Pool).WithNamespace(opts.Namespace).WithContext(ctx),
+		defaultSize:       defaultSize,
+		defaultFileSystem: opts.DefaultFileSystem,
+		defaultFeatures:   rbd.ParseFeatures(opts.DefaultFeatures),
+		defaultDataPool:   opts.DefaultDataPool,
+		mountpoint:        opts.Mountpoint,
+		listUsage:         opts.ListUsage,
+		inspectUsage:      opts.InspectUsage,
+		listCacheTTL:      opts.ListCacheTTL,
+		listCacheMutex:    &sync.Mutex{},
+		inFlight:          &sync.WaitGroup{},
+		hostname:          hostname,
+		clusterLockTTL:    opts.ClusterLockTTL,
+		clusterLockWait:   opts.ClusterLockWait,
+		volErrMutex:       &sync.Mutex{},
+		volErrs:           make(map[string]error),
+		probeTimeout:      opts.ProbeTimeout,
+		probeFence:        opts.ProbeFence,
+		probeMutex:        &sync.Mutex{},
+		probeFSErrors:     make(map[probeKey]int64),
+		flattenClones:     opts.FlattenClones,
+		lockWait:          opts.LockWait,
+		growOnResize:      opts.GrowOnResize,
+		watchMutex:        &sync.Mutex{},
+		watches:           make(map[string]*resizeWatch),
+		docker:            dockerClient,
+		driverName:        opts.DriverName,
+		ctrCacheMutex:     &sync.Mutex{},
+		requestedMutex:    &sync.Mutex{},
+		requested:         make(map[string]struct{}),
+		ctx:               ctx,
+		cancel:            cancel,
+	}, nil
+}
+
+// track marks an operation that changes image state as in flight until the returned function is called
+func (rd *RbdDriver) track() func() {
+	rd.inFlight.Add(1)
+	return rd.inFlight.Done
+}
+
+// drainGrace is how long Drain waits for operations to return after their commands are killed
+const drainGrace = 5 * time.Second
+
+// Drain waits for in flight operations to complete. If ctx is done first, the rbd commands of the
+// remaining operations are killed.
+func (rd *RbdDriver) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		rd.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	// kill the commands of stuck operations, and give them a moment to return
+	rd.cancel()
+	select {
+	case <-done:
+	case <-time.After(drainGrace):
+	}
+	return fmt.Errorf("in flight operations did not complete: %w", ctx.Err())
 }
 
 func (rd *RbdDriver) mountPoint(img *rbd.Image) string {
@@ -43,26 +199,36 @@ func (rd *RbdDriver) isMounted(img *rbd.Image) (string, error) {
 }
 
 func (rd *RbdDriver) imgFullName(name string) string {
-	return rd.pool.Name() + "/" + name
+	return rd.pool.FullName() + "/" + name
 }
 
 func (rd *RbdDriver) imgReqInit(name string) (string, *log.Entry, func()) {
 	imgName := rd.imgFullName(name)
-	lock(imgName)
+	unlock := rbd.LockName(imgName)
 	log := log.WithField("image", imgName)
-	return imgName, log, func() { unlock(imgName) }
+	return imgName, log, unlock
 }
 
 //Create creates a volume
 func (rd *RbdDriver) Create(req *volume.CreateRequest) error {
 	log.WithField("Request", req).Debug("create")
+	defer rd.track()()
+
+	if err := rbd.ValidateImageName(req.Name); err != nil {
+		log.WithError(err).Error("invalid volume name")
+		return fmt.Errorf("error in driver create: %w", err)
+	}
 
 	_, log, unlock := rd.imgReqInit(req.Name)
 	defer unlock()
 
-	size := req.Options["size"]
-	if size == "" {
-		size = rd.defaultSize
+	size := rd.defaultSize
+	if s := req.Options["size"]; s != "" {
+		var err error
+		if size, err = rbd.ParseSize(s); err != nil {
+			log.WithError(err).Error("invalid size")
+			return fmt.Errorf("error in driver create: %w", err)
+		}
 	}
 
 	fs := req.Options["fs"]
@@ -70,7 +236,64 @@ func (rd *RbdDriver) Create(req *volume.CreateRequest) error {
 		fs = rd.defaultFileSystem
 	}
 
-	_, err := rd.pool.CreateImageWithFileSystem(req.Name, size, fs, "--image-feature", "exclusive-lock")
+	features := rd.defaultFeatures
+	if f, ok := req.Options["features"]; ok {
+		features = rbd.ParseFeatures(f)
+	}
+	features = withFeature(features, string(rbd.FeatureExclusiveLock)) // required by MapExclusive
+	cloneFrom := req.Options["clone-from"]
+	if cloneFrom != "" {
+		features = withFeature(features, string(rbd.FeatureLayering)) // required by clones
+	}
+	if err := rbd.ValidateFeatures("nbd", features...); err != nil {
+		log.WithError(err).Error("invalid features")
+		return fmt.Errorf("error in driver create: %w", err)
+	}
+
+	args := []string{"--image-feature", strings.Join(features, ",")}
+
+	dataPool, ok := req.Options["data-pool"]
+	if !ok {
+		dataPool = rd.defaultDataPool
+	}
+	if dataPool != "" {
+		args = append(args, "--data-pool", dataPool)
+	}
+
+	stripeUnit, stripeCount := req.Options["stripe-unit"], req.Options["stripe-count"]
+	if stripeUnit != "" || stripeCount != "" {
+		count, err := strconv.Atoi(stripeCount)
+		if err != nil {
+			count = 0 // rejected by StripingArgs
+		}
+		stripeArgs, err := rbd.StripingArgs(stripeUnit, count)
+		if err != nil {
+			log.WithError(err).Error("invalid striping options")
+			return fmt.Errorf("error in driver create: %w", err)
+		}
+		args = append(args, stripeArgs...)
+	}
+
+	if cloneFrom != "" {
+		flatten := rd.flattenClones
+		if f, ok := req.Options["flatten"]; ok {
+			var err error
+			if flatten, err = strconv.ParseBool(f); err != nil {
+				log.WithError(err).Error("invalid flatten option")
+				return fmt.Errorf("error in driver create: invalid flatten option %v: %w", f, err)
+			}
+		}
+		defer rd.invalidateListCache()
+		if err := rd.createClone(req.Name, cloneFrom, flatten, args, log); err != nil {
+			log.WithError(err).Error("error cloning image")
+			return fmt.Errorf("error in driver create: clone: %w", err)
+		}
+		return nil
+	}
+
+	defer rd.invalidateListCache()
+	mkfsArgs := strings.Fields(req.Options["mkfs-args"])
+	_, err := rd.pool.CreateImageWithFileSystem(req.Name, size, fs, mkfsArgs, args...)
 	if err != nil {
 		log.WithError(err).Error("error creating image")
 		return fmt.Errorf("error in driver create: create: %w", err)
@@ -79,30 +302,159 @@ func (rd *RbdDriver) Create(req *volume.CreateRequest) error {
 	return nil
 }
 
+// createClone creates name as a clone of from (image@snapshot) in the pool.
+// The clone keeps the filesystem of its parent. If flatten is set, the clone is flattened in the background so the parent can later be removed.
+func (rd *RbdDriver) createClone(name, from string, flatten bool, args []string, log *log.Entry) error {
+	parts := strings.SplitN(from, "@", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("clone-from %v must be in the form image@snapshot: %w", from, rbd.ErrInvalidName)
+	}
+	parent, err := rd.pool.GetImage(parts[0])
+	if err != nil {
+		return err
+	}
+	snap, err := parent.GetSnapshot(parts[1])
+	if err != nil {
+		return err
+	}
+	img, err := snap.Clone(rd.pool, name, args...)
+	if err != nil {
+		return err
+	}
+	if flatten {
+		rd.flatten(img, log)
+	}
+	return nil
+}
+
+// flatten flattens a cloned image in the background, the image remains usable while this runs.
+// It is only stopped by the driver shutting down, flattening a large clone can take hours.
+func (rd *RbdDriver) flatten(img *rbd.Image, log *log.Entry) {
+	done := rd.track()
+	go func() {
+		defer done()
+		log.Info("flattening clone")
+		parent, err := img.Parent()
+		if err != nil && !errors.Is(err, rbd.ErrNoParent) {
+			log.WithError(err).Warn("error getting parent")
+		}
+		err = img.Flatten()
+		if errors.Is(err, rbd.ErrNoParent) {
+			log.Debug("clone was already flattened")
+			return
+		}
+		if err != nil {
+			log.WithError(err).Error("error flattening clone")
+			// the parent can't be removed until the clone is flattened, so the failure is shown in the volume's status
+			rd.setVolumeError(img.Name(), fmt.Errorf("error flattening clone: %w", err))
+			return
+		}
+		log.Info("flattened clone")
+		rd.releaseParent(parent, log)
+	}()
+}
+
+// withFeature adds feature to features if it is not already included
+func withFeature(features []string, feature string) []string {
+	for _, f := range features {
+		if f == feature {
+			return features
+		}
+	}
+	return append([]string{feature}, features...)
+}
+
 //List lists the volumes
 func (rd *RbdDriver) List() (*volume.ListResponse, error) {
 	log.Debug("List")
-	log := log.WithField("pool", rd.pool.Name())
+	log := log.WithField("pool", rd.pool.FullName())
 
-	mutexMapMutex.Lock()
-	defer mutexMapMutex.Unlock()
-	imgs, err := rd.pool.Images()
+	imgs, err := rd.listImages()
 	if err != nil {
 		log.WithError(err).Error("error in driver list")
-		return nil, fmt.Errorf("error in driver list for %v: %w", rd.pool.Name(), err)
+		return nil, fmt.Errorf("error in driver list for %v: %w", rd.pool.FullName(), err)
+	}
+
+	mountpoints, err := rd.pool.MountsUnder(rd.mountpoint)
+	if err != nil {
+		log.WithError(err).Warn("error getting mounts, mountpoints will not be listed")
 	}
+
+	var usage map[string]*rbd.DiskUsage
+	if rd.listUsage {
+		// one rbd du for the whole pool is cheaper than one per image
+		usage, err = rd.pool.DiskUsage()
+		if err != nil {
+			log.WithError(err).Warn("error getting disk usage, usage will not be listed")
+		}
+	}
+
 	vols := make([]*volume.Volume, 0, len(imgs))
 	for _, img := range imgs {
-		vols = append(vols, &volume.Volume{Name: img.Name()})
+		vol := &volume.Volume{Name: img.Name(), Mountpoint: mountpoints[img.Name()]}
+		if du, ok := usage[img.Name()]; ok {
+			vol.Status = diskUsageStatus(du)
+		}
+		vols = append(vols, vol)
 	}
 
 	return &volume.ListResponse{Volumes: vols}, nil
 }
 
+func diskUsageStatus(du *rbd.DiskUsage) map[string]interface{} {
+	status := map[string]interface{}{"provisioned_bytes": int64(du.ProvisionedSize), "provisioned": du.ProvisionedSize.String()}
+	if du.UsedSize != rbd.UsageUnknown {
+		status["used_bytes"] = int64(du.UsedSize)
+	}
+	return status
+}
+
+// listImages lists the images in the pool, using the cached list if it is newer than listCacheTTL
+func (rd *RbdDriver) listImages() ([]*rbd.Image, error) {
+	rd.listCacheMutex.Lock()
+	defer rd.listCacheMutex.Unlock()
+	if rd.listCache != nil && time.Since(rd.listCacheTime) < rd.listCacheTTL {
+		return rd.listCache, nil
+	}
+	imgs := []*rbd.Image{}
+	err := rd.pool.EachImage(func(img *rbd.Image) error {
+		imgs = append(imgs, img)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rd.listCache, rd.listCacheTime = imgs, time.Now()
+	return imgs, nil
+}
+
+func (rd *RbdDriver) invalidateListCache() {
+	rd.listCacheMutex.Lock()
+	defer rd.listCacheMutex.Unlock()
+	rd.listCache = nil
+}
+
+// clusterLock takes the cluster wide lock on img if it is enabled, the returned function releases it
+func (rd *RbdDriver) clusterLock(img *rbd.Image, log *log.Entry) (func(), error) {
+	if rd.clusterLockTTL <= 0 {
+		return func() {}, nil
+	}
+	unlock, err := img.ClusterLock(rd.hostname, rd.clusterLockTTL, rd.clusterLockWait)
+	if err != nil {
+		log.WithError(err).Error("error taking cluster lock")
+		return nil, err
+	}
+	return func() {
+		if err := unlock(); err != nil {
+			log.WithError(err).Warn("error releasing cluster lock")
+		}
+	}, nil
+}
+
 func (rd *RbdDriver) getImg(name string) (*rbd.Image, error) {
 	img, err := rd.pool.GetImage(name)
 	if err != nil {
-		log.WithField("image", rd.pool.Name()+"/"+name).WithError(err).Error("error getting device")
+		log.WithField("image", rd.imgFullName(name)).WithError(err).Error("error getting device")
 	}
 	return img, err
 }
@@ -129,12 +481,30 @@ func (rd *RbdDriver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
 		vol.Mountpoint = mp
 	}
 
+	vol.Status = make(map[string]interface{})
+	if rd.inspectUsage {
+		du, err := img.DiskUsage()
+		if err != nil {
+			log.WithError(err).Warn("error getting disk usage")
+		} else {
+			vol.Status = diskUsageStatus(du)
+		}
+	}
+	if vErr := rd.volumeError(img.Name()); vErr != nil {
+		vol.Status["error"] = vErr.Error()
+	}
+	// docker calls Get when creating and inspecting containers, so it doesn't wait on a call back to docker
+	if containers := rd.cachedContainersUsing(img.Name()); len(containers) > 0 {
+		vol.Status["containers"] = containerNames(containers)
+	}
+
 	return &volume.GetResponse{Volume: vol}, nil
 }
 
 //Remove removes a volume
 func (rd *RbdDriver) Remove(req *volume.RemoveRequest) error {
 	log.WithField("request", req).Debug("remove")
+	defer rd.track()()
 
 	_, log, unlock := rd.imgReqInit(req.Name)
 	defer unlock()
@@ -144,11 +514,53 @@ func (rd *RbdDriver) Remove(req *volume.RemoveRequest) error {
 		return fmt.Errorf("error in driver remove: %w", err)
 	}
 
+	// an engine connected over --listen-tcp doesn't know of the containers using the volume here
+	if err = rd.checkNotInUse(req.Name); errors.Is(err, ErrVolumeInUse) {
+		log.WithError(err).Error("error in driver remove")
+		return fmt.Errorf("error in driver remove: %w", err)
+	} else if err != nil {
+		log.WithError(err).Warn("error checking for containers using the volume")
+	}
+
+	release, err := rd.clusterLock(img, log)
+	if err != nil {
+		return fmt.Errorf("error in driver remove: %w", err)
+	}
+	defer release()
+
+	children, err := img.Children()
+	if err != nil {
+		log.WithError(err).Error("error checking for clones")
+		return fmt.Errorf("error in driver remove: %w", err)
+	}
+	if len(children) > 0 {
+		err = fmt.Errorf("%v is the parent of %v: %w", req.Name, children[0].FullName(), rbd.ErrHasChildren)
+		log.WithError(err).Error("error in driver remove")
+		return fmt.Errorf("error in driver remove: %w", err)
+	}
+
+	parent, err := img.Parent()
+	if err != nil && !errors.Is(err, rbd.ErrNoParent) {
+		log.WithError(err).Warn("error getting parent")
+	}
+
+	defer rd.invalidateListCache()
 	if err = img.Remove(); err != nil {
 		log.WithError(err).Error("error in driver remove")
 		return fmt.Errorf("error in driver remove: %w", err)
 	}
-	return err
+	rd.releaseParent(parent, log)
+	return nil
+}
+
+// releaseParent unprotects the parent snapshot of a removed or flattened clone if it was protected only for cloning
+func (rd *RbdDriver) releaseParent(parent *rbd.Snapshot, log *log.Entry) {
+	if parent == nil {
+		return
+	}
+	if err := parent.ReleaseCloneProtection(); err != nil {
+		log.WithField("parent", parent.FullName()).WithError(err).Warn("error releasing parent snapshot protection")
+	}
 }
 
 //Path returns the mount point of a volume
@@ -176,41 +588,82 @@ func (rd *RbdDriver) Path(req *volume.PathRequest) (*volume.PathResponse, error)
 	return nil, nil
 }
 
+// lockWaitInterval is how often Mount retries while waiting for the exclusive lock
+const lockWaitInterval = 2 * time.Second
+
 //Mount mounts a volume
 func (rd *RbdDriver) Mount(req *volume.MountRequest) (*volume.MountResponse, error) {
 	log.WithField("request", req).Debug("mount")
+	defer rd.track()()
 
 	_, log, unlock := rd.imgReqInit(req.Name)
 	defer unlock()
+	rd.setRequested(req.Name)
 
 	img, err := rd.getImg(req.Name)
 	if err != nil {
 		return nil, fmt.Errorf("error in driver mount: %w", err)
 	}
 
+	release, err := rd.clusterLock(img, log)
+	if err != nil {
+		return nil, fmt.Errorf("error in driver mount: %w", err)
+	}
+	defer release()
+
 	mp := rd.mountPoint(img)
-	err = img.MapAndMountExclusive(mp, "", syscall.MS_NOATIME, "")
+	// the previous client may still be shutting down, so wait for it to release the lock
+	deadline := time.Now().Add(rd.lockWait)
+	for {
+		err = img.MapAndMountExclusive(mp, "", syscall.MS_NOATIME, "")
+		if !errors.Is(err, rbd.ErrExclusiveLockTaken) || !time.Now().Before(deadline) || rd.ctx.Err() != nil {
+			break
+		}
+		log.WithError(err).Info("waiting for exclusive lock")
+		select {
+		case <-time.After(lockWaitInterval):
+		case <-rd.ctx.Done():
+		}
+	}
 	if err != nil {
 		log.WithError(err).Error("error in driver mount")
 		return nil, fmt.Errorf("error in driver mount: %w", err)
 	}
 
+	rd.setVolumeError(img.Name(), nil)
+	if rd.growOnResize {
+		rd.watchResize(img, log)
+	}
 	return &volume.MountResponse{Mountpoint: mp}, nil
 }
 
 //Unmount unmounts a volume
 func (rd *RbdDriver) Unmount(req *volume.UnmountRequest) error {
 	log.WithField("request", req).Debug("unmount")
+	defer rd.track()()
 
 	_, log, unlock := rd.imgReqInit(req.Name)
 	defer unlock()
+	rd.setRequested(req.Name)
 
 	img, err := rd.getImg(req.Name)
+	mp := rd.mountPoint(img)
+	if errors.Is(err, rbd.ErrDoesNotExist) {
+		log.WithError(err).Info("image no longer exists, cleaning up mountpoint")
+		return rd.cleanupMountPoint(mp, log)
+	}
 	if err != nil {
 		return fmt.Errorf("error in driver unmount: %w", err)
 	}
 
-	mp := rd.mountPoint(img)
+	release, err := rd.clusterLock(img, log)
+	if err != nil {
+		return fmt.Errorf("error in driver unmount: %w", err)
+	}
+	defer release()
+
+	rd.stopWatch(img.Name())
+
 	err = img.UnmountAndUnmap(mp)
 	if err != nil {
 		if errors.Is(err, rbd.ErrMountedElsewhere) {
@@ -221,6 +674,298 @@ func (rd *RbdDriver) Unmount(req *volume.UnmountRequest) error {
 		return fmt.Errorf("error in driver unmount: %w", err)
 	}
 
+	rd.setVolumeError(img.Name(), nil)
+	// if the device was already gone, its filesystem may still be mounted here
+	return rd.cleanupMountPoint(mp, log)
+}
+
+// watchResize grows the filesystem of a mounted image when another client resizes it, until the image is unmounted
+func (rd *RbdDriver) watchResize(img *rbd.Image, log *log.Entry) {
+	rd.watchMutex.Lock()
+	if _, ok := rd.watches[img.Name()]; ok {
+		rd.watchMutex.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(rd.ctx)
+	w := &resizeWatch{cancel: cancel}
+	rd.watches[img.Name()] = w
+	rd.watchMutex.Unlock()
+
+	// the watch is started in the background, so the image lock is not held while it is established
+	go func() {
+		defer rd.endWatch(img.Name(), w)
+		events, size, err := rd.startWatch(ctx, img, log)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithError(err).Warn("error watching image, its filesystem will not grow when it is resized")
+			}
+			return
+		}
+		for e := range events {
+			if e.Op != rbd.WatchOpResize && e.Op != rbd.WatchOpHeaderUpdate {
+				continue
+			}
+			info, err := img.Info()
+			if err != nil {
+				log.WithError(err).Warn("error getting image size after notification")
+				continue
+			}
+			if info.Size <= size {
+				continue
+			}
+			log.WithField("size", info.Size).Info("image was resized, growing filesystem")
+			size = info.Size
+			func() {
+				defer rd.track()()
+				defer rbd.LockDev(img)()
+				if err := img.GrowMounted(rbd.GrowFileSystem); err != nil {
+					log.WithError(err).Error("error growing filesystem after resize")
+				}
+			}()
+		}
+	}()
+}
+
+// resizeWatch is a running watch for resizes of a mounted image
+type resizeWatch struct {
+	cancel context.CancelFunc
+}
+
+// startWatch establishes the watch on img and returns its events and the size of the image to compare resizes to
+func (rd *RbdDriver) startWatch(ctx context.Context, img *rbd.Image, log *log.Entry) (<-chan *rbd.WatchEvent, rbd.Size, error) {
+	defer rd.track()()
+	events, err := img.WithContext(ctx).Watch(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	var size rbd.Size
+	if info, err := img.Info(); err == nil {
+		size = info.Size
+	} else {
+		log.WithError(err).Warn("error getting image size to watch for resizes")
+	}
+	return events, size, nil
+}
+
+// endWatch removes a watch which ended, unless it was already replaced
+func (rd *RbdDriver) endWatch(name string, w *resizeWatch) {
+	rd.watchMutex.Lock()
+	defer rd.watchMutex.Unlock()
+	w.cancel()
+	if rd.watches[name] == w {
+		delete(rd.watches, name)
+	}
+}
+
+// stopWatch stops watching an image for resizes
+func (rd *RbdDriver) stopWatch(name string) {
+	rd.watchMutex.Lock()
+	defer rd.watchMutex.Unlock()
+	if w, ok := rd.watches[name]; ok {
+		w.cancel()
+		delete(rd.watches, name)
+	}
+}
+
+func (rd *RbdDriver) cleanupMountPoint(mp string, log *log.Entry) error {
+	if err := rbd.CleanupMountPoint(mp); err != nil {
+		log.WithError(err).Error("error cleaning up mountpoint")
+		return fmt.Errorf("error in driver unmount: %w", err)
+	}
+	return nil
+}
+
+// Mounts returns where a volume is mounted in every mount namespace on the host
+func (rd *RbdDriver) Mounts(req *mountsRequest) (*mountsResponse, error) {
+	log.WithField("request", req).Debug("mounts")
+
+	img, err := rd.getImg(req.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error in driver mounts: %w", err)
+	}
+	resp := &mountsResponse{Mounts: []*volumeMount{}}
+	blk, err := img.Device()
+	if err != nil || blk == "" {
+		return resp, err
+	}
+	nsMounts, err := rbd.ScanNamespaceMounts(blk)
+	if err != nil {
+		return nil, fmt.Errorf("error in driver mounts: %w", err)
+	}
+	for _, nm := range nsMounts {
+		resp.Mounts = append(resp.Mounts, &volumeMount{Namespace: nm.Namespace, Pid: nm.Pid, MountPoint: nm.Mount.MountPoint, Root: nm.Mount.Root})
+	}
+	return resp, nil
+}
+
+// Status returns the detail of a volume: where it is mapped and mounted here, the clients which have it open
+// on any host, its usage, and its migration and mirroring state
+func (rd *RbdDriver) Status(req *statusRequest) (*statusResponse, error) {
+	log := log.WithField("request", req)
+	log.Debug("status")
+
+	img, err := rd.getImg(req.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error in driver status: %w", err)
+	}
+	resp := &statusResponse{Name: img.Name(), Image: img.FullName()}
+	if resp.Status, err = img.Status(); err != nil {
+		return nil, fmt.Errorf("error in driver status: %w", err)
+	}
+	if resp.Device, err = img.Device(); err != nil {
+		return nil, fmt.Errorf("error in driver status: %w", err)
+	}
+	if resp.Mountpoint, err = rd.isMounted(img); err != nil {
+		log.WithError(err).Debug("error determining if rbd is already mounted")
+	}
+	if resp.Usage, err = img.DiskUsage(); err != nil {
+		log.WithError(err).Warn("error getting disk usage")
+	}
+	if vErr := rd.volumeError(img.Name()); vErr != nil {
+		resp.Error = vErr.Error()
+	}
+	if resp.Containers, err = rd.containersUsing(img.Name(), true); err != nil {
+		log.WithError(err).Warn("error getting the containers using the volume")
+	}
+	return resp, nil
+}
+
+// Bench benchmarks a volume. Write benchmarks overwrite the volume, so they must be explicitly allowed
+// and are refused while the volume is in use on any host.
+func (rd *RbdDriver) Bench(req *benchRequest) (*rbd.BenchResult, error) {
+	log := log.WithField("request", req)
+	log.Debug("bench")
+	defer rd.track()()
+
+	if req.Mode != "" && req.Mode != "read" && !req.AllowWrite {
+		return nil, fmt.Errorf("error in driver bench: %v benchmarks overwrite %v, they must be allowed explicitly", req.Mode, req.Name)
+	}
+
+	_, log, unlock := rd.imgReqInit(req.Name)
+	defer unlock()
+
+	img, err := rd.getImg(req.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error in driver bench: %w", err)
+	}
+	if req.Mode != "" && req.Mode != "read" {
+		watchers, err := img.Watchers()
+		if err != nil {
+			return nil, fmt.Errorf("error in driver bench: %w", err)
+		}
+		if len(watchers) > 0 {
+			return nil, fmt.Errorf("error in driver bench: %v is in use: %w", req.Name, rbd.ErrDeviceBusy)
+		}
+	}
+	r, err := img.Bench(req.Mode, req.Size, req.Pattern)
+	if err != nil {
+		log.WithError(err).Error("error in driver bench")
+		return nil, fmt.Errorf("error in driver bench: %w", err)
+	}
+	return r, nil
+}
+
+// GroupSnapshot snapshots the volumes of an rbd group at the same point in time, freezing the filesystems
+// of those mounted here first, so volumes used together, eg: a database's data and wal, are consistent
+func (rd *RbdDriver) GroupSnapshot(req *groupSnapshotRequest) (*groupSnapshotResponse, error) {
+	log := log.WithField("request", req)
+	log.Debug("group snapshot")
+	defer rd.track()()
+
+	if err := rbd.ValidateImageName(req.Group); err != nil {
+		return nil, fmt.Errorf("error in driver group snapshot: invalid group name: %w", err)
+	}
+	group := rd.pool.Group(req.Group)
+	if len(req.Volumes) > 0 {
+		if err := group.Create(); err != nil && !errors.Is(err, rbd.ErrAlreadyExists) {
+			log.WithError(err).Error("error creating group")
+			return nil, fmt.Errorf("error in driver group snapshot: %w", err)
+		}
+		for _, name := range req.Volumes {
+			img, err := rd.getImg(name)
+			if err != nil {
+				return nil, fmt.Errorf("error in driver group snapshot: %w", err)
+			}
+			if err = group.AddImage(img); err != nil && !errors.Is(err, rbd.ErrAlreadyExists) {
+				log.WithError(err).Error("error adding volume to group")
+				return nil, fmt.Errorf("error in driver group snapshot: %w", err)
+			}
+		}
+	}
+
+	imgs, err := group.Images()
+	if err != nil {
+		log.WithError(err).Error("error listing group")
+		return nil, fmt.Errorf("error in driver group snapshot: %w", err)
+	}
+	// lock every volume in the same order every time so concurrent group snapshots can't deadlock
+	names := make([]string, 0, len(imgs))
+	for _, img := range imgs {
+		names = append(names, img.FullName())
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		defer rbd.LockName(n)()
+	}
+
+	snapName := req.Snapshot
+	if snapName == "" {
+		snapName = time.Now().UTC().Format("20060102T150405Z")
+	}
+	if err = group.CreateConsistentSnapshot(snapName); err != nil {
+		log.WithError(err).Error("error in driver group snapshot")
+		return nil, fmt.Errorf("error in driver group snapshot: %w", err)
+	}
+	return &groupSnapshotResponse{Snapshot: snapName, Volumes: names}, nil
+}
+
+//Rename renames a volume, it must not be mapped
+func (rd *RbdDriver) Rename(req *renameRequest) error {
+	log := log.WithField("request", req)
+	log.Debug("rename")
+	defer rd.track()()
+
+	if err := rbd.ValidateImageName(req.NewName); err != nil {
+		log.WithError(err).Error("invalid volume name")
+		return fmt.Errorf("error in driver rename: %w", err)
+	}
+
+	// lock both names in the same order every time so concurrent renames can't deadlock
+	names := []string{rd.imgFullName(req.Name), rd.imgFullName(req.NewName)}
+	sort.Strings(names)
+	defer rbd.LockName(names[0])()
+	if names[1] != names[0] {
+		defer rbd.LockName(names[1])()
+	}
+
+	img, err := rd.getImg(req.Name)
+	if err != nil {
+		return fmt.Errorf("error in driver rename: %w", err)
+	}
+
+	// another host mounting the volume while it is renamed would lose track of it
+	release, err := rd.clusterLock(img, log)
+	if err != nil {
+		return fmt.Errorf("error in driver rename: %w", err)
+	}
+	defer rd.invalidateListCache()
+	renamed, err := img.Rename(req.NewName)
+	release()
+	if err != nil {
+		log.WithError(err).Error("error in driver rename")
+		return fmt.Errorf("error in driver rename: %w", err)
+	}
+	// the lock moved with the image, so release could not find it under the old name
+	if rd.clusterLockTTL > 0 {
+		if err = renamed.ReleaseClusterLock(rd.hostname); err != nil {
+			log.WithError(err).Warn("error releasing cluster lock")
+		}
+	}
+
+	// the image is not mapped, so the old mountpoint can only be an empty directory
+	if err = os.Remove(rd.mountPoint(img)); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Warn("error removing old mountpoint")
+	}
 	return nil
 }
 
@@ -236,10 +981,13 @@ func (rd *RbdDriver) reap(olderThan time.Time) {
 		log.WithError(err).Error("error getting mapped images for reaping")
 		return
 	}
+	// every unmount in this reap shares one scan of the other mount namespaces
+	scan := rbd.NewMountScan()
 	for _, img := range mapped {
+		done := rd.track()
 		go func(img *rbd.Image) {
-			lock(img.FullName())
-			defer unlock(img.FullName())
+			defer done()
+			defer rbd.LockDev(img)()
 			log := log.WithField("image", img.FullName())
 			blk, err := img.Device()
 			if err != nil {
@@ -261,8 +1009,17 @@ func (rd *RbdDriver) reap(olderThan time.Time) {
 			if olderThan.Before(blkStats.ModTime()) {
 				return
 			}
+			containers, err := rd.containersUsing(img.Name(), false)
+			if err != nil {
+				log.WithError(err).Warn("error getting the containers using the volume, not reaping")
+				return
+			}
+			if len(containers) > 0 {
+				log.WithField("containers", containerNames(containers)).Debug("volume is in use, not reaping")
+				return
+			}
 			mp := rd.mountPoint(img)
-			err = img.UnmountAndUnmap(mp)
+			err = img.UnmountAndUnmapWithScan(mp, scan)
 			if errors.Is(err, rbd.ErrMountedElsewhere) {
 				return
 			}
@@ -274,3 +1031,197 @@ func (rd *RbdDriver) reap(olderThan time.Time) {
 		}(img)
 	}
 }
+
+// setVolumeError records an error to report in the status of a volume, nil clears it
+func (rd *RbdDriver) setVolumeError(name string, err error) {
+	rd.volErrMutex.Lock()
+	defer rd.volErrMutex.Unlock()
+	if err == nil {
+		delete(rd.volErrs, name)
+		return
+	}
+	rd.volErrs[name] = err
+}
+
+// probeKey identifies the filesystem error count of an image on a device, devices are reused by other images
+type probeKey struct {
+	image string
+	blk   string
+}
+
+// probeError is a volume error set by a failed health probe
+type probeError struct{ err error }
+
+func (e *probeError) Error() string { return e.err.Error() }
+
+func (e *probeError) Unwrap() error { return e.err }
+
+// clearProbeError clears the error of a volume if it was set by a health probe, errors set elsewhere, like a failed
+// reattach, are not cleared by a passing probe
+func (rd *RbdDriver) clearProbeError(name string) {
+	rd.volErrMutex.Lock()
+	defer rd.volErrMutex.Unlock()
+	var pErr *probeError
+	if errors.As(rd.volErrs[name], &pErr) {
+		delete(rd.volErrs, name)
+	}
+}
+
+func (rd *RbdDriver) volumeError(name string) error {
+	rd.volErrMutex.Lock()
+	defer rd.volErrMutex.Unlock()
+	return rd.volErrs[name]
+}
+
+// recover reattaches images mounted under the mountpoint whose rbd-nbd process has died
+func (rd *RbdDriver) recover() {
+	dead, err := rbd.DeadMountsUnder(rd.mountpoint)
+	if err != nil {
+		log.WithError(err).Error("error checking for dead mounts")
+		return
+	}
+	for _, dm := range dead {
+		rel, err := filepath.Rel(rd.mountpoint, dm.MountPoint)
+		if err != nil || rel == "." {
+			continue
+		}
+		name := strings.SplitN(rel, string(filepath.Separator), 2)[0]
+		done := rd.track()
+		go func(name string, dm *rbd.DeadMount) {
+			defer done()
+			_, log, unlock := rd.imgReqInit(name)
+			defer unlock()
+			log = log.WithField("blk", dm.Device).WithField("mountpoint", dm.MountPoint)
+
+			img, err := rd.getImg(name)
+			if err == nil {
+				// a previous check may have already reattached it
+				if blk, _ := img.Device(); blk != "" {
+					return
+				}
+				log.Warn("rbd-nbd process died, reattaching")
+				err = img.Reattach(dm.Device)
+			}
+			if err != nil {
+				reattaches.Add("failed", 1)
+				log.WithError(err).Error("error reattaching image")
+				rd.setVolumeError(name, fmt.Errorf("rbd-nbd died and reattach failed: %w", err))
+				return
+			}
+			reattaches.Add("succeeded", 1)
+			rd.setVolumeError(name, nil)
+			log.Info("reattached image")
+		}(name, dm)
+	}
+}
+
+// probe checks the health of mapped images, fencing unhealthy devices if enabled so they can be reattached
+func (rd *RbdDriver) probe() {
+	mapped, err := rd.pool.MappedImages()
+	if err != nil {
+		log.WithError(err).Error("error getting mapped images for probe")
+		return
+	}
+	probed := make(map[probeKey]struct{}, len(mapped))
+	for _, img := range mapped {
+		log := log.WithField("image", img.FullName())
+		blk, err := img.Device()
+		if err != nil || blk == "" {
+			continue
+		}
+		log = log.WithField("blk", blk)
+		key := probeKey{image: img.Name(), blk: blk}
+		probed[key] = struct{}{}
+
+		h := rbd.ProbeDevice(blk, rd.probeTimeout)
+		err = h.Err
+		rd.probeMutex.Lock()
+		lastFSErrors, seen := rd.probeFSErrors[key]
+		rd.probeFSErrors[key] = h.FSErrors
+		rd.probeMutex.Unlock()
+		// -1 is a filesystem without an error count, or one not mounted yet
+		if err == nil && seen && lastFSErrors >= 0 && h.FSErrors > lastFSErrors {
+			err = fmt.Errorf("filesystem error count on %v increased from %v to %v: %w", blk, lastFSErrors, h.FSErrors, rbd.ErrIO)
+		}
+		if err == nil {
+			rd.clearProbeError(img.Name())
+			continue
+		}
+
+		probeFailures.Add(img.Name(), 1)
+		log.WithError(err).Error("device failed health probe")
+		rd.setVolumeError(img.Name(), &probeError{err})
+		if rd.probeFence {
+			rd.fence(img, blk, log)
+		}
+	}
+
+	// a device unmapped since the last probe may be reused by another image
+	rd.probeMutex.Lock()
+	defer rd.probeMutex.Unlock()
+	for key := range rd.probeFSErrors {
+		if _, ok := probed[key]; !ok {
+			delete(rd.probeFSErrors, key)
+		}
+	}
+}
+
+// sparsify reclaims zeroed space in images which are not in use on any host.
+// Cancelling ctx kills a running sparsify, which is safe to interrupt, and ends the pass.
+func (rd *RbdDriver) sparsify(ctx context.Context) {
+	imgs, err := rd.pool.Images()
+	if err != nil {
+		log.WithError(err).Error("error listing images to sparsify")
+		return
+	}
+	for _, img := range imgs {
+		if ctx.Err() != nil {
+			return
+		}
+		rd.sparsifyImage(img.WithContext(ctx))
+	}
+}
+
+func (rd *RbdDriver) sparsifyImage(img *rbd.Image) {
+	defer rd.track()()
+	defer rbd.LockDev(img)()
+	log := log.WithField("image", img.FullName())
+
+	// an image mapped anywhere is in use, sparsify would compete with its i/o
+	watchers, err := img.Watchers()
+	if err != nil {
+		log.WithError(err).Error("error getting watchers before sparsify")
+		return
+	}
+	if len(watchers) > 0 {
+		return
+	}
+	if err = img.Sparsify(0); err != nil {
+		log.WithError(err).Error("error sparsifying image")
+		return
+	}
+	log.Debug("sparsified image")
+}
+
+// fence kills the rbd-nbd process behind blk, recover will reattach it
+func (rd *RbdDriver) fence(img *rbd.Image, blk string, log *log.Entry) {
+	done := rd.track()
+	go func() {
+		defer done()
+		defer rbd.LockDev(img)()
+		if err := rbd.FenceDevice(blk); err != nil {
+			log.WithError(err).Error("error fencing device")
+			return
+		}
+		log.Warn("fenced device")
+		// the kernel can take a while to drop the fenced watch, any others are clients elsewhere still using the image
+		status, err := img.Status()
+		if err != nil {
+			log.WithError(err).Warn("error getting status after fencing")
+			return
+		}
+		if len(status.Watchers) > 0 {
+			log.WithField("watchers", status.Watchers).Warn("image is still open after fencing")
+		}
+	}()
+}
@@ -2,15 +2,24 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"os/user"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/TrilliumIT/docker-rbd-plugin/docker"
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
 	"github.com/coreos/go-systemd/activation"
 	"github.com/docker/go-plugins-helpers/volume"
 	log "github.com/sirupsen/logrus"
@@ -20,6 +29,7 @@ import (
 const (
 	version         = "0.2.3"
 	shutdownTimeout = 10 * time.Second
+	defaultSocket   = "/run/docker/plugins/rbd.sock"
 )
 
 func main() {
@@ -36,6 +46,26 @@ func main() {
 			Value: "docker",
 			Usage: "Name of the pool in which to create our rbd images. Default \"docker\". Pool MUST already exist in ceph cluster.",
 		},
+		cli.StringFlag{
+			Name:  "namespace",
+			Usage: "Namespace within the pool in which to create rbd images (empty for the default namespace). Namespace MUST already exist.",
+		},
+		cli.StringFlag{
+			Name:  "ceph-cluster",
+			Usage: "Name of the ceph cluster, which selects /etc/ceph/<name>.conf (empty for ceph).",
+		},
+		cli.StringFlag{
+			Name:  "ceph-id",
+			Usage: "Ceph client id to connect as, without the client. prefix (empty for admin).",
+		},
+		cli.StringFlag{
+			Name:  "ceph-conf",
+			Usage: "Path of the ceph config file (empty for the default of the cluster).",
+		},
+		cli.StringFlag{
+			Name:  "ceph-keyring",
+			Usage: "Path of the ceph keyring (empty for the default of the client).",
+		},
 
 		cli.StringFlag{
 			Name:  "default-size",
@@ -49,6 +79,39 @@ func main() {
 			Usage:  "Default filesystem when creating an rbd image.",
 			EnvVar: "RBD_DEFAULT_FS",
 		},
+		cli.StringFlag{
+			Name:  "default-features",
+			Value: "exclusive-lock",
+			Usage: "Default comma separated image features when creating an rbd image. exclusive-lock is always enabled.",
+		},
+		cli.BoolFlag{
+			Name:  "verify-pool",
+			Usage: "Fail on startup if --pool does not exist",
+		},
+		cli.BoolFlag{
+			Name:  "create-pool",
+			Usage: "Create --pool on startup if it does not exist. Requires the ceph binary.",
+		},
+		cli.IntFlag{
+			Name:  "create-pool-pg-num",
+			Usage: "Placement groups for a pool created by --create-pool (0 for the cluster default)",
+		},
+		cli.StringFlag{
+			Name:  "default-data-pool",
+			Usage: "Default pool for image data when creating an rbd image, eg: an erasure coded pool. Metadata is always stored in --pool.",
+		},
+		cli.BoolFlag{
+			Name:  "flatten-clones",
+			Usage: "Flatten volumes created with the clone-from option in the background, so their parent can be removed. Overridden by the flatten option.",
+		},
+		cli.StringSliceFlag{
+			Name:  "mkfs-args",
+			Usage: "Arguments for mkfs as fs=args, eg: xfs=\"-K -m reflink=1\". Replaces the built in arguments for that filesystem. May be repeated.",
+		},
+		cli.StringSliceFlag{
+			Name:  "mount-data",
+			Usage: "Default mount data as fs=data, eg: ext4=data=ordered. May be repeated.",
+		},
 		cli.StringFlag{
 			Name:   "mountpoint",
 			Value:  "/var/lib/docker-volumes/rbd",
@@ -64,6 +127,152 @@ func main() {
 			// an admistrator just mapped manually
 			Usage: "reap mapped images (0 to disable)",
 		},
+		cli.DurationFlag{
+			Name:  "list-cache",
+			Value: 30 * time.Second,
+			Usage: "How long to cache the image list for volume list requests, volumes created or removed by this plugin are always listed immediately (0 to disable).",
+		},
+		cli.BoolFlag{
+			Name:  "list-usage",
+			Usage: "Report provisioned and used bytes in volume list, from one rbd du of the pool. Slow on images without fast-diff.",
+		},
+		cli.BoolFlag{
+			Name:  "inspect-usage",
+			Usage: "Report provisioned and used bytes in volume inspect. Used bytes are only reported for images with fast-diff.",
+		},
+		cli.DurationFlag{
+			Name:  "mapped-cache",
+			Value: rbd.DefaultMappedCacheTTL,
+			Usage: "How long to cache the list of mapped devices (0 to disable).",
+		},
+		cli.DurationFlag{
+			Name:  "info-cache",
+			Value: rbd.DefaultInfoCacheTTL,
+			Usage: "How long to cache image info, which volume get and path check on every call (0 to disable). Changes made by other hosts may not be seen until it expires.",
+		},
+		cli.StringFlag{
+			Name:  "backend",
+			Value: rbd.CLIBackend,
+			Usage: fmt.Sprintf("Backend for image operations, mapping always uses the rbd cli. Compiled in: %v.", rbd.Backends()),
+		},
+		cli.DurationFlag{
+			Name:  "cluster-lock-ttl",
+			Usage: "Take a cluster wide lock on images during mount, unmount and remove, so hosts cannot change an image at the same time. Locks not refreshed within this time are broken (0 to disable).",
+		},
+		cli.DurationFlag{
+			Name:  "cluster-lock-wait",
+			Value: 30 * time.Second,
+			Usage: "How long to wait for a cluster wide lock held by another host.",
+		},
+		cli.DurationFlag{
+			Name:  "recover",
+			Value: 10 * time.Second,
+			Usage: "check mounted images this often and reattach any whose rbd-nbd process has died (0 to disable)",
+		},
+		cli.BoolFlag{
+			Name:  "quiesce",
+			Usage: "map images with rbd-nbd's quiesce support, so snapshots taken by any client freeze the filesystem (requires pacific or later)",
+		},
+		cli.StringFlag{
+			Name:  "quiesce-hook",
+			Usage: "hook script rbd-nbd runs to quiesce and unquiesce a device, instead of its default",
+		},
+		cli.DurationFlag{
+			Name:  "lock-wait",
+			Usage: "wait up to this long for another client to release an image's exclusive lock when mounting",
+		},
+		cli.DurationFlag{
+			Name:  "probe",
+			Value: time.Minute,
+			Usage: "probe mapped devices for i/o errors this often, failures are logged and reported in volume status (0 to disable)",
+		},
+		cli.DurationFlag{
+			Name:  "probe-timeout",
+			Value: 10 * time.Second,
+			Usage: "consider a device failed if a probe read takes longer than this",
+		},
+		cli.BoolFlag{
+			Name:  "probe-fence",
+			Usage: "kill the rbd-nbd process of devices that fail a probe, so --recover reattaches them",
+		},
+		cli.BoolFlag{
+			Name:  "grow-on-resize",
+			Usage: "grow the filesystem of mounted volumes when their image is resized by another client",
+		},
+		cli.DurationFlag{
+			Name:  "sparsify",
+			Usage: "sparsify images which are not in use on any host this often, reclaiming zeroed space (0 to disable)",
+		},
+		cli.DurationFlag{
+			Name:  "perf",
+			Usage: "collect the i/o of each volume and the capacity and i/o of the pool this often, served as volume_perf and pool_perf on the admin socket (0 to disable, volume i/o requires the rbd_support mgr module and pool stats the ceph binary)",
+		},
+		cli.IntFlag{
+			Name:  "max-rbd-procs",
+			Value: rbd.DefaultCmdLimit,
+			Usage: "Maximum number of concurrent rbd processes, additional commands will queue (0 for no limit).",
+		},
+		cli.StringFlag{
+			Name:   "rbd-binary",
+			Usage:  "Name or path of the rbd binary, eg: a wrapper script that runs rbd in a container. Defaults to rbd from $PATH.",
+			EnvVar: "RBD_BINARY",
+		},
+		cli.DurationFlag{
+			Name:  "rbd-timeout",
+			Value: 5 * time.Minute,
+			Usage: "Kill rbd commands that run longer than this (0 to disable).",
+		},
+		cli.IntFlag{
+			Name:  "rbd-retries",
+			Value: 1,
+			Usage: "Run rbd commands that fail with transient errors, such as monitor timeouts, up to this many times (1 to disable). Map commands, and commands killed at --rbd-timeout, are never retried.",
+		},
+		cli.DurationFlag{
+			Name:  "rbd-retry-backoff",
+			Value: time.Second,
+			Usage: "Wait before retrying a failed rbd command, doubling for each further retry.",
+		},
+		cli.DurationFlag{
+			Name:  "rbd-retry-max-backoff",
+			Value: 30 * time.Second,
+			Usage: "Maximum wait between retries of a failed rbd command.",
+		},
+		cli.StringFlag{
+			Name:  "listen-tcp",
+			Usage: "Also serve the plugin api with TLS on this tcp address, eg: :7500. Requires --tls-cert, --tls-key and --tls-ca.",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "TLS certificate for --listen-tcp.",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "TLS key for --listen-tcp.",
+		},
+		cli.StringFlag{
+			Name:  "tls-ca",
+			Usage: "CA for verifying client certificates on --listen-tcp. Clients must present a certificate signed by this CA.",
+		},
+		cli.StringFlag{
+			Name:  "docker-socket",
+			Value: docker.DefaultSocket,
+			Usage: "Docker engine api socket, used to find the containers using volumes (empty to disable).",
+		},
+		cli.StringFlag{
+			Name:  "driver-name",
+			Value: "rbd",
+			Usage: "Volume driver name docker knows the plugin by, eg: rbd for a plugin listening on /run/docker/plugins/rbd.sock. Containers using volumes of other drivers with the same name are ignored.",
+		},
+		cli.DurationFlag{
+			Name:  "reconcile-wait",
+			Value: 2 * time.Minute,
+			Usage: "At startup, wait this long for the docker api to unmount and unmap the volumes no running container uses. If it can't be reached, mounted volumes are left alone.",
+		},
+		cli.StringFlag{
+			Name:  "admin-socket",
+			Value: "/run/docker-rbd-plugin/admin.sock",
+			Usage: "Unix socket for admin operations (empty to disable).",
+		},
 		cli.BoolFlag{
 			Name:        "verbose",
 			Usage:       "verbose output",
@@ -71,6 +280,126 @@ func main() {
 		},
 	}
 	app.Action = Run
+	app.Commands = []cli.Command{
+		{
+			Name:  "admin",
+			Usage: "run admin operations on the running plugin",
+			Subcommands: []cli.Command{
+				{
+					Name:      "rename",
+					Usage:     "rename a volume, it must not be in use",
+					ArgsUsage: "NAME NEW_NAME",
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 2 {
+							return fmt.Errorf("rename requires NAME and NEW_NAME")
+						}
+						req := &renameRequest{Name: c.Args().Get(0), NewName: c.Args().Get(1)}
+						return adminCall(c.GlobalString("admin-socket"), "Volume.Rename", req, nil)
+					},
+				},
+				{
+					Name:      "bench",
+					Usage:     "benchmark a volume with rbd bench",
+					ArgsUsage: "NAME",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "mode",
+							Value: "read",
+							Usage: "read, write or readwrite",
+						},
+						cli.StringFlag{
+							Name:  "size",
+							Usage: "total i/o, eg: 1G (empty for the rbd default)",
+						},
+						cli.StringFlag{
+							Name:  "pattern",
+							Usage: "seq or rand (empty for the rbd default)",
+						},
+						cli.BoolFlag{
+							Name:  "allow-write",
+							Usage: "allow write benchmarks, which overwrite the volume's data",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return fmt.Errorf("bench requires NAME")
+						}
+						req := &benchRequest{
+							Name:       c.Args().Get(0),
+							Mode:       c.String("mode"),
+							Size:       c.String("size"),
+							Pattern:    c.String("pattern"),
+							AllowWrite: c.Bool("allow-write"),
+						}
+						resp := &rbd.BenchResult{}
+						if err := adminCall(c.GlobalString("admin-socket"), "Volume.Bench", req, resp); err != nil {
+							return err
+						}
+						fmt.Printf("elapsed: %v ops: %v ops/sec: %.2f bytes/sec: %.0f\n", resp.Elapsed, resp.Ops, resp.OpsPerSec, resp.BytesPerSec)
+						return nil
+					},
+				},
+				{
+					Name:      "group-snap",
+					Usage:     "snapshot the volumes of a group at the same point in time, freezing their filesystems together",
+					ArgsUsage: "GROUP [VOLUME...]",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "snapshot",
+							Usage: "snapshot name (empty for the current time)",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 1 {
+							return fmt.Errorf("group-snap requires GROUP")
+						}
+						req := &groupSnapshotRequest{Group: c.Args().Get(0), Volumes: c.Args().Tail(), Snapshot: c.String("snapshot")}
+						resp := &groupSnapshotResponse{}
+						if err := adminCall(c.GlobalString("admin-socket"), "Volume.GroupSnapshot", req, resp); err != nil {
+							return err
+						}
+						fmt.Printf("%v: %v\n", resp.Snapshot, strings.Join(resp.Volumes, " "))
+						return nil
+					},
+				},
+				{
+					Name:      "status",
+					Usage:     "show a volume's device, mountpoint, usage, watchers, and migration and mirroring state",
+					ArgsUsage: "NAME",
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return fmt.Errorf("status requires NAME")
+						}
+						resp := &statusResponse{}
+						if err := adminCall(c.GlobalString("admin-socket"), "Volume.Status", &statusRequest{Name: c.Args().Get(0)}, resp); err != nil {
+							return err
+						}
+						enc := json.NewEncoder(os.Stdout)
+						enc.SetIndent("", "  ")
+						return enc.Encode(resp)
+					},
+				},
+				{
+					Name:      "mounts",
+					Usage:     "list where a volume is mounted in every mount namespace on the host",
+					ArgsUsage: "NAME",
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return fmt.Errorf("mounts requires NAME")
+						}
+						resp := &mountsResponse{}
+						if err := adminCall(c.GlobalString("admin-socket"), "Volume.Mounts", &mountsRequest{Name: c.Args().Get(0)}, resp); err != nil {
+							return err
+						}
+						for _, m := range resp.Mounts {
+							fmt.Printf("%v\t%v\t%v\t%v\n", m.Namespace, m.Pid, m.MountPoint, m.Root)
+						}
+						return nil
+					},
+				},
+			},
+		},
+	}
 	app.Before = func(c *cli.Context) error {
 		if verbose {
 			log.SetLevel(log.DebugLevel)
@@ -83,6 +412,20 @@ func main() {
 	}
 }
 
+// verifyPool checks that the pool exists, creating it if create is set
+func verifyPool(name string, create bool, pgNum int) error {
+	pool := rbd.GetPool(name)
+	exists, err := pool.Exists()
+	if err != nil || exists {
+		return err
+	}
+	if !create {
+		return fmt.Errorf("pool %v: %w", name, rbd.ErrDoesNotExist)
+	}
+	log.WithField("pool", name).Info("creating pool")
+	return pool.Create(pgNum, true)
+}
+
 // Run runs the driver
 func Run(ctx *cli.Context) error {
 	u, err := user.Current()
@@ -94,59 +437,273 @@ func Run(ctx *cli.Context) error {
 		return fmt.Errorf("user is not root")
 	}
 
-	d, err := NewRbdDriver(ctx.String("pool"), ctx.String("default-size"), ctx.String("default-filesystem"), ctx.String("mountpoint"))
+	rbd.SetRbdBinary(ctx.String("rbd-binary"))
+	rbd.SetDefaultCluster(rbd.Cluster{
+		Name:    ctx.String("ceph-cluster"),
+		ID:      ctx.String("ceph-id"),
+		Conf:    ctx.String("ceph-conf"),
+		Keyring: ctx.String("ceph-keyring"),
+	})
+	if release := rbd.CLIRelease(); release != "" {
+		log.WithField("release", release).Info("detected rbd cli release")
+	} else {
+		log.Warn("unable to detect the rbd cli release, assuming a current release")
+	}
+	rbd.SetCmdLimit(ctx.Int("max-rbd-procs"))
+	rbd.SetCmdTimeout(ctx.Duration("rbd-timeout"))
+	rbd.SetRetryPolicy(&rbd.RetryPolicy{
+		Attempts:   ctx.Int("rbd-retries"),
+		Backoff:    ctx.Duration("rbd-retry-backoff"),
+		MaxBackoff: ctx.Duration("rbd-retry-max-backoff"),
+	})
+	rbd.SetMappedCacheTTL(ctx.Duration("mapped-cache"))
+	rbd.SetInfoCacheTTL(ctx.Duration("info-cache"))
+	rbd.SetQuiesce(ctx.Bool("quiesce"), ctx.String("quiesce-hook"))
+	if err = rbd.SetBackend(ctx.String("backend")); err != nil {
+		return err
+	}
+	if err = setFileSystemProfiles(ctx.StringSlice("mkfs-args"), ctx.StringSlice("mount-data")); err != nil {
+		return err
+	}
+
+	if ctx.Bool("verify-pool") || ctx.Bool("create-pool") {
+		if err = verifyPool(ctx.String("pool"), ctx.Bool("create-pool"), ctx.Int("create-pool-pg-num")); err != nil {
+			return err
+		}
+	}
+
+	d, err := NewRbdDriver(&RbdDriverOptions{
+		Pool:              ctx.String("pool"),
+		Namespace:         ctx.String("namespace"),
+		DefaultSize:       ctx.String("default-size"),
+		DefaultFileSystem: ctx.String("default-filesystem"),
+		DefaultFeatures:   ctx.String("default-features"),
+		DefaultDataPool:   ctx.String("default-data-pool"),
+		Mountpoint:        ctx.String("mountpoint"),
+		ListCacheTTL:      ctx.Duration("list-cache"),
+		ListUsage:         ctx.Bool("list-usage"),
+		InspectUsage:      ctx.Bool("inspect-usage"),
+		ClusterLockTTL:    ctx.Duration("cluster-lock-ttl"),
+		ClusterLockWait:   ctx.Duration("cluster-lock-wait"),
+		ProbeTimeout:      ctx.Duration("probe-timeout"),
+		ProbeFence:        ctx.Bool("probe-fence"),
+		FlattenClones:     ctx.Bool("flatten-clones"),
+		LockWait:          ctx.Duration("lock-wait"),
+		GrowOnResize:      ctx.Bool("grow-on-resize"),
+		DockerSocket:      ctx.String("docker-socket"),
+		DriverName:        ctx.String("driver-name"),
+	})
 	if err != nil {
 		return err
 	}
 
+	// docker may not serve its api until the plugin is up, so this runs alongside the handlers
+	reconcileCtx, cancelReconcile := context.WithCancel(context.Background())
+	reconciled := make(chan struct{})
+	go func() {
+		defer close(reconciled)
+		d.reconcile(reconcileCtx, ctx.Duration("reconcile-wait"))
+	}()
+	stopReconcile := func() {
+		cancelReconcile()
+		<-reconciled
+	}
+
 	reapDur := ctx.Duration("reap")
-	if reapDur != 0 {
-		ticker := time.NewTicker(reapDur)
+	stopReap := every(reapDur, func(t time.Time) { d.reap(t.Add(-reapDur)) })
+	stopRecover := every(ctx.Duration("recover"), func(time.Time) { d.recover() })
+	stopProbe := every(ctx.Duration("probe"), func(time.Time) { d.probe() })
+	stopPerf := every(ctx.Duration("perf"), func(time.Time) { d.collectPerf() })
+	sparsifyCtx, cancelSparsify := context.WithCancel(context.Background())
+	stopSparsifyTicker := every(ctx.Duration("sparsify"), func(time.Time) { d.sparsify(sparsifyCtx) })
+	// a sparsify pass can run for a long time, so it is killed rather than waited for
+	stopSparsify := func() {
+		cancelSparsify()
+		stopSparsifyTicker()
+	}
+
+	var adminSrv *http.Server
+	if adminSocket := ctx.String("admin-socket"); adminSocket != "" {
+		if err = os.MkdirAll(filepath.Dir(adminSocket), 0755); err != nil {
+			return fmt.Errorf("error creating admin socket directory: %w", err)
+		}
+		l, err := listenAdmin(adminSocket)
+		if err != nil {
+			return err
+		}
+		adminSrv = &http.Server{Handler: d.adminHandler()}
 		go func() {
-			for t := range ticker.C {
-				d.reap(t.Add(-reapDur))
+			if err := adminSrv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.WithError(err).Error("error serving admin socket")
 			}
 		}()
 	}
 
-	h := volume.NewHandler(d)
-	errCh := make(chan error)
+	// each listener gets its own handler so each can be shut down
 	listeners, _ := activation.Listeners() // wtf coreos, this funciton never returns errors
-	if len(listeners) > 1 {
-		log.Warn("driver does not support multiple sockets")
+	serveDefault := true
+	for _, l := range listeners {
+		if l.Addr().String() == defaultSocket {
+			serveDefault = false
+		}
+	}
+	handlers := make([]*volume.Handler, 0, len(listeners)+2)
+	errCh := make(chan error, len(listeners)+2)
+	if addr := ctx.String("listen-tcp"); addr != "" {
+		l, err := tlsListener(addr, ctx.String("tls-cert"), ctx.String("tls-key"), ctx.String("tls-ca"))
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
 	}
-	if len(listeners) == 0 {
+	for _, l := range listeners {
+		h := volume.NewHandler(d)
+		handlers = append(handlers, h)
+		log.WithField("listener", l.Addr().String()).Debug("launching volume handler")
+		go func(l net.Listener) { errCh <- h.Serve(l) }(l)
+	}
+	if serveDefault {
+		h := volume.NewHandler(d)
+		handlers = append(handlers, h)
 		log.Debug("launching volume handler on default socket")
 		go func() { errCh <- h.ServeUnix("rbd", 0) }()
-	} else {
-		l := listeners[0]
-		log.WithField("listener", l.Addr().String()).Debug("launching volume handler")
-		go func() { errCh <- h.Serve(l) }()
 	}
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	defer close(c)
 	signal.Notify(c, os.Interrupt)
 	signal.Notify(c, syscall.SIGTERM)
 
+	running := len(handlers)
 	select {
 	case err = <-errCh:
 		log.WithError(err).Error("error running handler")
-		close(errCh)
+		running--
 	case <-c:
 	}
 
 	toCtx, toCtxCancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer toCtxCancel()
-	if sErr := h.Shutdown(toCtx); sErr != nil {
-		err = sErr
-		log.WithError(err).Error("error shutting down handler")
+	for _, h := range handlers {
+		if sErr := h.Shutdown(toCtx); sErr != nil {
+			err = sErr
+			log.WithError(err).Error("error shutting down handler")
+		}
 	}
 
-	if hErr := <-errCh; hErr != nil && !errors.Is(hErr, http.ErrServerClosed) {
-		err = hErr
-		log.WithError(err).Error("error in handler after shutdown")
+	if adminSrv != nil {
+		if sErr := adminSrv.Shutdown(toCtx); sErr != nil {
+			log.WithError(sErr).Error("error shutting down admin socket")
+		}
+	}
+
+	// no new operations can start once the handlers and background checks have stopped
+	stopReconcile()
+	stopReap()
+	stopRecover()
+	stopProbe()
+	stopPerf()
+	stopSparsify()
+	if dErr := d.Drain(toCtx); dErr != nil {
+		err = dErr
+		log.WithError(err).Error("error waiting for in flight operations")
+	}
+
+	for ; running > 0; running-- {
+		if hErr := <-errCh; hErr != nil && !errors.Is(hErr, http.ErrServerClosed) {
+			err = hErr
+			log.WithError(err).Error("error in handler after shutdown")
+		}
 	}
 
 	return err
 }
+
+// every calls f every d until the returned function is called, which also waits for f to return. f is never called if d is 0.
+func every(d time.Duration, f func(time.Time)) func() {
+	if d == 0 {
+		return func() {}
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	ticker := time.NewTicker(d)
+	go func() {
+		defer close(done)
+		defer ticker.Stop()
+		for {
+			select {
+			case t := <-ticker.C:
+				f(t)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// tlsListener listens on addr with TLS, requiring client certificates signed by ca. The plugin api can mount and
+// remove any volume, so it is never served to clients without a verified certificate.
+func tlsListener(addr, cert, key, ca string) (net.Listener, error) {
+	if cert == "" || key == "" || ca == "" {
+		return nil, fmt.Errorf("--listen-tcp requires --tls-cert, --tls-key and --tls-ca")
+	}
+	keyPair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("error loading tls certificate: %w", err)
+	}
+	caPEM, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tls ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in tls ca %v", ca)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %v: %w", addr, err)
+	}
+	return tls.NewListener(l, tlsConfig), nil
+}
+
+func setFileSystemProfiles(mkfsArgs, mountData []string) error {
+	profiles := make(map[string]rbd.FileSystemProfile)
+	getProfile := func(fs string) rbd.FileSystemProfile {
+		if p, ok := profiles[fs]; ok {
+			return p
+		}
+		return rbd.GetFileSystemProfile(fs)
+	}
+	for _, a := range mkfsArgs {
+		parts := strings.SplitN(a, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid mkfs-args %v, must be fs=args", a)
+		}
+		p := getProfile(parts[0])
+		p.MkfsArgs = strings.Fields(parts[1])
+		profiles[parts[0]] = p
+	}
+	for _, d := range mountData {
+		parts := strings.SplitN(d, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid mount-data %v, must be fs=data", d)
+		}
+		p := getProfile(parts[0])
+		p.MountData = parts[1]
+		profiles[parts[0]] = p
+	}
+	for fs, p := range profiles {
+		log.WithField("fs", fs).WithField("mkfs-args", p.MkfsArgs).WithField("mount-data", p.MountData).Debug("setting filesystem profile")
+		rbd.SetFileSystemProfile(fs, p)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
+	log "github.com/sirupsen/logrus"
+)
+
+// metrics are served by the admin socket at /debug/vars
+var (
+	probeFailures = expvar.NewMap("probe_failures")
+	reattaches    = expvar.NewMap("reattaches")
+)
+
+// lastPerf is the i/o of each volume, keyed by volume name, and of the pool from the last collectPerf
+var lastPerf = struct {
+	sync.Mutex
+	volumes map[string]*rbd.ImagePerf
+	pool    *rbd.PoolStats
+}{volumes: map[string]*rbd.ImagePerf{}}
+
+func init() {
+	expvar.Publish("rbd_cmds", expvar.Func(func() interface{} { return rbd.CmdStats() }))
+	expvar.Publish("volume_perf", expvar.Func(func() interface{} {
+		lastPerf.Lock()
+		defer lastPerf.Unlock()
+		return lastPerf.volumes
+	}))
+	expvar.Publish("pool_perf", expvar.Func(func() interface{} {
+		lastPerf.Lock()
+		defer lastPerf.Unlock()
+		return lastPerf.pool
+	}))
+}
+
+// collectPerf replaces volume_perf with the i/o of every volume in the pool, volumes without recent i/o are left out,
+// and pool_perf with the capacity and i/o of the pool. A failed collection leaves the previous one in place.
+func (rd *RbdDriver) collectPerf() {
+	if all, err := rd.pool.ImagePerf(); err != nil {
+		log.WithError(err).Warn("error collecting volume perf stats")
+	} else {
+		volumes := make(map[string]*rbd.ImagePerf, len(all))
+		for _, p := range all {
+			volumes[p.Image] = p
+		}
+		lastPerf.Lock()
+		lastPerf.volumes = volumes
+		lastPerf.Unlock()
+	}
+
+	if pool, err := rd.pool.PerfStats(); err != nil {
+		log.WithError(err).Warn("error collecting pool perf stats")
+	} else {
+		lastPerf.Lock()
+		lastPerf.pool = pool
+		lastPerf.Unlock()
+	}
+}
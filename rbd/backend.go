@@ -0,0 +1,90 @@
+package rbd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// backend performs the image operations that do not need an nbd device.
+// Mapping and unmapping always use the rbd cli.
+type backend interface {
+	createImage(pool *Pool, name string, size Size, args ...string) error
+	// eachImage calls fn with the name of each image in the pool, stopping at the first error
+	eachImage(pool *Pool, fn func(name string) error) error
+	info(d Dev) (*DevInfo, error)
+	createSnapshot(img *Image, name string) error
+	listSnapshots(img *Image) ([]*snapshotListEntry, error)
+	resize(img *Image, size Size, allowShrink bool) error
+}
+
+// CLIBackend is the name of the backend which runs the rbd binary for every operation
+const CLIBackend = "cli"
+
+var backends = map[string]backend{CLIBackend: cliBackend{}}
+
+var activeBackend backend = cliBackend{}
+
+// ErrUnknownBackend is returned when selecting a backend that was not compiled in
+var ErrUnknownBackend = errors.New("unknown backend")
+
+// SetBackend selects the backend used for image operations.
+// It should be called before any other operations.
+func SetBackend(name string) error {
+	b, ok := backends[name]
+	if !ok {
+		return fmt.Errorf("%v (available: %v): %w", name, Backends(), ErrUnknownBackend)
+	}
+	activeBackend = b
+	return nil
+}
+
+// Backends returns the names of the backends compiled into this binary
+func Backends() []string {
+	r := make([]string, 0, len(backends))
+	for n := range backends {
+		r = append(r, n)
+	}
+	sort.Strings(r)
+	return r
+}
+
+type cliBackend struct{}
+
+func (cliBackend) createImage(pool *Pool, name string, size Size, args ...string) error {
+	args = append([]string{"create", "--image", name, "--size", size.String()}, args...)
+	return cmdRun(pool.context(), createErrs, pool.cmdArgs(args...)...)
+}
+
+func (cliBackend) eachImage(pool *Pool, fn func(name string) error) error {
+	return cmdJSONEach(pool.context(), poolErrs, func(dec *json.Decoder) error {
+		name := ""
+		if err := dec.Decode(&name); err != nil {
+			return err
+		}
+		return fn(name)
+	}, pool.cmdArgs("list")...)
+}
+
+func (cliBackend) info(d Dev) (*DevInfo, error) {
+	i := &DevInfo{}
+	return i, cmdJSON(d.context(), i, imageErrs, d.cmdArgs("info")...)
+}
+
+func (cliBackend) createSnapshot(img *Image, name string) error {
+	return cmdRun(img.context(), createErrs, img.cmdArgs("snap", "create", "--snap", name)...)
+}
+
+func (cliBackend) listSnapshots(img *Image) ([]*snapshotListEntry, error) {
+	snaps := []*snapshotListEntry{}
+	return snaps, cmdJSON(img.context(), &snaps, nil, img.cmdArgs("snap", "list")...)
+}
+
+func (cliBackend) resize(img *Image, size Size, allowShrink bool) error {
+	args := []string{"resize", "--size", size.String(), "--no-progress"}
+	if allowShrink {
+		args = append(args, "--allow-shrink")
+	}
+	return cmdRun(img.context(), resizeErrs, img.cmdArgs(args...)...)
+}
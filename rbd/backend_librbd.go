@@ -0,0 +1,288 @@
+//go:build ceph
+// +build ceph
+
+package rbd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+	librbd "github.com/ceph/go-ceph/rbd"
+)
+
+// LibRBDBackend is the name of the backend which uses librados and librbd through go-ceph
+const LibRBDBackend = "librbd"
+
+func init() {
+	backends[LibRBDBackend] = &librbdBackend{conns: make(map[Cluster]*rados.Conn), ioctxs: make(map[ioctxKey]*rados.IOContext)}
+}
+
+type librbdBackend struct {
+	mu     sync.Mutex
+	conns  map[Cluster]*rados.Conn
+	ioctxs map[ioctxKey]*rados.IOContext
+}
+
+type ioctxKey struct {
+	cluster   Cluster
+	pool      string
+	namespace string
+}
+
+// errorCode is implemented by go-ceph errors, the code is a negative errno
+type errorCode interface {
+	ErrorCode() int
+}
+
+func librbdErr(err error) error {
+	var ec errorCode
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, librbd.ErrNotFound), errors.Is(err, rados.ErrNotFound):
+		return fmt.Errorf("%v: %w", err, ErrDoesNotExist)
+	case errors.As(err, &ec) && ec.ErrorCode() == -int(syscall.EEXIST):
+		return fmt.Errorf("%v: %w", err, ErrAlreadyExists)
+	}
+	return err
+}
+
+// connect returns the connection to the cluster, connecting if needed. b.mu must be held.
+func (b *librbdBackend) connect(c Cluster) (*rados.Conn, error) {
+	if conn, ok := b.conns[c]; ok {
+		return conn, nil
+	}
+	name, user := c.Name, "client.admin"
+	if name == "" {
+		name = "ceph"
+	}
+	if c.ID != "" {
+		user = "client." + c.ID
+	}
+	conn, err := rados.NewConnWithClusterAndUser(name, user)
+	if err != nil {
+		return nil, fmt.Errorf("error creating rados connection: %w", err)
+	}
+	if c.Conf != "" {
+		err = conn.ReadConfigFile(c.Conf)
+	} else {
+		err = conn.ReadDefaultConfigFile()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading ceph config: %w", err)
+	}
+	if c.Keyring != "" {
+		if err = conn.SetConfigOption("keyring", c.Keyring); err != nil {
+			return nil, fmt.Errorf("error setting keyring: %w", err)
+		}
+	}
+	if err = conn.Connect(); err != nil {
+		return nil, fmt.Errorf("error connecting to ceph: %w", err)
+	}
+	b.conns[c] = conn
+	return conn, nil
+}
+
+func (b *librbdBackend) ioctx(pool *Pool) (*rados.IOContext, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := ioctxKey{pool.Cluster(), pool.Name(), pool.Namespace()}
+	if ioctx, ok := b.ioctxs[key]; ok {
+		return ioctx, nil
+	}
+	conn, err := b.connect(pool.Cluster())
+	if err != nil {
+		return nil, err
+	}
+	ioctx, err := conn.OpenIOContext(pool.Name())
+	if err != nil {
+		return nil, wrapErr(librbdErr(err), "error opening pool %v", pool.Name())
+	}
+	ioctx.SetNamespace(pool.Namespace())
+	b.ioctxs[key] = ioctx
+	return ioctx, nil
+}
+
+// openImage opens an image read only, at snapshot snap if it is not empty
+func (b *librbdBackend) openImage(img *Image, snap string) (*librbd.Image, error) {
+	ioctx, err := b.ioctx(img.Pool())
+	if err != nil {
+		return nil, err
+	}
+	if snap == "" {
+		snap = librbd.NoSnapshot
+	}
+	i, err := librbd.OpenImageReadOnly(ioctx, img.Name(), snap)
+	return i, wrapErr(librbdErr(err), "error opening %v", img.FullName())
+}
+
+func (b *librbdBackend) createImage(pool *Pool, name string, size Size, args ...string) error {
+	features := []string{}
+	dataPool := ""
+	uintOpts := make(map[string]uint64)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return cliBackend{}.createImage(pool, name, size, args...)
+		}
+		switch args[i] {
+		case "--image-feature":
+			features = append(features, strings.Split(args[i+1], ",")...)
+		case "--data-pool":
+			dataPool = args[i+1]
+		case "--stripe-unit", "--stripe-count":
+			v, err := strconv.ParseUint(args[i+1], 10, 64)
+			if err != nil {
+				return cliBackend{}.createImage(pool, name, size, args...)
+			}
+			uintOpts[args[i]] = v
+		default:
+			// only the cli understands the remaining arguments
+			return cliBackend{}.createImage(pool, name, size, args...)
+		}
+	}
+	ioctx, err := b.ioctx(pool)
+	if err != nil {
+		return err
+	}
+	opts := librbd.NewRbdImageOptions()
+	defer opts.Destroy()
+	if len(features) > 0 {
+		if err = opts.SetUint64(librbd.ImageOptionFeatures, uint64(librbd.FeatureSetFromNames(features))); err != nil {
+			return fmt.Errorf("error setting features %v: %w", features, err)
+		}
+	}
+	if dataPool != "" {
+		if err = opts.SetString(librbd.ImageOptionDataPool, dataPool); err != nil {
+			return fmt.Errorf("error setting data pool %v: %w", dataPool, err)
+		}
+	}
+	if v, ok := uintOpts["--stripe-unit"]; ok {
+		if err = opts.SetUint64(librbd.ImageOptionStripeUnit, v); err != nil {
+			return fmt.Errorf("error setting stripe unit %v: %w", v, err)
+		}
+	}
+	if v, ok := uintOpts["--stripe-count"]; ok {
+		if err = opts.SetUint64(librbd.ImageOptionStripeCount, v); err != nil {
+			return fmt.Errorf("error setting stripe count %v: %w", v, err)
+		}
+	}
+	return wrapErr(librbdErr(librbd.CreateImage(ioctx, name, uint64(size), opts)), "error creating %v/%v", pool.FullName(), name)
+}
+
+func (b *librbdBackend) eachImage(pool *Pool, fn func(name string) error) error {
+	ioctx, err := b.ioctx(pool)
+	if err != nil {
+		return err
+	}
+	names, err := librbd.GetImageNames(ioctx)
+	if err != nil {
+		return wrapErr(librbdErr(err), "error listing images in %v", pool.FullName())
+	}
+	for _, n := range names {
+		if err = fn(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *librbdBackend) info(d Dev) (*DevInfo, error) {
+	var img *Image
+	snapName := ""
+	switch v := d.(type) {
+	case *Image:
+		img = v
+	case *Snapshot:
+		img, snapName = v.Image(), v.Name()
+	}
+	i, err := b.openImage(img, snapName)
+	if err != nil {
+		return nil, err
+	}
+	defer i.Close()
+
+	stat, err := i.Stat()
+	if err != nil {
+		return nil, wrapErr(librbdErr(err), "error getting info for %v", d.FullName())
+	}
+	features, err := i.GetFeatures()
+	if err != nil {
+		return nil, wrapErr(librbdErr(err), "error getting features for %v", d.FullName())
+	}
+	info := &DevInfo{
+		Name:            img.Name(),
+		Size:            Size(stat.Size),
+		Objects:         int(stat.Num_objs),
+		Order:           stat.Order,
+		ObjectSize:      int(stat.Obj_size),
+		BlockNamePrefix: stat.Block_name_prefix,
+		Format:          2,
+	}
+	fs := librbd.FeatureSet(features)
+	info.Features = fs.Names()
+	if ts, err := i.GetCreateTimestamp(); err == nil {
+		info.CreateTimestamp = CreateTimestamp(time.Unix(ts.Sec, ts.Nsec))
+	}
+	if snapName != "" {
+		info.Protected, err = i.GetSnapshot(snapName).IsProtected()
+		if err != nil {
+			return nil, wrapErr(librbdErr(err), "error checking protection on %v", d.FullName())
+		}
+	}
+	return info, nil
+}
+
+func (b *librbdBackend) createSnapshot(img *Image, name string) error {
+	ioctx, err := b.ioctx(img.Pool())
+	if err != nil {
+		return err
+	}
+	i, err := librbd.OpenImage(ioctx, img.Name(), librbd.NoSnapshot)
+	if err != nil {
+		return wrapErr(librbdErr(err), "error opening %v", img.FullName())
+	}
+	defer i.Close()
+	_, err = i.CreateSnapshot(name)
+	return wrapErr(librbdErr(err), "error creating snapshot %v of %v", name, img.FullName())
+}
+
+func (b *librbdBackend) listSnapshots(img *Image) ([]*snapshotListEntry, error) {
+	i, err := b.openImage(img, "")
+	if err != nil {
+		return nil, err
+	}
+	defer i.Close()
+	snaps, err := i.GetSnapshotNames()
+	if err != nil {
+		return nil, wrapErr(librbdErr(err), "error listing snapshots of %v", img.FullName())
+	}
+	r := make([]*snapshotListEntry, 0, len(snaps))
+	for _, s := range snaps {
+		e := &snapshotListEntry{ID: int(s.Id), Name: s.Name, Size: Size(s.Size)}
+		if ts, err := i.GetSnapTimestamp(s.Id); err == nil {
+			e.Timestamp = CreateTimestamp(time.Unix(ts.Sec, ts.Nsec))
+		}
+		r = append(r, e)
+	}
+	return r, nil
+}
+
+// resize does not check allowShrink, Image.Resize has already compared the sizes
+func (b *librbdBackend) resize(img *Image, size Size, allowShrink bool) error {
+	ioctx, err := b.ioctx(img.Pool())
+	if err != nil {
+		return err
+	}
+	i, err := librbd.OpenImage(ioctx, img.Name(), librbd.NoSnapshot)
+	if err != nil {
+		return wrapErr(librbdErr(err), "error opening %v", img.FullName())
+	}
+	defer i.Close()
+	return wrapErr(librbdErr(i.Resize(uint64(size))), "error resizing %v", img.FullName())
+}
@@ -0,0 +1,75 @@
+package rbd
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BenchResult is the summary of an rbd bench run
+type BenchResult struct {
+	Elapsed     time.Duration
+	Ops         int64
+	OpsPerSec   float64
+	BytesPerSec float64
+	// Output is the full output of rbd bench, including per second progress
+	Output string
+}
+
+var benchSummary = regexp.MustCompile(`elapsed:\s*([\d.]+)\s+ops:\s*(\d+)\s+ops/sec:\s*([\d.]+)\s+bytes/sec:\s*([\d.]+)\s*([KMGT]i?B)?`)
+
+var benchUnits = map[string]float64{
+	"":    1,
+	"B":   1,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+// Bench runs rbd bench against the image. mode is read, write or readwrite, size is the total i/o eg: 1G,
+// and pattern is seq or rand. Empty values use the rbd defaults.
+// Write benchmarks overwrite the image's data, so they must only be run on scratch images.
+// It is only bounded by the image's context and is never retried.
+func (img *Image) Bench(mode, size, pattern string) (*BenchResult, error) {
+	args := []string{"bench"}
+	if mode == "" {
+		mode = "read"
+	}
+	args = append(args, "--io-type", mode)
+	if size != "" {
+		args = append(args, "--io-total", size)
+	}
+	if pattern != "" {
+		args = append(args, "--io-pattern", pattern)
+	}
+	// a large --io-total can outlast the command timeout, and a write benchmark must not be run again
+	out := &bytes.Buffer{}
+	if err := cmdStream(img.context(), imageErrs, nil, out, img.cmdArgs(args...)...); err != nil {
+		return nil, wrapErr(err, "error benchmarking %v", img.FullName())
+	}
+	r, err := parseBench(strings.TrimSpace(out.String()))
+	return r, wrapErr(err, "error parsing bench result for %v", img.FullName())
+}
+
+func parseBench(out string) (*BenchResult, error) {
+	r := &BenchResult{Output: out}
+	lines := strings.Split(out, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		m := benchSummary.FindStringSubmatch(lines[i])
+		if m == nil {
+			continue
+		}
+		elapsed, _ := strconv.ParseFloat(m[1], 64)
+		r.Elapsed = time.Duration(elapsed * float64(time.Second))
+		r.Ops, _ = strconv.ParseInt(m[2], 10, 64)
+		r.OpsPerSec, _ = strconv.ParseFloat(m[3], 64)
+		r.BytesPerSec, _ = strconv.ParseFloat(m[4], 64)
+		r.BytesPerSec *= benchUnits[m[5]]
+		return r, nil
+	}
+	return r, fmt.Errorf("no summary in bench output")
+}
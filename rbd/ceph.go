@@ -0,0 +1,49 @@
+package rbd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+)
+
+// cephBin returns the path of the ceph binary, which is only needed by the few operations which use it
+func cephBin() (string, error) {
+	bin, err := exec.LookPath("ceph")
+	if err != nil {
+		return "", fmt.Errorf("unable to find ceph binary: %w", err)
+	}
+	return bin, nil
+}
+
+// cephRun runs a ceph command
+func cephRun(ctx context.Context, cluster Cluster, errMap cmdErrMap, args ...string) error {
+	bin, err := cephBin()
+	if err != nil {
+		return err
+	}
+	args = cluster.cmdArgs(args...)
+	done := cmdAcquire(append([]string{"ceph"}, args...))
+	ctx, cancel := cmdContext(ctx)
+	defer cancel()
+	stderr := &bytes.Buffer{}
+	err = executor.Run(ctx, nil, nil, stderr, bin, args...)
+	done(err)
+	return cmdTimeoutErr(ctx, cmdMapErr(err, errMap, stderr, bin, args), args)
+}
+
+// cephJSON runs a ceph command, decoding its json output into v
+func cephJSON(ctx context.Context, cluster Cluster, v interface{}, errMap cmdErrMap, args ...string) error {
+	bin, err := cephBin()
+	if err != nil {
+		return err
+	}
+	args = cluster.cmdArgs(append([]string{"--format", "json"}, args...)...)
+	done := cmdAcquire(append([]string{"ceph"}, args...))
+	ctx, cancel := cmdContext(ctx)
+	defer cancel()
+	stderr := &bytes.Buffer{}
+	err = executor.StreamJSON(ctx, v, stderr, bin, args...)
+	done(err)
+	return cmdTimeoutErr(ctx, cmdMapErr(err, errMap, stderr, bin, args), args)
+}
@@ -0,0 +1,147 @@
+package rbd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrHasChildren is returned when removing a snapshot or image that has clones
+var ErrHasChildren = errors.New("snapshot has clones")
+
+type childListEntry struct {
+	Pool          string `json:"pool"`
+	PoolNamespace string `json:"pool_namespace"`
+	Image         string `json:"image"`
+}
+
+// parentInfo is the parent in rbd info json, which is only present for clones
+type parentInfo struct {
+	Pool          string `json:"pool"`
+	PoolNamespace string `json:"pool_namespace"`
+	Image         string `json:"image"`
+	Snapshot      string `json:"snapshot"`
+	// Overlap is how much of the clone is still read from the parent
+	Overlap Size `json:"overlap"`
+}
+
+// ParentOverlap is the parent snapshot of a clone and how much of the clone is still read from it
+type ParentOverlap struct {
+	Parent  *Snapshot
+	Overlap Size
+}
+
+// parseChildren parses rbd children json, which is a list of objects in newer releases and a list of pool/image or
+// pool/namespace/image strings in older releases
+func parseChildren(out string) ([]*childListEntry, error) {
+	children := []*childListEntry{}
+	if strings.TrimSpace(out) == "" {
+		return children, nil
+	}
+	if err := json.Unmarshal([]byte(out), &children); err == nil {
+		return children, nil
+	}
+	names := []string{}
+	if err := json.Unmarshal([]byte(out), &names); err != nil {
+		return nil, fmt.Errorf("error parsing children: %w", err)
+	}
+	for _, n := range names {
+		parts := strings.Split(n, "/")
+		switch len(parts) {
+		case 2:
+			children = append(children, &childListEntry{Pool: parts[0], Image: parts[1]})
+		case 3:
+			children = append(children, &childListEntry{Pool: parts[0], PoolNamespace: parts[1], Image: parts[2]})
+		default:
+			return nil, fmt.Errorf("error parsing child %v", n)
+		}
+	}
+	return children, nil
+}
+
+// Children returns the images cloned from the snapshot
+func (snap *Snapshot) Children() ([]*Image, error) {
+	out, err := cmdOut(snap.context(), imageErrs, snap.cmdArgs("children", "--format", "json")...)
+	if err != nil {
+		return nil, wrapErr(err, "error listing children of %v", snap.FullName())
+	}
+	children, err := parseChildren(out)
+	if err != nil {
+		return nil, err
+	}
+	imgs := make([]*Image, 0, len(children))
+	for _, c := range children {
+		imgs = append(imgs, snap.relatedPool(c.Pool, c.PoolNamespace).getImage(c.Image))
+	}
+	return imgs, nil
+}
+
+// Children returns the images cloned from any snapshot of the image
+func (img *Image) Children() ([]*Image, error) {
+	snaps, err := img.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	imgs := []*Image{}
+	for _, snap := range snaps {
+		children, err := snap.Children()
+		if err != nil {
+			return nil, err
+		}
+		imgs = append(imgs, children...)
+	}
+	return imgs, nil
+}
+
+// relatedPool returns a pool in the same cluster as the image, for its clones and parents
+func (img *Image) relatedPool(pool, namespace string) *Pool {
+	return newPool(img.Pool().Cluster(), pool, namespace, img.context())
+}
+
+func (snap *Snapshot) relatedPool(pool, namespace string) *Pool {
+	return snap.Image().relatedPool(pool, namespace)
+}
+
+// ParentOverlap returns the snapshot the image was cloned from, and how much of the image is still read from it.
+// It returns ErrNoParent if the image is not a clone, or has been flattened.
+func (img *Image) ParentOverlap() (*ParentOverlap, error) {
+	info := &struct {
+		Parent *parentInfo `json:"parent"`
+	}{}
+	if err := cmdJSON(img.context(), info, imageErrs, img.cmdArgs("info")...); err != nil {
+		return nil, wrapErr(err, "error getting parent of %v", img.FullName())
+	}
+	if info.Parent == nil || info.Parent.Image == "" {
+		return nil, fmt.Errorf("%v: %w", img.FullName(), ErrNoParent)
+	}
+	p := info.Parent
+	parent := img.relatedPool(p.Pool, p.PoolNamespace).getImage(p.Image).getSnapshot(p.Snapshot)
+	return &ParentOverlap{Parent: parent, Overlap: p.Overlap}, nil
+}
+
+// Parent returns the snapshot the image was cloned from, or ErrNoParent if the image is not a clone
+func (img *Image) Parent() (*Snapshot, error) {
+	p, err := img.ParentOverlap()
+	if err != nil {
+		return nil, err
+	}
+	return p.Parent, nil
+}
+
+// Ancestors returns the snapshots of the image's clone chain, starting with its parent.
+// It is empty if the image is not a clone.
+func (img *Image) Ancestors() ([]*Snapshot, error) {
+	r := []*Snapshot{}
+	for {
+		parent, err := img.Parent()
+		if errors.Is(err, ErrNoParent) {
+			return r, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, parent)
+		img = parent.Image()
+	}
+}
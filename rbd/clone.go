@@ -0,0 +1,116 @@
+package rbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Clone formats, clone v2 clones unprotected snapshots and requires clients of mimic or later
+const (
+	CloneFormatV1 = 1
+	CloneFormatV2 = 2
+)
+
+// cephReleases are the ceph release names, oldest first
+var cephReleases = []string{
+	"argonaut", "bobtail", "cuttlefish", "dumpling", "emperor", "firefly", "giant", "hammer", "infernalis",
+	"jewel", "kraken", "luminous", "mimic", "nautilus", "octopus", "pacific", "quincy", "reef", "squid", "tentacle",
+}
+
+// releaseIndex returns the position of release in cephReleases, or -1 if it is unknown
+func releaseIndex(release string) int {
+	for i, r := range cephReleases {
+		if r == release {
+			return i
+		}
+	}
+	return -1
+}
+
+// cloneProtectMetaPrefix marks, in the parent image's metadata, snapshots which Clone protected
+const cloneProtectMetaPrefix = "docker-rbd-plugin.clone-protected."
+
+var cloneFormats = struct {
+	sync.Mutex
+	formats map[Cluster]int
+}{formats: map[Cluster]int{}}
+
+// MinCompatClient returns the oldest ceph release the cluster allows clients to run, eg: luminous
+func (c Cluster) MinCompatClient() (string, error) {
+	dump := &struct {
+		RequireMinCompatClient string `json:"require_min_compat_client"`
+	}{}
+	if err := cephJSON(context.Background(), c, dump, nil, "osd", "dump"); err != nil {
+		return "", fmt.Errorf("error getting minimum client version: %w", err)
+	}
+	return dump.RequireMinCompatClient, nil
+}
+
+// CloneFormat returns CloneFormatV2 if the cluster requires clients of mimic or later, otherwise CloneFormatV1.
+// It requires the ceph binary, and is cached once known.
+func (c Cluster) CloneFormat() (int, error) {
+	cloneFormats.Lock()
+	defer cloneFormats.Unlock()
+	if f, ok := cloneFormats.formats[c]; ok {
+		return f, nil
+	}
+	release, err := c.MinCompatClient()
+	if err != nil {
+		return 0, err
+	}
+	f := CloneFormatV1
+	if releaseIndex(release) >= releaseIndex("mimic") {
+		f = CloneFormatV2
+	}
+	cloneFormats.formats[c] = f
+	return f, nil
+}
+
+// protectForClone protects the snapshot on clusters which need it to be cloned, recording the protection
+// in the parent's metadata so ReleaseCloneProtection can remove it once the snapshot has no clones
+func (snap *Snapshot) protectForClone() error {
+	err := snap.Protect()
+	if errors.Is(err, ErrAlreadyProtected) {
+		// protected by someone else, leave it to them
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return snap.Image().SetMeta(cloneProtectMetaPrefix+snap.Name(), "true")
+}
+
+// ReleaseCloneProtection unprotects the snapshot if Clone protected it and it no longer has clones,
+// so it can be removed. Snapshots protected by anything else, and those cloned with clone v2, are left alone.
+func (snap *Snapshot) ReleaseCloneProtection() error {
+	children, err := snap.Children()
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return nil
+	}
+	return snap.unprotectForClone()
+}
+
+// CloneProtected returns true if Clone protected the snapshot, which Remove unprotects once it has no clones
+func (snap *Snapshot) CloneProtected() (bool, error) {
+	_, err := snap.Image().GetMeta(cloneProtectMetaPrefix + snap.Name())
+	if errors.Is(err, ErrDoesNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unprotectForClone unprotects a snapshot without clones if Clone protected it
+func (snap *Snapshot) unprotectForClone() error {
+	if protected, err := snap.CloneProtected(); err != nil || !protected {
+		return err
+	}
+	if err := snap.Unprotect(); err != nil && !errors.Is(err, ErrNotProtected) {
+		return err
+	}
+	return snap.Image().RemoveMeta(cloneProtectMetaPrefix + snap.Name())
+}
@@ -0,0 +1,57 @@
+package rbd
+
+import "sync"
+
+// Cluster identifies a ceph cluster and the client commands connect to it as.
+// The zero value is the default cluster, connected to as the admin client.
+type Cluster struct {
+	// Name is the cluster name, which selects /etc/ceph/<name>.conf, empty for ceph
+	Name string
+	// ID is the client to connect as, without the client. prefix, empty for admin
+	ID string
+	// Conf is the path of the ceph config file, empty for the default of the cluster name
+	Conf string
+	// Keyring is the path of the keyring, empty for the default of the client
+	Keyring string
+}
+
+var defaultClusterMutex = &sync.RWMutex{}
+var defaultCluster Cluster
+
+// SetDefaultCluster sets the cluster of pools from GetPool, and of commands which are not run against a pool.
+// It should be called before any commands are run.
+func SetDefaultCluster(c Cluster) {
+	defaultClusterMutex.Lock()
+	defer defaultClusterMutex.Unlock()
+	defaultCluster = c
+}
+
+// DefaultCluster returns the cluster set by SetDefaultCluster
+func DefaultCluster() Cluster {
+	defaultClusterMutex.RLock()
+	defer defaultClusterMutex.RUnlock()
+	return defaultCluster
+}
+
+// Pool gets a pool object in the cluster (does not verify pool exists)
+func (c Cluster) Pool(name string) *Pool {
+	return newPool(c, name, "", nil)
+}
+
+// cmdArgs prepends the arguments selecting the cluster and client to args, they are accepted by both rbd and ceph
+func (c Cluster) cmdArgs(args ...string) []string {
+	r := []string{}
+	if c.Name != "" {
+		r = append(r, "--cluster", c.Name)
+	}
+	if c.ID != "" {
+		r = append(r, "--id", c.ID)
+	}
+	if c.Conf != "" {
+		r = append(r, "--conf", c.Conf)
+	}
+	if c.Keyring != "" {
+		r = append(r, "--keyring", c.Keyring)
+	}
+	return append(r, args...)
+}
@@ -0,0 +1,159 @@
+package rbd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrLocked is returned when the cluster lock on an image is held by another host
+var ErrLocked = errors.New("image is locked by another host")
+
+const clusterLockPrefix = "docker-rbd-plugin:"
+
+// clusterLockMetaKey is the image-meta key holding the heartbeat of the cluster lock holder
+const clusterLockMetaKey = "docker-rbd-plugin.lock-heartbeat"
+
+var lockAddErrs = exitCodeToErrMap(map[int]error{
+	2:  ErrDoesNotExist,
+	16: ErrLocked,
+	17: ErrLocked,
+})
+
+func (img *Image) writeHeartbeat(owner string) error {
+	return img.SetMeta(clusterLockMetaKey, owner+" "+time.Now().UTC().Format(time.RFC3339))
+}
+
+// heartbeat returns the time of the last heartbeat from the cluster lock holder, zero if there is none
+func (img *Image) heartbeat() (time.Time, error) {
+	out, err := img.GetMeta(clusterLockMetaKey)
+	if errors.Is(err, ErrDoesNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	parts := strings.Fields(out)
+	if len(parts) == 0 {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, parts[len(parts)-1])
+}
+
+// ClusterLock takes an exclusive advisory lock on the image which every host using the cluster respects.
+// owner identifies the holder, usually by hostname. While the lock is held a heartbeat is written to the
+// image metadata every ttl/3, and a lock without a heartbeat in the last ttl is broken as abandoned.
+// If another host holds the lock, ClusterLock retries for up to wait before returning ErrLocked.
+// The returned function releases the lock.
+func (img *Image) ClusterLock(owner string, ttl, wait time.Duration) (func() error, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("cluster lock ttl must be greater than 0")
+	}
+	lockID := clusterLockPrefix + owner
+	deadline := time.Now().Add(wait)
+	var missingSince time.Time
+	for {
+		err := cmdRun(img.context(), lockAddErrs, img.cmdArgs("lock", "add", lockID)...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrLocked) {
+			return nil, wrapErr(err, "error locking %v", img.FullName())
+		}
+
+		last, err := img.heartbeat()
+		if err != nil {
+			return nil, wrapErr(err, "error getting lock heartbeat for %v", img.FullName())
+		}
+		// the holder may not have written its first heartbeat yet, so give it ttl to do so
+		if last.IsZero() {
+			if missingSince.IsZero() {
+				missingSince = time.Now()
+			}
+			last = missingSince
+		}
+		if time.Since(last) > ttl {
+			if err = img.breakClusterLocks(); err != nil {
+				return nil, err
+			}
+			missingSince = time.Time{}
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%v: %w", img.FullName(), ErrLocked)
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-img.context().Done():
+			return nil, fmt.Errorf("error waiting for lock on %v: %w", img.FullName(), img.context().Err())
+		}
+	}
+
+	// best effort, a missed heartbeat is retried on the next tick
+	_ = img.writeHeartbeat(owner)
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = img.writeHeartbeat(owner)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() error {
+		close(stop)
+		<-stopped
+		err := img.releaseClusterLock(lockID)
+		if errors.Is(err, ErrDoesNotExist) {
+			// the image was removed while locked
+			return nil
+		}
+		return err
+	}, nil
+}
+
+// ReleaseClusterLock releases the cluster lock owner holds on the image, for a lock taken before the image was
+// renamed, which the function returned by ClusterLock can no longer find
+func (img *Image) ReleaseClusterLock(owner string) error {
+	return img.releaseClusterLock(clusterLockPrefix + owner)
+}
+
+func (img *Image) releaseClusterLock(lockID string) error {
+	if err := img.RemoveMeta(clusterLockMetaKey); err != nil && !errors.Is(err, ErrDoesNotExist) {
+		return err
+	}
+	locks, err := img.ListLocks()
+	if err != nil {
+		return err
+	}
+	for _, l := range locks {
+		if l.ID == lockID {
+			return img.BreakLock(l)
+		}
+	}
+	return nil
+}
+
+// breakClusterLocks removes abandoned cluster locks
+func (img *Image) breakClusterLocks() error {
+	locks, err := img.ListLocks()
+	if err != nil {
+		return err
+	}
+	for _, l := range locks {
+		if strings.HasPrefix(l.ID, clusterLockPrefix) {
+			if err = img.BreakLock(l); err != nil && !errors.Is(err, ErrDoesNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package rbd
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// versionRe matches rbd --version output, eg: ceph version 17.2.6 (d7ff0d10654d2280e08f1ab989c7cdf3064446a5) quincy (stable)
+var versionRe = regexp.MustCompile(`ceph version (\d+)\.\S*(?: \([0-9a-f]+\))?(?: ([a-z]+))?`)
+
+var cliReleaseOnce sync.Once
+var cliRelease string
+
+// CLIRelease returns the ceph release of the installed rbd cli, eg: quincy, or an empty string if it could not be determined.
+// It is detected once, the first time it is needed.
+func CLIRelease() string {
+	cliReleaseOnce.Do(func() {
+		out, err := cmdOut(context.Background(), nil, "--version")
+		if err == nil {
+			cliRelease = parseRelease(out)
+		}
+	})
+	return cliRelease
+}
+
+// parseRelease returns the release name in rbd --version output, from the major version if the name is missing
+func parseRelease(out string) string {
+	m := versionRe.FindStringSubmatch(out)
+	if m == nil {
+		return ""
+	}
+	if releaseIndex(m[2]) >= 0 {
+		return m[2]
+	}
+	// the major version of each release since jewel (10) is its position in cephReleases plus one
+	major, err := strconv.Atoi(m[1])
+	if err != nil || major < 10 || major > len(cephReleases) {
+		return ""
+	}
+	return cephReleases[major-1]
+}
+
+// deviceCommandsSupported returns true if the cli has rbd device, added in mimic. The rbd nbd commands it replaced
+// were later removed, so an unknown release is assumed to be newer.
+func deviceCommandsSupported() bool {
+	release := CLIRelease()
+	return release == "" || releaseIndex(release) >= releaseIndex("mimic")
+}
+
+// nbdArgs returns the arguments for an nbd device command, eg: map, in the dialect of the installed cli
+func nbdArgs(command string, args ...string) []string {
+	if deviceCommandsSupported() {
+		return append([]string{"device", command, "--device-type", DeviceTypeNBD}, args...)
+	}
+	return append([]string{"nbd", command}, args...)
+}
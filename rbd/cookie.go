@@ -0,0 +1,35 @@
+package rbd
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+var cookieOnce sync.Once
+var cookieSupported bool
+
+// cookiesSupported returns true if rbd-nbd supports mapping with a cookie (pacific or later)
+func cookiesSupported() bool {
+	cookieOnce.Do(func() {
+		out, err := cmdOut(context.Background(), nil, "help", "device", "map")
+		cookieSupported = err == nil && strings.Contains(out, "--cookie")
+	})
+	return cookieSupported
+}
+
+// cookiePrefix identifies the cookies of devices mapped by this package
+const cookiePrefix = "docker-rbd-plugin:"
+
+// devCookie is the cookie a device is mapped with, which identifies it in the device list
+func devCookie(d Dev) string {
+	return cookiePrefix + d.FullName()
+}
+
+// cookieArgs returns the arguments to map or attach d with its cookie, if cookies are supported
+func cookieArgs(d Dev) []string {
+	if !cookiesSupported() {
+		return nil
+	}
+	return []string{"--cookie", devCookie(d)}
+}
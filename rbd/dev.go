@@ -1,9 +1,11 @@
 package rbd
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"os/exec"
+	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -26,25 +28,36 @@ type Dev interface {
 	Remove() error
 	FileSystem() (string, error)
 	cmdArgs(...string) []string
+	context() context.Context
 }
 
 func devFullName(d Dev) string {
-	return d.Pool().Name() + "/" + d.ImageName()
+	return d.Pool().FullName() + "/" + d.ImageName()
 }
 
 func device(d Dev) (string, error) {
-	mapped, err := mappedNBDs()
+	mapped, err := mappedDevices()
 	if err != nil {
 		return "", err
 	}
+	cookie := devCookie(d)
 	for _, m := range mapped {
+		if m.Cookie != "" {
+			if m.Cookie == cookie {
+				return m.Device, nil
+			}
+			// devices mapped by other tools may have other cookies, so fall back to the names
+			if strings.HasPrefix(m.Cookie, cookiePrefix) {
+				continue
+			}
+		}
 		switch v := d.(type) {
 		case *Image:
-			if m.Snapshot == "-" && m.Name == v.Name() && m.Pool == v.Pool().Name() {
+			if m.Snapshot == "-" && m.Name == v.Name() && v.Pool().owns(m) {
 				return m.Device, nil
 			}
 		case *Snapshot:
-			if m.Snapshot == v.Name() && m.Name == v.Image().Name() && m.Pool == v.Pool().Name() {
+			if m.Snapshot == v.Name() && m.Name == v.Image().Name() && v.Pool().owns(m) {
 				return m.Device, nil
 			}
 		}
@@ -85,17 +98,16 @@ var ErrExclusiveLockNotEnabled = errors.New("exclusive-lock not enabled")
 // ErrExclusiveLockTaken is returned when this client cannot get an exclusive-lock
 var ErrExclusiveLockTaken = errors.New("exclusive-lock is held by another client")
 
-func devMapErrors(err *exec.ExitError) error {
-	if err.ExitCode() == 22 {
-		stdErr := string(err.Stderr)
-		if strings.Contains(stdErr, "failed to request exclusive lock: (30) Read-only file system") {
+func devMapErrors(err *CmdError) error {
+	if err.ExitCode == 22 {
+		if strings.Contains(err.Stderr, "failed to request exclusive lock: (30) Read-only file system") {
 			return ErrExclusiveLockTaken
 		}
-		if strings.Contains(stdErr, "exclusive-lock feature is not enabled") {
+		if strings.Contains(err.Stderr, "exclusive-lock feature is not enabled") {
 			return ErrExclusiveLockNotEnabled
 		}
 	}
-	return err
+	return nil
 }
 
 func devMap(d Dev, args ...string) (string, error) {
@@ -103,9 +115,10 @@ func devMap(d Dev, args ...string) (string, error) {
 	if err != nil || nbd != "" {
 		return nbd, err
 	}
-	args = append([]string{"nbd", "map"}, args...)
+	args = nbdArgs("map", append(cookieArgs(d), args...)...)
 	args = d.cmdArgs(args...)
-	return cmdOut(devMapErrors, args...)
+	defer invalidateMappedCache()
+	return cmdOut(d.context(), devMapErrors, args...)
 }
 
 func devMapAndMount(d Dev, mountPoint, fs string, flags uintptr, data string, mapF func() (string, error)) error {
@@ -136,19 +149,19 @@ func devUnmount(d Dev, mountPoint string) error {
 	return unmount(blk, mountPoint)
 }
 
-// devUnmountAndUnmap safely unmounts and unmaps checking for would-be orphan mounts first
-func devUnmountAndUnmap(d Dev, mountPoint string) error {
+// devUnmountAndUnmap safely unmounts and unmaps checking for would-be orphan mounts first, scan may be nil
+func devUnmountAndUnmap(d Dev, mountPoint string, scan *MountScan) error {
 	blk, err := device(d)
 	if err != nil || blk == "" {
 		return err
 	}
-	if err = isMountedElsewhere(blk, mountPoint); err != nil {
+	if err = isMountedElsewhere(blk, mountPoint, scan); err != nil {
 		return err
 	}
 	if err = unmount(blk, mountPoint); err != nil {
 		return err
 	}
-	return unmap(blk)
+	return unmap(d.context(), blk)
 }
 
 // ErrDeviceBusy is returned if the device is busy
@@ -158,8 +171,14 @@ var unmapErrors = exitCodeToErrMap(map[int]error{
 	16: ErrDeviceBusy,
 })
 
-func unmap(blk string) error {
-	return cmdRun(unmapErrors, "nbd", "unmap", blk)
+// unmap unmaps blk with the command matching the device type it was mapped with
+func unmap(ctx context.Context, blk string) error {
+	args := nbdArgs("unmap", blk)
+	if t, err := MappedDeviceType(blk); err == nil && t == DeviceTypeKRBD {
+		args = []string{"unmap", blk}
+	}
+	defer invalidateMappedCache()
+	return cmdRun(ctx, unmapErrors, args...)
 }
 
 func devUnmap(d Dev) error {
@@ -167,13 +186,13 @@ func devUnmap(d Dev) error {
 	if err != nil || blk == "" {
 		return err
 	}
-	return unmap(blk)
+	return unmap(d.context(), blk)
 }
 
 // DevInfo contains information about the image or snapshot
 type DevInfo struct {
 	Name            string          `json:"name"`
-	Size            int64           `json:"size"`
+	Size            Size            `json:"size"`
 	Objects         int             `json:"objects"`
 	Order           int             `json:"order"`
 	ObjectSize      int             `json:"object_size"`
@@ -183,15 +202,76 @@ type DevInfo struct {
 	Flags           []interface{}   `json:"flags"`
 	CreateTimestamp CreateTimestamp `json:"create_timestamp"`
 	Protected       bool            `json:"protected,string"`
+	// Mirroring is set if mirroring is enabled on the image
+	Mirroring *MirrorInfo `json:"mirroring,omitempty"`
+}
+
+// hasFastDiff returns true if usage can be measured without reading every object
+func (i *DevInfo) hasFastDiff() bool {
+	enabled := i.HasFeature(FeatureFastDiff)
+	for _, f := range i.Flags {
+		if f, ok := f.(string); ok && strings.HasSuffix(f, "invalid") {
+			return false // the object map or fast-diff map must be rebuilt
+		}
+	}
+	return enabled
+}
+
+// DiskUsage is the space provisioned for and used by an image or snapshot
+type DiskUsage struct {
+	Name            string `json:"name"`
+	Snapshot        string `json:"snapshot"`
+	ProvisionedSize Size   `json:"provisioned_size"`
+	UsedSize        Size   `json:"used_size"`
+}
+
+// UsageUnknown is the UsedSize of images whose usage could not be measured cheaply
+const UsageUnknown Size = -1
+
+type diskUsageList struct {
+	Images []*DiskUsage `json:"images"`
 }
 
 // CreateTimestamp is the creation timestamp for an image or snapshot
 type CreateTimestamp time.Time
 
+// timestampLayouts are the layouts of timestamps printed by rbd releases, most use asctime in local time
+var timestampLayouts = []string{
+	time.ANSIC,
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+// parseTimestamp parses a timestamp printed by rbd, releases which don't print one give the zero time
+func parseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown timestamp format %q", s)
+}
+
 // UnmarshalJSON unmarshals CreateTimestamp
 func (j *CreateTimestamp) UnmarshalJSON(b []byte) error {
-	s := strings.Trim(string(b), "\"")
-	t, err := time.ParseInLocation(time.ANSIC, s, time.Local)
+	if string(b) == "null" {
+		return nil
+	}
+	// some fields are printed as seconds since the epoch rather than a string
+	if secs, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+		*j = CreateTimestamp(time.Unix(secs, 0))
+		return nil
+	}
+	s := ""
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	t, err := parseTimestamp(s)
 	if err != nil {
 		return err
 	}
@@ -205,6 +285,5 @@ func (j CreateTimestamp) MarshalJSON() ([]byte, error) {
 }
 
 func devInfo(d Dev) (*DevInfo, error) {
-	i := &DevInfo{}
-	return i, cmdJSON(i, imageErrs, d.cmdArgs("info")...)
+	return cachedInfo(d)
 }
@@ -0,0 +1,128 @@
+package rbd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// deviceListEntry is a device in rbd nbd list or rbd showmapped json. Releases differ in the names of
+// the pid and image fields, and in whether the list is an array or an object keyed by id.
+type deviceListEntry struct {
+	ID     interface{} `json:"id"`
+	Pid    interface{} `json:"pid"`
+	Pool   string      `json:"pool"`
+	Ns     string      `json:"namespace"`
+	Image  string      `json:"image"`
+	Name   string      `json:"name"`
+	Snap   string      `json:"snap"`
+	Device string      `json:"device"`
+	Cookie string      `json:"cookie"`
+}
+
+// listDevices lists the devices mapped with the device type, using the plain output if json is not available
+func listDevices(deviceType string, args ...string) ([]*mappedDevice, error) {
+	out, err := cmdOut(context.Background(), nil, append([]string{"--format", "json"}, args...)...)
+	if err == nil {
+		if mapped, jsonErr := parseDeviceList(out, deviceType); jsonErr == nil {
+			return mapped, nil
+		}
+	}
+	out, err = cmdOut(context.Background(), nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	return parseDeviceColumns(out, deviceType)
+}
+
+func parseDeviceList(out, deviceType string) ([]*mappedDevice, error) {
+	entries := []*deviceListEntry{}
+	if strings.TrimSpace(out) == "" {
+		return []*mappedDevice{}, nil
+	}
+	if err := json.Unmarshal([]byte(out), &entries); err != nil {
+		byID := make(map[string]*deviceListEntry)
+		if err := json.Unmarshal([]byte(out), &byID); err != nil {
+			return nil, fmt.Errorf("error parsing device list: %w", err)
+		}
+		for id, e := range byID {
+			e.ID = id
+			entries = append(entries, e)
+		}
+	}
+	mapped := make([]*mappedDevice, 0, len(entries))
+	for _, e := range entries {
+		m := &mappedDevice{Pool: e.Pool, Namespace: e.Ns, Name: e.Image, Snapshot: e.Snap, Device: e.Device, Cookie: e.Cookie, Type: deviceType}
+		if m.Name == "" {
+			m.Name = e.Name
+		}
+		if m.Snapshot == "" {
+			m.Snapshot = "-"
+		}
+		// the id of an nbd device is the pid of its rbd-nbd process in releases without a pid field
+		if pid := jsonInt(e.Pid); pid != 0 {
+			m.Pid = pid
+		} else if deviceType == DeviceTypeNBD {
+			m.Pid = jsonInt(e.ID)
+		}
+		mapped = append(mapped, m)
+	}
+	sort.Slice(mapped, func(i, j int) bool { return mapped[i].Device < mapped[j].Device })
+	return mapped, nil
+}
+
+// jsonInt converts a json number or numeric string to an int, or returns 0
+func jsonInt(v interface{}) int {
+	switch v := v.(type) {
+	case float64:
+		return int(v)
+	case string:
+		i, _ := strconv.Atoi(v)
+		return i
+	}
+	return 0
+}
+
+// parseDeviceColumns parses the plain device list of releases without json output, which is
+// a header line followed by a line per device with whitespace separated columns
+func parseDeviceColumns(out, deviceType string) ([]*mappedDevice, error) {
+	mapped := []*mappedDevice{}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) == "" {
+		return mapped, nil
+	}
+	cols := make(map[string]int)
+	for i, h := range strings.Fields(lines[0]) {
+		cols[h] = i
+	}
+	if _, ok := cols["device"]; !ok {
+		return nil, fmt.Errorf("error parsing device list header %q", lines[0])
+	}
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		// the namespace column is blank for images in the default namespace
+		if i, ok := cols["namespace"]; ok && len(fields) == len(cols)-1 {
+			fields = append(fields[:i], append([]string{""}, fields[i:]...)...)
+		}
+		if len(fields) != len(cols) {
+			return nil, fmt.Errorf("error parsing device list line %q", line)
+		}
+		get := func(names ...string) string {
+			for _, n := range names {
+				if i, ok := cols[n]; ok {
+					return fields[i]
+				}
+			}
+			return ""
+		}
+		m := &mappedDevice{Pool: get("pool"), Namespace: get("namespace"), Name: get("image", "name"), Snapshot: get("snap"), Device: get("device"), Cookie: get("cookie"), Type: deviceType}
+		if deviceType == DeviceTypeNBD {
+			m.Pid, _ = strconv.Atoi(get("pid", "id"))
+		}
+		mapped = append(mapped, m)
+	}
+	return mapped, nil
+}
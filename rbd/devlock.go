@@ -0,0 +1,49 @@
+package rbd
+
+import "sync"
+
+// devLock is a mutex in the lock registry, removed when nothing holds or waits for it
+type devLock struct {
+	sync.Mutex
+	refs int
+}
+
+var devLocksMutex = &sync.Mutex{}
+var devLocks = make(map[string]*devLock)
+
+// LockName locks name, usually the FullName of a device, against every other operation in this process
+// which locks it through LockName, LockDev or WithLock. It returns the function to unlock it.
+func LockName(name string) func() {
+	devLocksMutex.Lock()
+	l := devLocks[name]
+	if l == nil {
+		l = &devLock{}
+		devLocks[name] = l
+	}
+	l.refs++
+	devLocksMutex.Unlock()
+
+	l.Lock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.Unlock()
+			devLocksMutex.Lock()
+			defer devLocksMutex.Unlock()
+			if l.refs--; l.refs == 0 {
+				delete(devLocks, name)
+			}
+		})
+	}
+}
+
+// LockDev locks dev against other operations on it in this process and returns the function to unlock it
+func LockDev(dev Dev) func() {
+	return LockName(dev.FullName())
+}
+
+// WithLock runs fn with dev locked
+func WithLock(dev Dev, fn func() error) error {
+	defer LockDev(dev)()
+	return fn()
+}
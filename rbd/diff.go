@@ -0,0 +1,84 @@
+package rbd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ExportDiff writes the changes to the image since a snapshot to w in the rbd diff format.
+// If since is nil, all data in the image is written.
+func (img *Image) ExportDiff(since *Snapshot, w io.Writer) error {
+	args := []string{"export-diff", "--no-progress"}
+	if since != nil {
+		args = append(args, "--from-snap", since.Name())
+	}
+	args = append(args, "-")
+	return wrapErr(cmdStream(img.context(), imageErrs, nil, w, img.cmdArgs(args...)...), "error exporting diff of %v", img.FullName())
+}
+
+// ExportDiff writes the changes to the image between since and this snapshot to w in the rbd diff format.
+// If since is nil, all data in the snapshot is written.
+func (snap *Snapshot) ExportDiff(since *Snapshot, w io.Writer) error {
+	args := []string{"export-diff", "--no-progress"}
+	if since != nil {
+		args = append(args, "--from-snap", since.Name())
+	}
+	args = append(args, "-")
+	return wrapErr(cmdStream(snap.context(), imageErrs, nil, w, snap.cmdArgs(args...)...), "error exporting diff of %v", snap.FullName())
+}
+
+// ImportDiff applies a diff read from r, as written by ExportDiff, to the image.
+// The image must contain the snapshot the diff was exported since, and must not be in use.
+func (img *Image) ImportDiff(r io.Reader) error {
+	defer InvalidateInfo(img)
+	return wrapErr(cmdStream(img.context(), imageErrs, r, nil, img.cmdArgs("import-diff", "--no-progress", "-")...), "error importing diff to %v", img.FullName())
+}
+
+// diffExtent is a changed extent in rbd diff json
+type diffExtent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	// Exists is false for extents which were discarded or zeroed
+	Exists bool `json:"exists,string"`
+}
+
+// ChangedBytes returns the bytes written, discarded or zeroed in the image between from and to.
+// If from is nil, it is every allocated byte. If to is nil, changes up to the current image are counted.
+func (img *Image) ChangedBytes(from, to *Snapshot) (Size, error) {
+	args := []string{"diff"}
+	if from != nil {
+		args = append(args, "--from-snap", from.Name())
+	}
+	d := Dev(img)
+	if to != nil {
+		d = to
+	}
+	var changed Size
+	err := cmdJSONEach(img.context(), imageErrs, func(dec *json.Decoder) error {
+		e := &diffExtent{}
+		if err := dec.Decode(e); err != nil {
+			return err
+		}
+		changed += Size(e.Length)
+		return nil
+	}, d.cmdArgs(args...)...)
+	return changed, wrapErr(err, "error getting changes to %v", d.FullName())
+}
+
+// ChangedBytes returns the bytes changed in the image between the previous snapshot and this one,
+// or every byte allocated when the snapshot was taken if it is the first
+func (snap *Snapshot) ChangedBytes() (Size, error) {
+	snaps, err := snap.Image().Snapshots()
+	if err != nil {
+		return 0, err
+	}
+	var prev *Snapshot
+	for _, s := range snaps {
+		if s.Name() == snap.Name() {
+			return snap.Image().ChangedBytes(prev, snap)
+		}
+		prev = s
+	}
+	return 0, fmt.Errorf("%v: %w", snap.FullName(), ErrDoesNotExist)
+}
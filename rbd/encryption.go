@@ -0,0 +1,75 @@
+package rbd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrInvalidEncryption is returned when an encryption format or passphrase file can not be used
+var ErrInvalidEncryption = errors.New("invalid encryption")
+
+// EncryptionFormat is the on disk format of an encrypted image
+type EncryptionFormat string
+
+// Encryption formats supported by rbd
+const (
+	EncryptionLUKS1 EncryptionFormat = "luks1"
+	EncryptionLUKS2 EncryptionFormat = "luks2"
+	// EncryptionLUKS loads either LUKS version when mapping, it can not be used to format an image. Requires quincy or later.
+	EncryptionLUKS EncryptionFormat = "luks"
+)
+
+// Valid returns true if images can be formatted with f
+func (f EncryptionFormat) Valid() bool {
+	return f == EncryptionLUKS1 || f == EncryptionLUKS2
+}
+
+var encryptionFormatErrs = exitCodeToErrMap(map[int]error{
+	2:  ErrDoesNotExist,
+	17: ErrAlreadyExists,
+	22: ErrInvalidEncryption,
+})
+
+// checkPassphraseFile returns ErrInvalidEncryption if the passphrase file can not be read
+func checkPassphraseFile(passphraseFile string) error {
+	if passphraseFile == "" {
+		return fmt.Errorf("passphrase file is empty: %w", ErrInvalidEncryption)
+	}
+	if _, err := os.Stat(passphraseFile); err != nil {
+		return fmt.Errorf("passphrase file %v: %v: %w", passphraseFile, err, ErrInvalidEncryption)
+	}
+	return nil
+}
+
+// EncryptionFormat formats the image for encryption with the passphrase in passphraseFile. Existing data on the
+// image is no longer readable, and the encryption header takes space at the start of the image.
+// The image must be mapped with its Encryption to read and write the decrypted data. Requires pacific or later.
+func (img *Image) EncryptionFormat(format EncryptionFormat, passphraseFile string) error {
+	defer InvalidateInfo(img)
+	if !format.Valid() {
+		return fmt.Errorf("can not format %v with %q: %w", img.FullName(), format, ErrInvalidEncryption)
+	}
+	if err := checkPassphraseFile(passphraseFile); err != nil {
+		return err
+	}
+	err := cmdRun(img.context(), encryptionFormatErrs, img.cmdArgs("encryption", "format", string(format), passphraseFile)...)
+	return wrapErr(err, "error formatting %v for %v encryption", img.FullName(), format)
+}
+
+// Encryption loads the encryption of an image when it is mapped, so the device reads and writes decrypted data
+type Encryption struct {
+	Format         EncryptionFormat
+	PassphraseFile string
+}
+
+// MapArgs returns the arguments to pass to Map or MapExclusive to load the encryption. Requires rbd-nbd from pacific or later.
+func (e *Encryption) MapArgs() ([]string, error) {
+	if !e.Format.Valid() && e.Format != EncryptionLUKS {
+		return nil, fmt.Errorf("can not load %q encryption: %w", e.Format, ErrInvalidEncryption)
+	}
+	if err := checkPassphraseFile(e.PassphraseFile); err != nil {
+		return nil, err
+	}
+	return []string{"--options", "encryption-format=" + string(e.Format) + ",encryption-passphrase-file=" + e.PassphraseFile}, nil
+}
@@ -0,0 +1,63 @@
+package rbd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrPermission is returned when the cluster denies an operation
+var ErrPermission = errors.New("permission denied")
+
+// ErrClusterFull is returned when the cluster or pool is out of space
+var ErrClusterFull = errors.New("cluster is full")
+
+// CmdError is returned when an rbd or ceph command fails. Err is the package error the failure maps to,
+// or the error from the Executor if there is none, so errors.Is can be used with the package errors.
+type CmdError struct {
+	Args     []string
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *CmdError) Error() string {
+	msg := fmt.Sprintf("%v: exit status %v", strings.Join(e.Args, " "), e.ExitCode)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	var exitErr exitCoder
+	if !errors.As(e.Err, &exitErr) {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *CmdError) Unwrap() error {
+	return e.Err
+}
+
+// exitCoder is implemented by the errors of commands which ran and exited unsuccessfully, such as *exec.ExitError
+type exitCoder interface {
+	error
+	ExitCode() int
+}
+
+// commonErrs maps the exit statuses and messages which mean the same thing for every command
+func commonErrs(err *CmdError) error {
+	switch {
+	case err.ExitCode == 28, strings.Contains(err.Stderr, "No space left"), strings.Contains(err.Stderr, "is full"):
+		return ErrClusterFull
+	case err.ExitCode == 110:
+		return ErrTimeout
+	case err.ExitCode == 1 || err.ExitCode == 13:
+		if strings.Contains(err.Stderr, "Operation not permitted") || strings.Contains(err.Stderr, "Permission denied") {
+			return ErrPermission
+		}
+	case err.ExitCode == 2:
+		return ErrDoesNotExist
+	case err.ExitCode == 16:
+		return ErrDeviceBusy
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package rbd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+)
+
+// Executor runs the commands of the package: rbd, ceph and the filesystem tools. Errors from commands which ran and
+// exited unsuccessfully must have an ExitCode() int method, as *exec.ExitError does.
+type Executor interface {
+	// Run runs name with args, connecting stdin, stdout and stderr, any of which may be nil
+	Run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, name string, args ...string) error
+	// Output runs name with args and returns its stdout
+	Output(ctx context.Context, stderr io.Writer, name string, args ...string) ([]byte, error)
+	// StreamJSON runs name with args, decoding its stdout as json into v as it is written
+	StreamJSON(ctx context.Context, v interface{}, stderr io.Writer, name string, args ...string) error
+}
+
+var executor Executor = execExecutor{}
+
+// SetExecutor replaces the Executor which runs commands, nil restores the default which uses os/exec.
+// It should be called before any commands are run.
+func SetExecutor(e Executor) {
+	if e == nil {
+		e = execExecutor{}
+	}
+	executor = e
+}
+
+type execExecutor struct{}
+
+func (execExecutor) Run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	return cmd.Run()
+}
+
+func (execExecutor) Output(ctx context.Context, stderr io.Writer, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = stderr
+	return cmd.Output()
+}
+
+func (execExecutor) StreamJSON(ctx context.Context, v interface{}, stderr io.Writer, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = stderr
+	stdOut, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("error setting up stdout for cmd %v %v: %w", cmd, args, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting cmd %v %v: %w", cmd, args, err)
+	}
+	decodeErr := json.NewDecoder(stdOut).Decode(v)
+	if decodeErr != nil {
+		// a failed command usually writes nothing, so its exit status explains the decode error
+		_, _ = io.Copy(ioutil.Discard, stdOut)
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("error waiting on cmd %v %v: %w", cmd, args, err)
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("error decoding cmd %v %v: %w", cmd, args, decodeErr)
+	}
+	return nil
+}
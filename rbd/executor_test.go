@@ -0,0 +1,194 @@
+package rbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeExitError is returned by fakeExecutor for commands which exit unsuccessfully
+type fakeExitError int
+
+func (e fakeExitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+
+func (e fakeExitError) ExitCode() int { return int(e) }
+
+// fakeExecutor records the commands it is asked to run and answers them with out, stderr and err
+type fakeExecutor struct {
+	mu   sync.Mutex
+	cmds [][]string
+	// deadlines records whether each command was run with a deadline
+	deadlines []bool
+	out       string
+	stderr    string
+	err       error
+}
+
+func (f *fakeExecutor) record(ctx context.Context, name string, args []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cmds = append(f.cmds, append([]string{name}, args...))
+	_, ok := ctx.Deadline()
+	f.deadlines = append(f.deadlines, ok)
+}
+
+func (f *fakeExecutor) Run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+	f.record(ctx, name, args)
+	if stdout != nil {
+		_, _ = io.WriteString(stdout, f.out)
+	}
+	if stderr != nil {
+		_, _ = io.WriteString(stderr, f.stderr)
+	}
+	return f.err
+}
+
+func (f *fakeExecutor) Output(ctx context.Context, stderr io.Writer, name string, args ...string) ([]byte, error) {
+	f.record(ctx, name, args)
+	if stderr != nil {
+		_, _ = io.WriteString(stderr, f.stderr)
+	}
+	return []byte(f.out), f.err
+}
+
+func (f *fakeExecutor) StreamJSON(ctx context.Context, v interface{}, stderr io.Writer, name string, args ...string) error {
+	return errors.New("not implemented")
+}
+
+// withFakeExecutor runs the package's commands with f until the returned function is called
+func withFakeExecutor(f *fakeExecutor) func() {
+	SetExecutor(f)
+	return func() { SetExecutor(nil) }
+}
+
+func TestGrowFileSystem(t *testing.T) {
+	tests := []struct {
+		fs   string
+		want []string
+	}{
+		{"xfs", []string{"xfs_growfs", "/mnt/vol"}},
+		{"ext4", []string{"resize2fs", "/dev/nbd0"}},
+		{"ext3", []string{"resize2fs", "/dev/nbd0"}},
+		{"btrfs", []string{"btrfs", "filesystem", "resize", "max", "/mnt/vol"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fs, func(t *testing.T) {
+			f := &fakeExecutor{}
+			defer withFakeExecutor(f)()
+			if err := GrowFileSystem("/dev/nbd0", tt.fs, "/mnt/vol"); err != nil {
+				t.Fatalf("GrowFileSystem() error = %v", err)
+			}
+			if len(f.cmds) != 1 || !reflect.DeepEqual(f.cmds[0], tt.want) {
+				t.Errorf("GrowFileSystem() ran %v, want %v", f.cmds, tt.want)
+			}
+		})
+	}
+}
+
+func TestGrowFileSystemUnsupported(t *testing.T) {
+	f := &fakeExecutor{}
+	defer withFakeExecutor(f)()
+	if err := GrowFileSystem("/dev/nbd0", "vfat", "/mnt/vol"); err == nil {
+		t.Error("GrowFileSystem(vfat) error = nil, want an error")
+	}
+	if len(f.cmds) != 0 {
+		t.Errorf("GrowFileSystem(vfat) ran %v, want nothing", f.cmds)
+	}
+}
+
+func TestMkfs(t *testing.T) {
+	f := &fakeExecutor{}
+	defer withFakeExecutor(f)()
+	if err := mkfs("/dev/nbd0", "xfs", "-L", "vol"); err != nil {
+		t.Fatalf("mkfs() error = %v", err)
+	}
+	want := []string{"mkfs.xfs", "-K", "-L", "vol", "/dev/nbd0"}
+	if len(f.cmds) != 1 || !reflect.DeepEqual(f.cmds[0], want) {
+		t.Errorf("mkfs() ran %v, want %v", f.cmds, want)
+	}
+}
+
+func TestMkfsError(t *testing.T) {
+	f := &fakeExecutor{out: "mkfs.ext4: Device size reported to be zero\n", err: fakeExitError(1)}
+	defer withFakeExecutor(f)()
+	err := mkfs("/dev/nbd0", "ext4")
+	if err == nil {
+		t.Fatal("mkfs() error = nil, want an error")
+	}
+	if !strings.Contains(err.Error(), "Device size reported to be zero") {
+		t.Errorf("mkfs() error = %v, want the output of mkfs", err)
+	}
+	var exitErr exitCoder
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Errorf("mkfs() error = %v, want exit status 1", err)
+	}
+}
+
+// withRbdBin runs rbd commands as "rbd" without looking for the binary until the returned function is called
+func withRbdBin() func() {
+	rbdBinMutex.Lock()
+	rbdBinPath = "rbd"
+	rbdBinMutex.Unlock()
+	return func() {
+		rbdBinMutex.Lock()
+		rbdBinPath = ""
+		rbdBinMutex.Unlock()
+	}
+}
+
+func TestCmdRunMapsExitCodes(t *testing.T) {
+	defer withRbdBin()()
+
+	tests := []struct {
+		name   string
+		code   int
+		stderr string
+		want   error
+	}{
+		{"does not exist", 2, "rbd: error opening image vol: (2) No such file or directory", ErrDoesNotExist},
+		{"exists", 17, "rbd: create error: (17) File exists", ErrAlreadyExists},
+		{"full", 28, "rbd: create error: (28) No space left on device", ErrClusterFull},
+		{"permission", 1, "rbd: error opening pool: (1) Operation not permitted", ErrPermission},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeExecutor{stderr: tt.stderr, err: fakeExitError(tt.code)}
+			defer withFakeExecutor(f)()
+			err := cmdRun(context.Background(), createErrs, "create", "--size", "1G", "rbd/vol")
+			if !errors.Is(err, tt.want) {
+				t.Errorf("cmdRun() error = %v, want %v", err, tt.want)
+			}
+			var cmdErr *CmdError
+			if !errors.As(err, &cmdErr) || cmdErr.ExitCode != tt.code {
+				t.Errorf("cmdRun() error = %v, want a CmdError with exit status %v", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestFlattenNoTimeoutOrRetry(t *testing.T) {
+	defer withRbdBin()()
+	SetCmdTimeout(time.Minute)
+	defer SetCmdTimeout(0)
+	SetRetryPolicy(&RetryPolicy{Attempts: 3})
+	defer SetRetryPolicy(nil)
+
+	f := &fakeExecutor{stderr: "rbd: flatten error: (110) Connection timed out", err: fakeExitError(110)}
+	defer withFakeExecutor(f)()
+	pool := GetPool("rbd")
+	if err := pool.getImage("vol").Flatten(); err == nil {
+		t.Fatal("Flatten() error = nil, want an error")
+	}
+	if len(f.cmds) != 1 {
+		t.Errorf("Flatten() ran %v commands, want 1", len(f.cmds))
+	}
+	if len(f.deadlines) > 0 && f.deadlines[0] {
+		t.Error("Flatten() ran with the command timeout")
+	}
+}
@@ -0,0 +1,22 @@
+package rbd
+
+import "io"
+
+// Export writes the contents of the image to w as a raw disk image
+func (img *Image) Export(w io.Writer) error {
+	return wrapErr(cmdStream(img.context(), imageErrs, nil, w, img.cmdArgs("export", "--no-progress", "-")...), "error exporting %v", img.FullName())
+}
+
+// Import creates an image in the pool from a raw disk image read from r.
+// args are passed to rbd import, and accept the same image options as CreateImage.
+func (pool *Pool) Import(name string, r io.Reader, args ...string) (*Image, error) {
+	if err := ValidateImageName(name); err != nil {
+		return nil, err
+	}
+	args = append(append(append([]string{"import"}, pool.destArgs(name)...), "--no-progress"), args...)
+	args = append(args, "-")
+	if err := cmdStream(pool.context(), createErrs, r, nil, pool.cmdArgs(args...)...); err != nil {
+		return nil, wrapErr(err, "error importing %v/%v", pool.FullName(), name)
+	}
+	return pool.createdImage(name), nil
+}
@@ -0,0 +1,129 @@
+package rbd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidFeatures is returned when a set of image features is unknown, unsupported or incomplete
+var ErrInvalidFeatures = errors.New("invalid image features")
+
+// Feature is an rbd image feature
+type Feature string
+
+// Image features which can be enabled
+const (
+	FeatureLayering      Feature = "layering"
+	FeatureExclusiveLock Feature = "exclusive-lock"
+	FeatureObjectMap     Feature = "object-map"
+	FeatureFastDiff      Feature = "fast-diff"
+	FeatureDeepFlatten   Feature = "deep-flatten"
+	FeatureJournaling    Feature = "journaling"
+)
+
+var knownFeatures = map[Feature]struct{}{
+	FeatureLayering:      struct{}{},
+	FeatureExclusiveLock: struct{}{},
+	FeatureObjectMap:     struct{}{},
+	FeatureFastDiff:      struct{}{},
+	FeatureDeepFlatten:   struct{}{},
+	FeatureJournaling:    struct{}{},
+}
+
+// featureDeps are the features that must also be enabled to use a feature
+var featureDeps = map[Feature][]Feature{
+	FeatureObjectMap:  {FeatureExclusiveLock},
+	FeatureFastDiff:   {FeatureObjectMap},
+	FeatureJournaling: {FeatureExclusiveLock},
+}
+
+// unsupportedFeatures are the features each device type cannot map
+var unsupportedFeatures = map[string][]Feature{
+	"nbd":  {},
+	"krbd": {FeatureJournaling},
+}
+
+// Valid returns true if f is a known feature
+func (f Feature) Valid() bool {
+	_, ok := knownFeatures[f]
+	return ok
+}
+
+// ParseFeatures splits a comma separated list of features
+func ParseFeatures(s string) []string {
+	features := []string{}
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			features = append(features, f)
+		}
+	}
+	return features
+}
+
+// ValidateFeatures checks that features are known, that their dependencies are included,
+// and that an image with these features can be mapped with deviceType (nbd or krbd)
+func ValidateFeatures(deviceType string, features ...string) error {
+	unsupported, ok := unsupportedFeatures[deviceType]
+	if !ok {
+		return fmt.Errorf("unknown device type %v: %w", deviceType, ErrInvalidFeatures)
+	}
+	enabled := make(map[Feature]struct{}, len(features))
+	for _, f := range features {
+		if !Feature(f).Valid() {
+			return fmt.Errorf("unknown feature %v: %w", f, ErrInvalidFeatures)
+		}
+		enabled[Feature(f)] = struct{}{}
+	}
+	for _, f := range features {
+		for _, dep := range featureDeps[Feature(f)] {
+			if _, ok := enabled[dep]; !ok {
+				return fmt.Errorf("%v requires %v: %w", f, dep, ErrInvalidFeatures)
+			}
+		}
+		for _, u := range unsupported {
+			if Feature(f) == u {
+				return fmt.Errorf("%v is not supported by %v: %w", f, deviceType, ErrInvalidFeatures)
+			}
+		}
+	}
+	return nil
+}
+
+// HasFeature returns true if feature f is enabled
+func (i *DevInfo) HasFeature(f Feature) bool {
+	for _, e := range i.Features {
+		if Feature(e) == f {
+			return true
+		}
+	}
+	return false
+}
+
+// Features returns the features enabled on the image
+func (img *Image) Features() ([]Feature, error) {
+	info, err := img.Info()
+	if err != nil {
+		return nil, err
+	}
+	features := make([]Feature, 0, len(info.Features))
+	for _, f := range info.Features {
+		features = append(features, Feature(f))
+	}
+	return features, nil
+}
+
+// featureArgs checks that features are known and returns them as arguments
+func featureArgs(features []Feature) ([]string, error) {
+	if len(features) == 0 {
+		return nil, fmt.Errorf("no features given: %w", ErrInvalidFeatures)
+	}
+	args := make([]string, 0, len(features))
+	for _, f := range features {
+		if !f.Valid() {
+			return nil, fmt.Errorf("unknown feature %v: %w", f, ErrInvalidFeatures)
+		}
+		args = append(args, string(f))
+	}
+	return args, nil
+}
@@ -0,0 +1,219 @@
+package rbd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// ErrFreezeTimeout is returned when fsfreeze does not complete in time, or a filesystem stayed frozen
+// longer than the freeze timeout and was unfrozen by the watchdog
+var ErrFreezeTimeout = errors.New("filesystem freeze timed out")
+
+var fsFreezePath string
+
+var freezeTimeout = 30 * time.Second
+
+// SetFreezeTimeout sets the maximum time a filesystem may stay frozen for a snapshot. A watchdog unfreezes
+// the filesystem after this time even if the snapshot has not completed or this process has died. Use 0 for no timeout.
+func SetFreezeTimeout(d time.Duration) {
+	freezeTimeout = d
+}
+
+// FSFreeze freezes a filesystem
+func FSFreeze(mountpoint string) error {
+	return fsFreeze(mountpoint, false)
+}
+
+// FSUnfreeze unfreezes a filesystem
+func FSUnfreeze(mountpoint string) error {
+	return fsFreeze(mountpoint, true)
+}
+
+func fsFreezeBin() (string, error) {
+	var err error
+	if fsFreezePath == "" {
+		fsFreezePath, err = exec.LookPath("fsfreeze")
+	}
+	return fsFreezePath, err
+}
+
+func fsFreeze(mountpoint string, unfreeze bool) error {
+	bin, err := fsFreezeBin()
+	if err != nil {
+		return err
+	}
+	op := "freeze"
+	if unfreeze {
+		op = "unfreeze"
+	}
+
+	// fsfreeze can block in the kernel where it cannot be killed, so don't wait for it past the timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- executor.Run(ctx, nil, nil, nil, bin, "--"+op, mountpoint) }()
+	var timeout <-chan time.Time
+	if freezeTimeout > 0 {
+		timeout = time.After(freezeTimeout)
+	}
+	select {
+	case err = <-done:
+		cancel()
+	case <-timeout:
+		cancel()
+		return fmt.Errorf("%v %v did not complete in %v: %w", op, mountpoint, freezeTimeout, ErrFreezeTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to %v %v: %w", op, mountpoint, err)
+	}
+
+	return nil
+}
+
+// startFreezeWatchdog starts a process which unfreezes mountpoint after the freeze timeout.
+// It is a separate process so that it still runs if this one dies while the filesystem is frozen.
+// The returned function stops the watchdog. That kills the shell, the sleep it started exits on its own without
+// unfreezing anything.
+func startFreezeWatchdog(mountpoint string) (func(), error) {
+	if freezeTimeout <= 0 {
+		return func() {}, nil
+	}
+	bin, err := fsFreezeBin()
+	if err != nil {
+		return nil, err
+	}
+	secs := strconv.FormatFloat(freezeTimeout.Seconds(), 'f', 3, 64)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// the command is killed when the watchdog is stopped
+		_ = executor.Run(ctx, nil, nil, nil, "sh", "-c", `sleep "$1" && exec "$2" --unfreeze "$3"`, "freeze-watchdog", secs, bin, mountpoint)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// freezeWithWatchdog freezes mountpoint under the watchdog and returns the function to unfreeze it, which returns
+// ErrFreezeTimeout if the watchdog may have unfrozen the filesystem first
+func freezeWithWatchdog(mountpoint string) (func() error, error) {
+	stopWatchdog, err := startFreezeWatchdog(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	frozenAt := time.Now()
+	if err = FSFreeze(mountpoint); err != nil {
+		if errors.Is(err, ErrFreezeTimeout) {
+			// the freeze may still complete, the watchdog covers a hung unfreeze
+			_ = FSUnfreeze(mountpoint)
+		}
+		stopWatchdog()
+		return nil, err
+	}
+	return func() error {
+		err := FSUnfreeze(mountpoint)
+		stopWatchdog()
+		if frozen := time.Since(frozenAt); freezeTimeout > 0 && frozen >= freezeTimeout {
+			return fmt.Errorf("%v was frozen for %v: %w", mountpoint, frozen, ErrFreezeTimeout)
+		}
+		return err
+	}, nil
+}
+
+// FreezeHook is called with the mountpoint of an image before its filesystem is frozen for a snapshot,
+// eg: to pause applications using it. The returned function is called after the filesystem is unfrozen.
+type FreezeHook func(img *Image, mountpoint string) (func() error, error)
+
+// runFreezeHooks runs hooks in order and returns a function which undoes them in reverse order.
+// If a hook fails the hooks which already ran are undone.
+func runFreezeHooks(img *Image, mountpoint string, hooks []FreezeHook) (func() error, error) {
+	undos := make([]func() error, 0, len(hooks))
+	undo := func() error {
+		var err error
+		for i := len(undos) - 1; i >= 0; i-- {
+			if uerr := undos[i](); uerr != nil && err == nil {
+				err = uerr
+			}
+		}
+		return err
+	}
+	for _, h := range hooks {
+		u, err := h(img, mountpoint)
+		if err != nil {
+			_ = undo()
+			return nil, fmt.Errorf("error running freeze hook for %v: %w", mountpoint, err)
+		}
+		if u != nil {
+			undos = append(undos, u)
+		}
+	}
+	return undo, nil
+}
+
+func fsFreezeBlk(img *Image, blk string, hooks []FreezeHook) (func() error, error) {
+	mounts, err := MountsForDevice(blk)
+	if err != nil {
+		return nil, fmt.Errorf("error getting mounts for %v: %w", blk, err)
+	}
+	if len(mounts) == 0 {
+		if err = isMountedElsewhere(blk, "", nil); err != nil {
+			return nil, err
+		}
+		return func() error { return nil }, nil
+	}
+	mountpoint := primaryMount(mounts).MountPoint
+	undoHooks, err := runFreezeHooks(img, mountpoint, hooks)
+	if err != nil {
+		return nil, err
+	}
+	unfreeze, err := freezeWithWatchdog(mountpoint)
+	if err != nil {
+		_ = undoHooks()
+		return nil, err
+	}
+	return func() error {
+		err := unfreeze()
+		if herr := undoHooks(); herr != nil && err == nil {
+			err = herr
+		}
+		return err
+	}, nil
+}
+
+// FreezeImages freezes the filesystems of every image in imgs mapped on this host, in order, and returns the function
+// which unfreezes them in reverse order. Images which are not mapped are skipped. If any freeze fails, those already
+// frozen are unfrozen. hooks are run before each filesystem is frozen and undone after it is unfrozen.
+func FreezeImages(imgs []*Image, hooks ...FreezeHook) (func() error, error) {
+	unfreezes := []func() error{}
+	unfreezeAll := func() error {
+		var err error
+		for i := len(unfreezes) - 1; i >= 0; i-- {
+			if uerr := unfreezes[i](); uerr != nil && err == nil {
+				err = uerr
+			}
+		}
+		return err
+	}
+	for _, img := range imgs {
+		blk, err := device(img)
+		if err != nil {
+			_ = unfreezeAll()
+			return nil, err
+		}
+		if blk == "" {
+			continue
+		}
+		unfreeze, err := fsFreezeBlk(img, blk, hooks)
+		if err != nil {
+			_ = unfreezeAll()
+			return nil, fmt.Errorf("error freezing %v: %w", img.FullName(), err)
+		}
+		unfreezes = append(unfreezes, unfreeze)
+	}
+	return unfreezeAll, nil
+}
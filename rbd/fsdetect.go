@@ -0,0 +1,122 @@
+package rbd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnknownFilesystem is returned when the filesystem on a device cannot be determined
+var ErrUnknownFilesystem = errors.New("unknown filesystem")
+
+// getFs returns the filesystem on blk using blkid if it is installed, otherwise the superblock,
+// otherwise what the kernel reports for a mounted device
+func getFs(blk string) (string, error) {
+	var errs []string
+	for _, detect := range []func(string) (string, error){blkidFs, superblockFs, sysFs} {
+		fs, err := detect(blk)
+		if err == nil && fs != "" {
+			return fs, nil
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return "", fmt.Errorf("%v (%v): %w", blk, strings.Join(errs, ", "), ErrUnknownFilesystem)
+	}
+	return "", fmt.Errorf("%v: %w", blk, ErrUnknownFilesystem)
+}
+
+// blkidFs returns the filesystem reported by blkid, or empty if blkid is not installed or found nothing
+func blkidFs(blk string) (string, error) {
+	bin, err := exec.LookPath("blkid")
+	if err != nil {
+		return "", nil
+	}
+	stderr := &bytes.Buffer{}
+	out, err := executor.Output(context.Background(), stderr, bin, "-c", "/dev/null", "-p", "-s", "TYPE", "-o", "value", blk)
+	if err != nil {
+		var exitErr exitCoder
+		if errors.As(err, &exitErr) {
+			// 2 means no filesystem was found
+			if exitErr.ExitCode() == 2 {
+				return "", nil
+			}
+			return "", fmt.Errorf("blkid: %v: %w", strings.TrimSpace(stderr.String()), err)
+		}
+		return "", fmt.Errorf("blkid: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+const (
+	extSuperblock       = 1024
+	extMagic            = 0xEF53
+	extCompatJournal    = 0x4
+	extIncompatExt4     = 0x40 | 0x80 | 0x200       // extents, 64bit, flex_bg
+	extROCompatExt4     = 0x8 | 0x10 | 0x20 | 0x400 // huge_file, gdt_csum, dir_nlink, metadata_csum
+	btrfsSuperblock     = 0x10000
+	btrfsMagicOffset    = btrfsSuperblock + 0x40
+	superblockReadBytes = btrfsMagicOffset + 8
+)
+
+// superblockFs identifies ext2/3/4, xfs and btrfs by their superblock magic numbers
+func superblockFs(blk string) (string, error) {
+	f, err := os.Open(blk)
+	if err != nil {
+		return "", fmt.Errorf("error reading superblock: %w", err)
+	}
+	defer f.Close()
+	buf := make([]byte, superblockReadBytes)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", fmt.Errorf("error reading superblock: %w", err)
+	}
+	buf = buf[:n]
+
+	if bytes.HasPrefix(buf, []byte("XFSB")) {
+		return "xfs", nil
+	}
+	if len(buf) >= btrfsMagicOffset+8 && string(buf[btrfsMagicOffset:btrfsMagicOffset+8]) == "_BHRfS_M" {
+		return "btrfs", nil
+	}
+	if len(buf) >= extSuperblock+0x68 && binary.LittleEndian.Uint16(buf[extSuperblock+0x38:]) == extMagic {
+		compat := binary.LittleEndian.Uint32(buf[extSuperblock+0x5C:])
+		incompat := binary.LittleEndian.Uint32(buf[extSuperblock+0x60:])
+		roCompat := binary.LittleEndian.Uint32(buf[extSuperblock+0x64:])
+		switch {
+		case incompat&extIncompatExt4 != 0 || roCompat&extROCompatExt4 != 0:
+			return "ext4", nil
+		case compat&extCompatJournal != 0:
+			return "ext3", nil
+		}
+		return "ext2", nil
+	}
+	return "", nil
+}
+
+// sysFs returns the filesystem of a mounted device from mountinfo or /sys/fs
+func sysFs(blk string) (string, error) {
+	mounts, err := MountsForDevice(blk)
+	if err != nil {
+		return "", err
+	}
+	if len(mounts) > 0 {
+		return mounts[0].FilesystemType, nil
+	}
+	dev := filepath.Base(blk)
+	for _, fs := range []string{"ext4", "xfs"} {
+		if _, err := os.Stat(filepath.Join("/sys/fs", fs, dev)); err == nil {
+			return fs, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,36 @@
+package rbd
+
+import (
+	"sync"
+)
+
+// FileSystemProfile contains the options used when creating and mounting a filesystem
+type FileSystemProfile struct {
+	// MkfsArgs are passed to mkfs.<fs> before the device
+	MkfsArgs []string
+	// MountData is the default data string used when mounting, if none is supplied
+	MountData string
+}
+
+var fsProfilesMutex = &sync.RWMutex{}
+
+// images are thin provisioned, so discarding on mkfs only wastes time
+var fsProfiles = map[string]FileSystemProfile{
+	"xfs":   {MkfsArgs: []string{"-K"}},
+	"ext4":  {MkfsArgs: []string{"-E", "nodiscard"}},
+	"btrfs": {MkfsArgs: []string{"--nodiscard"}},
+}
+
+// SetFileSystemProfile sets the profile for a filesystem, replacing any existing profile
+func SetFileSystemProfile(fs string, p FileSystemProfile) {
+	fsProfilesMutex.Lock()
+	defer fsProfilesMutex.Unlock()
+	fsProfiles[fs] = p
+}
+
+// GetFileSystemProfile gets the profile for a filesystem. Filesystems without a profile get an empty profile.
+func GetFileSystemProfile(fs string) FileSystemProfile {
+	fsProfilesMutex.RLock()
+	defer fsProfilesMutex.RUnlock()
+	return fsProfiles[fs]
+}
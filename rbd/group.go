@@ -0,0 +1,164 @@
+package rbd
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Group is an rbd group, the images in a group can be snapshotted together at a single point in time
+type Group struct {
+	name string
+	pool *Pool
+}
+
+// Group gets a group object in the pool (does not verify group exists)
+func (pool *Pool) Group(name string) *Group {
+	return &Group{name, pool}
+}
+
+// Name is the group name
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Pool is the pool the group lives on
+func (g *Group) Pool() *Pool {
+	return g.pool
+}
+
+// FullName is the full name in the format pool/group
+func (g *Group) FullName() string {
+	return g.pool.FullName() + "/" + g.name
+}
+
+func (g *Group) cmdArgs(args ...string) []string {
+	return g.pool.cmdArgs(append([]string{"--group", g.name}, args...)...)
+}
+
+var groupErrs = exitCodeToErrMap(map[int]error{
+	2:  ErrDoesNotExist,
+	17: ErrAlreadyExists,
+})
+
+// Create creates the group
+func (g *Group) Create() error {
+	err := cmdRun(g.pool.context(), groupErrs, g.cmdArgs("group", "create")...)
+	if err != nil && !errors.Is(err, ErrAlreadyExists) {
+		return wrapErr(err, "error creating group %v", g.FullName())
+	}
+	return err
+}
+
+// Remove removes the group and its snapshots, its images are not removed
+func (g *Group) Remove() error {
+	return wrapErr(cmdRun(g.pool.context(), groupErrs, g.cmdArgs("group", "remove")...), "error removing group %v", g.FullName())
+}
+
+// groupImageArgs returns the arguments naming the group and img for group image add and remove
+func (g *Group) groupImageArgs(img *Image) []string {
+	args := g.pool.cluster.cmdArgs("--group-pool", g.pool.Name(), "--group", g.name, "--image-pool", img.Pool().Name(), "--image", img.Name())
+	if g.pool.Namespace() != "" {
+		args = append(args, "--group-namespace", g.pool.Namespace())
+	}
+	if img.Pool().Namespace() != "" {
+		args = append(args, "--image-namespace", img.Pool().Namespace())
+	}
+	return args
+}
+
+// AddImage adds an image to the group, returning ErrAlreadyExists if it is already a member.
+// An image can only be a member of one group.
+func (g *Group) AddImage(img *Image) error {
+	err := cmdRun(g.pool.context(), groupErrs, append([]string{"group", "image", "add"}, g.groupImageArgs(img)...)...)
+	if err != nil && !errors.Is(err, ErrAlreadyExists) {
+		return wrapErr(err, "error adding %v to group %v", img.FullName(), g.FullName())
+	}
+	return err
+}
+
+// RemoveImage removes an image from the group
+func (g *Group) RemoveImage(img *Image) error {
+	err := cmdRun(g.pool.context(), groupErrs, append([]string{"group", "image", "remove"}, g.groupImageArgs(img)...)...)
+	return wrapErr(err, "error removing %v from group %v", img.FullName(), g.FullName())
+}
+
+type groupImageEntry struct {
+	Image     string `json:"image"`
+	Pool      string `json:"pool"`
+	Namespace string `json:"namespace"`
+}
+
+// Images returns the images in the group
+func (g *Group) Images() ([]*Image, error) {
+	entries := []*groupImageEntry{}
+	if err := cmdJSON(g.pool.context(), &entries, groupErrs, g.cmdArgs("group", "image", "list")...); err != nil {
+		return nil, wrapErr(err, "error listing images in group %v", g.FullName())
+	}
+	imgs := make([]*Image, 0, len(entries))
+	for _, e := range entries {
+		imgs = append(imgs, newPool(g.pool.cluster, e.Pool, e.Namespace, g.pool.context()).getImage(e.Image))
+	}
+	return imgs, nil
+}
+
+// GroupSnapshot is a snapshot of every image in a group
+type GroupSnapshot struct {
+	Name string `json:"snapshot"`
+	// State is complete, or incomplete if the snapshot failed part way
+	State string `json:"state"`
+}
+
+// Snapshots returns the snapshots of the group
+func (g *Group) Snapshots() ([]*GroupSnapshot, error) {
+	snaps := []*GroupSnapshot{}
+	err := cmdJSON(g.pool.context(), &snaps, groupErrs, g.cmdArgs("group", "snap", "list")...)
+	return snaps, wrapErr(err, "error listing snapshots of group %v", g.FullName())
+}
+
+// CreateSnapshot snapshots every image in the group at the same point in time
+func (g *Group) CreateSnapshot(name string) error {
+	defer g.invalidateImagesInfo()
+	err := cmdRun(g.pool.context(), groupErrs, g.cmdArgs("group", "snap", "create", "--snap", name)...)
+	if err != nil && !errors.Is(err, ErrAlreadyExists) {
+		return wrapErr(err, "error creating snapshot %v of group %v", name, g.FullName())
+	}
+	return err
+}
+
+// RemoveSnapshot removes a snapshot of the group
+func (g *Group) RemoveSnapshot(name string) error {
+	defer g.invalidateImagesInfo()
+	err := cmdRun(g.pool.context(), groupErrs, g.cmdArgs("group", "snap", "remove", "--snap", name)...)
+	return wrapErr(err, "error removing snapshot %v of group %v", name, g.FullName())
+}
+
+func (g *Group) invalidateImagesInfo() {
+	imgs, err := g.Images()
+	if err != nil {
+		return
+	}
+	for _, img := range imgs {
+		InvalidateInfo(img)
+	}
+}
+
+// CreateConsistentSnapshot snapshots every image in the group at the same point in time, first freezing the
+// filesystems of all the images mapped here so they are consistent with each other, eg: a database's data and
+// write ahead log. The filesystems are unfrozen once the snapshot is taken. As with Image.CreateConsistentSnapshot,
+// ErrFreezeTimeout is returned with a completed snapshot if a filesystem stayed frozen too long.
+// hooks are run before each filesystem is frozen and undone after it is unfrozen.
+func (g *Group) CreateConsistentSnapshot(name string, hooks ...FreezeHook) error {
+	imgs, err := g.Images()
+	if err != nil {
+		return err
+	}
+	unfreezeAll, err := FreezeImages(imgs, hooks...)
+	if err != nil {
+		return fmt.Errorf("error freezing for snapshot of group %v: %w", g.FullName(), err)
+	}
+	err = g.CreateSnapshot(name)
+	if uerr := unfreezeAll(); uerr != nil && err == nil {
+		err = uerr
+	}
+	return err
+}
@@ -1,7 +1,12 @@
 package rbd
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
 )
 
 // Image is an rbd image
@@ -15,6 +20,32 @@ var _ Dev = (*Image)(nil) // compile check that Image satisfies  Dev
 // ErrImageDoesNotExist is returned if an image does not exist
 var ErrImageDoesNotExist = errors.New("image does not exist")
 
+// ErrInvalidName is returned if an image name cannot be used
+var ErrInvalidName = errors.New("invalid image name")
+
+// MaxImageNameLength is the longest image name accepted by ValidateImageName, so it can also be used as a directory name
+const MaxImageNameLength = 255
+
+// ValidateImageName checks that name can be used as an image name without addressing a different pool or snapshot
+func ValidateImageName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("name is empty: %w", ErrInvalidName)
+	case len(name) > MaxImageNameLength:
+		return fmt.Errorf("%v is longer than %v characters: %w", name, MaxImageNameLength, ErrInvalidName)
+	case strings.HasPrefix(name, "."):
+		return fmt.Errorf("%v begins with '.': %w", name, ErrInvalidName)
+	case strings.ContainsAny(name, "/@"):
+		return fmt.Errorf("%v contains '/' or '@': %w", name, ErrInvalidName)
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("%q contains whitespace or control characters: %w", name, ErrInvalidName)
+		}
+	}
+	return nil
+}
+
 func getImage(pool *Pool, name string) *Image {
 	img := &Image{name, pool}
 	return img
@@ -40,6 +71,15 @@ func (img *Image) Pool() *Pool {
 	return img.pool
 }
 
+// WithContext returns a copy of the image whose commands are killed when ctx is done
+func (img *Image) WithContext(ctx context.Context) *Image {
+	return getImage(img.Pool().WithContext(ctx), img.Name())
+}
+
+func (img *Image) context() context.Context {
+	return img.Pool().context()
+}
+
 func (img *Image) cmdArgs(args ...string) []string {
 	args = append([]string{"--image", img.Name()}, args...)
 	return img.Pool().cmdArgs(args...)
@@ -57,15 +97,15 @@ func (img *Image) Info() (*DevInfo, error) {
 
 // Map maps to an nbd device
 func (img *Image) Map(args ...string) (string, error) {
-	return devMap(img, args...)
+	return devMap(img, append(quiesceArgs(), args...)...)
 }
 
 // MapExclusive maps to an nbd device using the exclusive option
 func (img *Image) MapExclusive(args ...string) (string, error) {
-	args = append([]string{"--exclusive"}, args...)
+	args = append(append([]string{"--exclusive"}, quiesceArgs()...), args...)
 	blk, err := devMap(img, args...)
 	if errors.Is(err, ErrExclusiveLockNotEnabled) {
-		err = img.EnableFeatures("exclusive-lock")
+		err = img.EnableFeatures(FeatureExclusiveLock)
 		if err != nil {
 			return "", wrapErr(err, "error enabling exclusive-lock on %v", img.FullName())
 		}
@@ -75,22 +115,40 @@ func (img *Image) MapExclusive(args ...string) (string, error) {
 	return blk, wrapErr(err, "error exlusive mapping %v", img.FullName())
 }
 
+// Reattach starts a new rbd-nbd process for the image on an existing nbd device, so filesystems
+// still mounted from blk after its rbd-nbd process exited work again. The image is locked exclusively.
+func (img *Image) Reattach(blk string) error {
+	defer invalidateMappedCache()
+	_, err := cmdOut(img.context(), devMapErrors, img.cmdArgs(nbdArgs("attach", append([]string{"--device", blk, "--exclusive"}, cookieArgs(img)...)...)...)...)
+	return wrapErr(err, "error reattaching %v to %v", img.FullName(), blk)
+}
+
 // ErrFeatureAlreadyEnabled is returned when enabling a feature that is already enabled
 var ErrFeatureAlreadyEnabled = errors.New("feature already enabled")
 
 var featureEnableErrMap = exitCodeToErrMap(map[int]error{22: ErrFeatureAlreadyEnabled})
 
-// EnableFeatures enables features
-func (img *Image) EnableFeatures(feature ...string) error {
-	args := append([]string{"feature", "enable"}, img.cmdArgs(feature...)...)
-	return cmdRun(featureEnableErrMap, args...)
+// EnableFeatures enables features, unknown features return ErrInvalidFeatures
+func (img *Image) EnableFeatures(feature ...Feature) error {
+	defer InvalidateInfo(img)
+	features, err := featureArgs(feature)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"feature", "enable"}, img.cmdArgs(features...)...)
+	return cmdRun(img.context(), featureEnableErrMap, args...)
 }
 
-// DisableFeatures disables features
-func (img *Image) DisableFeatures(feature ...string) error {
-	args := append([]string{"feature", "disable"}, feature...)
+// DisableFeatures disables features, unknown features return ErrInvalidFeatures
+func (img *Image) DisableFeatures(feature ...Feature) error {
+	defer InvalidateInfo(img)
+	features, err := featureArgs(feature)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"feature", "disable"}, features...)
 	args = img.cmdArgs(args...)
-	return cmdRun(nil, args...)
+	return cmdRun(img.context(), nil, args...)
 }
 
 // Mount mounts the device (must already be mapped)
@@ -120,12 +178,100 @@ func (img *Image) Unmount(mountPoint string) error {
 
 // UnmountAndUnmap unmounts and unmaps the device
 func (img *Image) UnmountAndUnmap(mountPoint string) error {
-	return devUnmountAndUnmap(img, mountPoint)
+	return devUnmountAndUnmap(img, mountPoint, nil)
+}
+
+// UnmountAndUnmapWithScan unmounts and unmaps the device, checking for mounts in other namespaces with scan
+func (img *Image) UnmountAndUnmapWithScan(mountPoint string, scan *MountScan) error {
+	return devUnmountAndUnmap(img, mountPoint, scan)
+}
+
+var renameErrs = exitCodeToErrMap(map[int]error{
+	2:  ErrDoesNotExist,
+	17: ErrAlreadyExists,
+})
+
+// Rename renames the image within its pool and returns the renamed image. The image must not be mapped here, or
+// open by a client on any host, which would lose track of it. Those return ErrDeviceBusy and a *HasWatchersError.
+func (img *Image) Rename(name string) (*Image, error) {
+	defer InvalidateInfo(img)
+	if err := ValidateImageName(name); err != nil {
+		return nil, err
+	}
+	blk, err := device(img)
+	if err != nil {
+		return nil, err
+	}
+	if blk != "" {
+		return nil, fmt.Errorf("%v is mapped to %v: %w", img.FullName(), blk, ErrDeviceBusy)
+	}
+	status, err := img.Status()
+	if err != nil {
+		return nil, err
+	}
+	if len(status.Watchers) > 0 {
+		return nil, &HasWatchersError{Image: img.FullName(), Watchers: status.Watchers}
+	}
+	err = cmdRun(img.context(), renameErrs, img.cmdArgs(append([]string{"rename"}, img.Pool().destArgs(name)...)...)...)
+	if err != nil {
+		return nil, wrapErr(err, "error renaming %v to %v", img.FullName(), name)
+	}
+	return img.Pool().createdImage(name), nil
 }
 
-// Remove deletes the device from the pool
+// Remove deletes the device from the pool. If a client on any host has the image open, including a
+// mapping on this host, it returns a *HasWatchersError identifying the clients. An image being live migrated
+// returns ErrMigrating.
 func (img *Image) Remove() error {
-	return cmdRun(nil, img.cmdArgs("remove", "--no-progress")...)
+	defer InvalidateInfo(img)
+	if err := img.checkSafeToRemove(); err != nil {
+		return err
+	}
+	return cmdRun(img.context(), nil, img.cmdArgs("remove", "--no-progress")...)
+}
+
+var copyErrs = exitCodeToErrMap(map[int]error{
+	2:  ErrDoesNotExist,
+	17: ErrAlreadyExists,
+})
+
+// Copy copies the current contents of the image to a new image in destPool. Snapshots are not copied.
+// Like Flatten, it is only bounded by the image's context and is never retried.
+func (img *Image) Copy(destPool *Pool, name string, args ...string) (*Image, error) {
+	return img.copy([]string{"copy"}, destPool, name, args...)
+}
+
+// DeepCopy copies the image with its snapshots to a new image in destPool. A clone remains a clone of the same parent.
+func (img *Image) DeepCopy(destPool *Pool, name string, args ...string) (*Image, error) {
+	return img.copy([]string{"deep", "copy"}, destPool, name, args...)
+}
+
+func (img *Image) copy(cmd []string, destPool *Pool, name string, args ...string) (*Image, error) {
+	if err := ValidateImageName(name); err != nil {
+		return nil, err
+	}
+	args = append(append(append(cmd, destPool.destArgs(name)...), "--no-progress"), args...)
+	// a copy of a large image can outlast the command timeout, and a retry would find the partly copied destination
+	if err := cmdRunLong(img.context(), copyErrs, img.cmdArgs(args...)...); err != nil {
+		return nil, wrapErr(err, "error copying %v to %v/%v", img.FullName(), destPool.FullName(), name)
+	}
+	return destPool.createdImage(name), nil
+}
+
+// ErrNoParent is returned when flattening an image that is not a clone
+var ErrNoParent = errors.New("image has no parent")
+
+var flattenErrs = exitCodeToErrMap(map[int]error{
+	2:  ErrDoesNotExist,
+	22: ErrNoParent,
+})
+
+// Flatten copies all data from the parent snapshot into a cloned image, so the parent can be removed.
+// Flattening a large clone can take much longer than the command timeout, so it is only bounded by the image's
+// context, see WithContext, and is never retried.
+func (img *Image) Flatten() error {
+	defer InvalidateInfo(img)
+	return wrapErr(cmdRunLong(img.context(), flattenErrs, img.cmdArgs("flatten", "--no-progress")...), "error flattening %v", img.FullName())
 }
 
 func (img *Image) getSnapshot(name string) *Snapshot {
@@ -141,16 +287,19 @@ func (img *Image) GetSnapshot(name string) (*Snapshot, error) {
 
 // CreateSnapshot creates a snapshot of the image
 func (img *Image) CreateSnapshot(name string) (*Snapshot, error) {
-	args := img.cmdArgs("snap", "create", "--snap", name)
-	err := cmdRun(createErrs, args...)
+	err := activeBackend.createSnapshot(img, name)
 	if err != nil && !errors.Is(err, ErrAlreadyExists) {
 		return nil, err
 	}
-	return img.getSnapshot(name), err
+	snap := img.getSnapshot(name)
+	InvalidateInfo(snap)
+	return snap, err
 }
 
-// CreateConsistentSnapshot creates a snapshot of the image, freezing the filesystem first for consistency
-func (img *Image) CreateConsistentSnapshot(name string, onlyIfMapped bool) (*Snapshot, error) {
+// CreateConsistentSnapshot creates a snapshot of the image, freezing the filesystem first for consistency.
+// If the filesystem stayed frozen longer than the freeze timeout the snapshot is returned with ErrFreezeTimeout.
+// hooks are run before the filesystem is frozen and undone after it is unfrozen.
+func (img *Image) CreateConsistentSnapshot(name string, onlyIfMapped bool, hooks ...FreezeHook) (*Snapshot, error) {
 	blk, err := device(img)
 	if err != nil {
 		return nil, err
@@ -158,14 +307,19 @@ func (img *Image) CreateConsistentSnapshot(name string, onlyIfMapped bool) (*Sna
 	if onlyIfMapped && blk == "" {
 		return nil, ErrNotMapped
 	}
-	if blk != "" {
-		unfreeze, err := fsFreezeBlk(blk)
-		defer unfreeze()
-		if err != nil {
-			return nil, err
-		}
+	if blk == "" {
+		return img.CreateSnapshot(name)
 	}
-	return img.CreateSnapshot(name)
+	unfreeze, err := fsFreezeBlk(img, blk, hooks)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := img.CreateSnapshot(name)
+	if uerr := unfreeze(); uerr != nil && err == nil {
+		// the snapshot may have been taken after the watchdog unfroze the filesystem
+		err = wrapErr(uerr, "error unfreezing %v after snapshot %v", img.FullName(), name)
+	}
+	return snap, err
 }
 
 // Device returns the nbd device that this image is mapped to
@@ -175,15 +329,16 @@ func (img *Image) Device() (string, error) {
 
 // Snapshots returns all existing snapshots of the image
 func (img *Image) Snapshots() ([]*Snapshot, error) {
-	args := img.cmdArgs("snap", "list")
-	snaps := []*snapshotListEntry{}
-	err := cmdJSON(&snaps, nil, args...)
+	snaps, err := activeBackend.listSnapshots(img)
 	if err != nil {
 		return nil, err
 	}
 	r := make([]*Snapshot, 0, len(snaps))
 	for _, s := range snaps {
-		r = append(r, img.getSnapshot(s.Name))
+		snap := img.getSnapshot(s.Name)
+		snap.createdAt = time.Time(s.Timestamp)
+		snap.size = s.Size
+		r = append(r, snap)
 	}
 	return r, nil
 }
@@ -193,14 +348,32 @@ func (img *Image) FileSystem() (string, error) {
 	return devFileSystem(img)
 }
 
-// LockInfo is an rbd lock
-type LockInfo struct {
-	Locker  string
-	address string
+// DiskUsage returns the space provisioned for and used by the image, not including snapshots.
+// Measuring usage without a valid fast-diff map means reading every object, so for those images
+// UsedSize is UsageUnknown. Use ExactDiskUsage to measure them anyway.
+func (img *Image) DiskUsage() (*DiskUsage, error) {
+	info, err := img.Info()
+	if err != nil {
+		return nil, err
+	}
+	if !info.hasFastDiff() {
+		return &DiskUsage{Name: img.Name(), ProvisionedSize: info.Size, UsedSize: UsageUnknown}, nil
+	}
+	return img.ExactDiskUsage()
 }
 
-func (img *Image) GetLocks() (map[string]*LockInfo, error) {
-	args := img.cmdArgs("lock", "list")
-	locks := make(map[string]*LockInfo)
-	return locks, cmdJSON(&locks, nil, args...)
+// ExactDiskUsage returns the space provisioned for and used by the image, not including snapshots.
+// This is slow on images without the fast-diff feature.
+func (img *Image) ExactDiskUsage() (*DiskUsage, error) {
+	du := &diskUsageList{}
+	err := cmdJSON(img.context(), du, imageErrs, img.cmdArgs("du")...)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range du.Images {
+		if u.Snapshot == "" {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("no usage returned for %v: %w", img.FullName(), ErrDoesNotExist)
 }
@@ -0,0 +1,89 @@
+package rbd
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+type infoCacheKey struct {
+	cluster Cluster
+	name    string
+}
+
+type infoCacheEntry struct {
+	info *DevInfo
+	time time.Time
+}
+
+// DefaultInfoCacheTTL is how long the info of images and snapshots is cached by default
+const DefaultInfoCacheTTL = 5 * time.Second
+
+var infoCacheMutex = &sync.Mutex{}
+var infoCacheTTL = DefaultInfoCacheTTL
+var infoCache = make(map[infoCacheKey]*infoCacheEntry)
+
+// infoCacheGen counts invalidations, so info fetched while the cache was invalidated is not stored
+var infoCacheGen uint64
+
+// SetInfoCacheTTL sets how long the info of images and snapshots is cached. Use 0 to disable caching.
+// The cache is invalidated when this process changes an image, and when Image.Watch receives a notification,
+// other changes by other clients are seen once the cached info expires.
+func SetInfoCacheTTL(d time.Duration) {
+	infoCacheMutex.Lock()
+	defer infoCacheMutex.Unlock()
+	infoCacheTTL = d
+	infoCache = make(map[infoCacheKey]*infoCacheEntry)
+	infoCacheGen++
+}
+
+func infoKey(d Dev) infoCacheKey {
+	return infoCacheKey{d.Pool().Cluster(), d.FullName()}
+}
+
+// InvalidateInfo drops the cached info of d, and of the snapshots of d if it is an image
+func InvalidateInfo(d Dev) {
+	infoCacheMutex.Lock()
+	defer infoCacheMutex.Unlock()
+	key := infoKey(d)
+	infoCacheGen++
+	delete(infoCache, key)
+	if _, ok := d.(*Image); !ok {
+		return
+	}
+	for k := range infoCache {
+		if k.cluster == key.cluster && strings.HasPrefix(k.name, key.name+"@") {
+			delete(infoCache, k)
+		}
+	}
+}
+
+// cachedInfo returns the info of d from the cache if it has not expired, otherwise from the backend
+func cachedInfo(d Dev) (*DevInfo, error) {
+	key := infoKey(d)
+	infoCacheMutex.Lock()
+	ttl := infoCacheTTL
+	e, ok := infoCache[key]
+	gen := infoCacheGen
+	infoCacheMutex.Unlock()
+	if ttl <= 0 {
+		return activeBackend.info(d)
+	}
+	if ok && time.Since(e.time) < ttl {
+		// a copy, so callers can't change the cached info
+		info := *e.info
+		return &info, nil
+	}
+	info, err := activeBackend.info(d)
+	if err != nil {
+		return nil, err
+	}
+	c := *info
+	infoCacheMutex.Lock()
+	// the info may predate a change which invalidated the cache while it was fetched
+	if gen == infoCacheGen {
+		infoCache[key] = &infoCacheEntry{info: &c, time: time.Now()}
+	}
+	infoCacheMutex.Unlock()
+	return info, nil
+}
@@ -0,0 +1,143 @@
+package rbd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// flexBool is a bool which releases print as either a json bool or a string
+type flexBool bool
+
+// UnmarshalJSON unmarshals true, false, "true" or "false"
+func (j *flexBool) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "null" || s == "" {
+		return nil
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("error parsing %s as bool: %w", b, err)
+	}
+	*j = flexBool(v)
+	return nil
+}
+
+// flexInt is an integer which releases print as either a json number or a string
+type flexInt int64
+
+// UnmarshalJSON unmarshals a number, or a string containing one
+func (j *flexInt) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "null" || s == "" {
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("error parsing %s as integer: %w", b, err)
+	}
+	*j = flexInt(v)
+	return nil
+}
+
+// flexUint is an unsigned integer which releases print as either a json number or a string
+type flexUint uint64
+
+// UnmarshalJSON unmarshals a number, or a string containing one
+func (j *flexUint) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "null" || s == "" {
+		return nil
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("error parsing %s as unsigned integer: %w", b, err)
+	}
+	*j = flexUint(v)
+	return nil
+}
+
+// UnmarshalJSON unmarshals DevInfo, accepting protected as a bool or a string
+func (i *DevInfo) UnmarshalJSON(b []byte) error {
+	type devInfo DevInfo
+	aux := &struct {
+		*devInfo
+		Protected flexBool `json:"protected"`
+	}{devInfo: (*devInfo)(i)}
+	if err := json.Unmarshal(b, aux); err != nil {
+		return err
+	}
+	i.Protected = bool(aux.Protected)
+	return nil
+}
+
+// UnmarshalJSON unmarshals a Watcher. Releases differ in whether client and cookie are numbers or strings,
+// and some print the client as client.4123.
+func (w *Watcher) UnmarshalJSON(b []byte) error {
+	aux := &struct {
+		Address string          `json:"address"`
+		Client  json.RawMessage `json:"client"`
+		Cookie  flexUint        `json:"cookie"`
+	}{}
+	if err := json.Unmarshal(b, aux); err != nil {
+		return err
+	}
+	client := flexInt(0)
+	if len(aux.Client) > 0 {
+		raw := strings.Replace(string(aux.Client), "client.", "", 1)
+		if err := client.UnmarshalJSON([]byte(raw)); err != nil {
+			return err
+		}
+	}
+	*w = Watcher{Address: aux.Address, Client: int64(client), Cookie: uint64(aux.Cookie)}
+	return nil
+}
+
+// parseWatchers parses the watchers in rbd status json, which newer releases print as a list
+// and older releases as an object with a watcher key for each watcher
+func parseWatchers(b []byte) ([]*Watcher, error) {
+	watchers := []*Watcher{}
+	if len(b) == 0 || string(b) == "null" {
+		return watchers, nil
+	}
+	if err := json.Unmarshal(b, &watchers); err == nil {
+		return watchers, nil
+	}
+	// the keys repeat, so the object is read a token at a time rather than into a map
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, fmt.Errorf("error parsing watchers: %w", err)
+	}
+	for dec.More() {
+		if _, err := dec.Token(); err != nil {
+			return nil, fmt.Errorf("error parsing watchers: %w", err)
+		}
+		w := &Watcher{}
+		if err := dec.Decode(w); err != nil {
+			return nil, fmt.Errorf("error parsing watchers: %w", err)
+		}
+		watchers = append(watchers, w)
+	}
+	return watchers, nil
+}
+
+// UnmarshalJSON unmarshals ImageStatus, accepting the watchers of any release
+func (s *ImageStatus) UnmarshalJSON(b []byte) error {
+	type imageStatus ImageStatus
+	aux := &struct {
+		*imageStatus
+		Watchers json.RawMessage `json:"watchers"`
+		// Mirror is filled from rbd mirror image status, not rbd status
+		Mirror json.RawMessage `json:"mirror"`
+	}{imageStatus: (*imageStatus)(s)}
+	if err := json.Unmarshal(b, aux); err != nil {
+		return err
+	}
+	watchers, err := parseWatchers(aux.Watchers)
+	if err != nil {
+		return err
+	}
+	s.Watchers = watchers
+	return nil
+}
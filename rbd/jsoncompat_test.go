@@ -0,0 +1,221 @@
+package rbd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("error reading fixture: %v", err)
+	}
+	return b
+}
+
+func TestFlexBool(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    bool
+		wantErr bool
+	}{
+		{`true`, true, false},
+		{`false`, false, false},
+		{`"true"`, true, false},
+		{`"false"`, false, false},
+		{`null`, false, false},
+		{`""`, false, false},
+		{`"yes"`, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			var v flexBool
+			err := json.Unmarshal([]byte(tt.in), &v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal(%s) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if bool(v) != tt.want {
+				t.Errorf("Unmarshal(%s) = %v, want %v", tt.in, v, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlexInt(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{`4123`, 4123, false},
+		{`"4123"`, 4123, false},
+		{`-1`, -1, false},
+		{`null`, 0, false},
+		{`""`, 0, false},
+		{`"client"`, 0, true},
+		{`1.5`, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			var v flexInt
+			err := json.Unmarshal([]byte(tt.in), &v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal(%s) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if int64(v) != tt.want {
+				t.Errorf("Unmarshal(%s) = %v, want %v", tt.in, v, tt.want)
+			}
+		})
+	}
+}
+
+func TestDevInfoUnmarshal(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		size      Size
+		features  int
+		created   string
+		protected bool
+		fastDiff  bool
+	}{
+		{"info_jewel.json", 1073741824, 5, "", false, true},
+		{"info_luminous.json", 10737418240, 5, "Tue Mar 12 10:15:26 2019", false, false},
+		{"info_nautilus.json", 10737418240, 5, "Wed Jan 15 08:02:11 2020", false, true},
+		{"info_pacific_snap.json", 10737418240, 5, "Mon Aug  2 14:30:00 2021", true, true},
+		{"info_reef_snap.json", 21474836480, 5, time.Unix(1691583000, 0).Format(time.ANSIC), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			info := &DevInfo{}
+			if err := json.Unmarshal(readFixture(t, tt.fixture), info); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if info.Name != "vol1" || info.Size != tt.size || info.Format != 2 || len(info.Features) != tt.features {
+				t.Errorf("Unmarshal() = %+v", info)
+			}
+			created := ""
+			if ts := time.Time(info.CreateTimestamp); !ts.IsZero() {
+				created = ts.Format(time.ANSIC)
+			}
+			if created != tt.created {
+				t.Errorf("CreateTimestamp = %q, want %q", created, tt.created)
+			}
+			if info.Protected != tt.protected {
+				t.Errorf("Protected = %v, want %v", info.Protected, tt.protected)
+			}
+			if info.hasFastDiff() != tt.fastDiff {
+				t.Errorf("hasFastDiff() = %v, want %v", info.hasFastDiff(), tt.fastDiff)
+			}
+		})
+	}
+}
+
+func TestCreateTimestampEpoch(t *testing.T) {
+	var ts CreateTimestamp
+	if err := json.Unmarshal([]byte(`1691583000`), &ts); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if got := time.Time(ts).Unix(); got != 1691583000 {
+		t.Errorf("Unmarshal() = %v, want 1691583000", got)
+	}
+	if err := json.Unmarshal([]byte(`"not a time"`), &ts); err == nil {
+		t.Error("Unmarshal(\"not a time\") error = nil, want an error")
+	}
+}
+
+func TestWatcherUnmarshal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Watcher
+	}{
+		{`{"address":"10.0.0.1:0/1234567","client":4123,"cookie":1}`, Watcher{"10.0.0.1:0/1234567", 4123, 1}},
+		{`{"address":"10.0.0.1:0/1234567","client":"4123","cookie":"1"}`, Watcher{"10.0.0.1:0/1234567", 4123, 1}},
+		{`{"address":"10.0.0.1:0/1234567","client":"client.4123","cookie":"140234987520000"}`, Watcher{"10.0.0.1:0/1234567", 4123, 140234987520000}},
+		{`{"address":"10.0.0.1:0/1234567","client":24152,"cookie":18446462598732840961}`, Watcher{"10.0.0.1:0/1234567", 24152, 18446462598732840961}},
+		{`{"address":"10.0.0.1:0/1234567"}`, Watcher{Address: "10.0.0.1:0/1234567"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			w := Watcher{}
+			if err := json.Unmarshal([]byte(tt.in), &w); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if w != tt.want {
+				t.Errorf("Unmarshal() = %+v, want %+v", w, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWatchers(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []Watcher
+		wantErr bool
+	}{
+		{"empty", ``, []Watcher{}, false},
+		{"null", `null`, []Watcher{}, false},
+		{"empty list", `[]`, []Watcher{}, false},
+		{"list", `[{"address":"a","client":1,"cookie":2},{"address":"b","client":3,"cookie":4}]`,
+			[]Watcher{{"a", 1, 2}, {"b", 3, 4}}, false},
+		{"repeated keys", `{"watcher":{"address":"a","client":1,"cookie":2},"watcher":{"address":"b","client":3,"cookie":4}}`,
+			[]Watcher{{"a", 1, 2}, {"b", 3, 4}}, false},
+		{"empty object", `{}`, []Watcher{}, false},
+		{"not watchers", `"none"`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			watchers, err := parseWatchers([]byte(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseWatchers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := []Watcher{}
+			for _, w := range watchers {
+				got = append(got, *w)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseWatchers() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageStatusUnmarshal(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		want      []Watcher
+		migration bool
+	}{
+		{"status_jewel.json", []Watcher{{"10.0.0.1:0/1234567", 4123, 1}, {"10.0.0.2:0/7654321", 4456, 2}}, false},
+		{"status_luminous.json", []Watcher{{"10.0.0.1:0/2563571406", 14151, 140234987520000}}, false},
+		{"status_quincy.json", []Watcher{{"192.168.1.2:0/3352580467", 24152, 18446462598732840961}}, true},
+		{"status_none.json", []Watcher{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			status := &ImageStatus{}
+			if err := json.Unmarshal(readFixture(t, tt.fixture), status); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			got := []Watcher{}
+			for _, w := range status.Watchers {
+				got = append(got, *w)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Watchers = %+v, want %+v", got, tt.want)
+			}
+			if (status.Migration != nil) != tt.migration {
+				t.Errorf("Migration = %+v, want set %v", status.Migration, tt.migration)
+			}
+		})
+	}
+}
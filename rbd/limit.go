@@ -0,0 +1,113 @@
+package rbd
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCmdLimit is the default maximum number of concurrent rbd processes
+const DefaultCmdLimit = 8
+
+var cmdSemMutex = &sync.RWMutex{}
+var cmdSem = make(chan struct{}, DefaultCmdLimit)
+
+// SetCmdLimit sets the maximum number of rbd processes that may run concurrently.
+// Commands beyond the limit queue until a slot frees up. Use 0 for no limit.
+func SetCmdLimit(n int) {
+	cmdSemMutex.Lock()
+	defer cmdSemMutex.Unlock()
+	if n <= 0 {
+		cmdSem = nil
+		return
+	}
+	cmdSem = make(chan struct{}, n)
+}
+
+// CmdStat contains counters for a single rbd operation
+type CmdStat struct {
+	Count  int64
+	Errors int64
+	// Retries is the number of times the operation was run again under the retry policy
+	Retries  int64
+	Queued   time.Duration
+	Duration time.Duration
+}
+
+var cmdStatsMutex = &sync.Mutex{}
+var cmdStats = make(map[string]*CmdStat)
+
+// CmdStats returns a snapshot of the counters for each rbd operation, keyed by operation (eg: "device map")
+func CmdStats() map[string]CmdStat {
+	cmdStatsMutex.Lock()
+	defer cmdStatsMutex.Unlock()
+	r := make(map[string]CmdStat, len(cmdStats))
+	for op, s := range cmdStats {
+		r[op] = *s
+	}
+	return r
+}
+
+func recordCmd(op string, queued, duration time.Duration, err error) {
+	cmdStatsMutex.Lock()
+	defer cmdStatsMutex.Unlock()
+	s := cmdStats[op]
+	if s == nil {
+		s = &CmdStat{}
+		cmdStats[op] = s
+	}
+	s.Count++
+	if err != nil {
+		s.Errors++
+	}
+	s.Queued += queued
+	s.Duration += duration
+}
+
+func recordRetry(op string) {
+	cmdStatsMutex.Lock()
+	defer cmdStatsMutex.Unlock()
+	s := cmdStats[op]
+	if s == nil {
+		s = &CmdStat{}
+		cmdStats[op] = s
+	}
+	s.Retries++
+}
+
+// cmdOpName finds the rbd operation in args. All flags before the operation are
+// prepended by cmdArgs and cmdJSON and take a value, so they are skipped in pairs.
+func cmdOpName(args []string) string {
+	i := 0
+	for i < len(args) && strings.HasPrefix(args[i], "-") {
+		i += 2
+	}
+	op := []string{}
+	for ; i < len(args) && len(op) < 2 && !strings.HasPrefix(args[i], "-"); i++ {
+		op = append(op, args[i])
+	}
+	if len(op) == 0 {
+		return "unknown"
+	}
+	return strings.Join(op, " ")
+}
+
+// cmdAcquire waits for a free command slot. The returned function must be called
+// with the commands result when it is finished to release the slot and record stats.
+func cmdAcquire(args []string) func(error) {
+	op := cmdOpName(args)
+	start := time.Now()
+	cmdSemMutex.RLock()
+	sem := cmdSem
+	cmdSemMutex.RUnlock()
+	if sem != nil {
+		sem <- struct{}{}
+	}
+	queued := time.Since(start)
+	return func(err error) {
+		if sem != nil {
+			<-sem
+		}
+		recordCmd(op, queued, time.Since(start)-queued, err)
+	}
+}
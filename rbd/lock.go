@@ -0,0 +1,109 @@
+package rbd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LockInfo is an advisory lock on an image
+type LockInfo struct {
+	// ID is the lock id given when the lock was taken
+	ID string `json:"id"`
+	// Locker is the client holding the lock, eg: client.4123
+	Locker string `json:"locker"`
+	// Address is the address of the client holding the lock
+	Address string `json:"address"`
+	// Tag is set on shared locks
+	Tag string `json:"tag,omitempty"`
+}
+
+// lockListWrapper is the lock list json of releases which wrap the locks in an object with the tag of shared locks
+type lockListWrapper struct {
+	Locks json.RawMessage `json:"locks"`
+	Tag   string          `json:"tag"`
+}
+
+// parseLockList parses rbd lock list json. Depending on the release this is a list of locks,
+// a map of locks keyed by lock id, or either of those wrapped in an object with the shared lock tag.
+func parseLockList(out string) ([]*LockInfo, error) {
+	if strings.TrimSpace(out) == "" {
+		return []*LockInfo{}, nil
+	}
+	locks, err := parseLocks([]byte(out))
+	if err == nil {
+		return locks, nil
+	}
+	w := &lockListWrapper{}
+	if wErr := json.Unmarshal([]byte(out), w); wErr != nil || w.Locks == nil {
+		return nil, fmt.Errorf("error parsing lock list: %w", err)
+	}
+	if locks, err = parseLocks(w.Locks); err != nil {
+		return nil, fmt.Errorf("error parsing lock list: %w", err)
+	}
+	for _, l := range locks {
+		if l.Tag == "" {
+			l.Tag = w.Tag
+		}
+	}
+	return locks, nil
+}
+
+// parseLocks parses a list of locks, or a map of locks keyed by lock id
+func parseLocks(b []byte) ([]*LockInfo, error) {
+	locks := []*LockInfo{}
+	if err := json.Unmarshal(b, &locks); err == nil {
+		return locks, nil
+	}
+	lockMap := make(map[string]*LockInfo)
+	if err := json.Unmarshal(b, &lockMap); err != nil {
+		return nil, err
+	}
+	for id, l := range lockMap {
+		if l == nil || (l.Locker == "" && l.Address == "") {
+			return nil, fmt.Errorf("lock %v has no locker", id)
+		}
+		if l.ID == "" {
+			l.ID = id
+		}
+		locks = append(locks, l)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].ID < locks[j].ID })
+	return locks, nil
+}
+
+// ListLocks returns the advisory locks on the image
+func (img *Image) ListLocks() ([]*LockInfo, error) {
+	out, err := cmdOut(img.context(), imageErrs, img.cmdArgs("lock", "list", "--format", "json")...)
+	if err != nil {
+		return nil, wrapErr(err, "error listing locks on %v", img.FullName())
+	}
+	return parseLockList(out)
+}
+
+// BreakLock removes a lock held by any client. The client is not stopped from writing,
+// so it should be blocklisted with BlocklistClient first if it may still be running.
+func (img *Image) BreakLock(l *LockInfo) error {
+	return wrapErr(cmdRun(img.context(), imageErrs, img.cmdArgs("lock", "remove", l.ID, l.Locker)...), "error removing lock %v held by %v on %v", l.ID, l.Locker, img.FullName())
+}
+
+// BlocklistClient stops the client at addr from accessing the cluster for expire, or the cluster default if expire is 0.
+// Requires the ceph binary.
+func BlocklistClient(addr string, expire time.Duration) error {
+	args := []string{"add", addr}
+	if expire > 0 {
+		args = append(args, strconv.Itoa(int(expire.Seconds())))
+	}
+	err := cephRun(context.Background(), DefaultCluster(), nil, append([]string{"osd", "blocklist"}, args...)...)
+	var cmdErr *CmdError
+	if errors.As(err, &cmdErr) && cmdErr.ExitCode == 22 {
+		// releases before pacific call it a blacklist
+		err = cephRun(context.Background(), DefaultCluster(), nil, append([]string{"osd", "blacklist"}, args...)...)
+	}
+	return wrapErr(err, "error blocklisting %v", addr)
+}
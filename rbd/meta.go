@@ -0,0 +1,24 @@
+package rbd
+
+// SetMeta sets an image metadata key
+func (img *Image) SetMeta(key, value string) error {
+	return wrapErr(cmdRun(img.context(), imageErrs, img.cmdArgs("image-meta", "set", key, value)...), "error setting %v on %v", key, img.FullName())
+}
+
+// GetMeta gets an image metadata key, returning ErrDoesNotExist if it is not set
+func (img *Image) GetMeta(key string) (string, error) {
+	out, err := cmdOut(img.context(), imageErrs, img.cmdArgs("image-meta", "get", key)...)
+	return out, wrapErr(err, "error getting %v on %v", key, img.FullName())
+}
+
+// ListMeta returns all image metadata
+func (img *Image) ListMeta() (map[string]string, error) {
+	meta := make(map[string]string)
+	err := cmdJSON(img.context(), &meta, imageErrs, img.cmdArgs("image-meta", "list")...)
+	return meta, wrapErr(err, "error listing metadata on %v", img.FullName())
+}
+
+// RemoveMeta removes an image metadata key, returning ErrDoesNotExist if it is not set
+func (img *Image) RemoveMeta(key string) error {
+	return wrapErr(cmdRun(img.context(), imageErrs, img.cmdArgs("image-meta", "remove", key)...), "error removing %v from %v", key, img.FullName())
+}
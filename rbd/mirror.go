@@ -0,0 +1,114 @@
+package rbd
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Image mirroring modes
+const (
+	MirrorModeJournal  = "journal"
+	MirrorModeSnapshot = "snapshot"
+)
+
+// Pool mirroring modes, in image mode each image must have mirroring enabled
+const (
+	MirrorPoolModeImage = "image"
+	MirrorPoolModePool  = "pool"
+)
+
+// ImageMirrorStatus is the mirroring status of an image
+type ImageMirrorStatus struct {
+	Name        string `json:"name"`
+	GlobalID    string `json:"global_id"`
+	State       string `json:"state"`
+	Description string `json:"description"`
+	LastUpdate  string `json:"last_update"`
+}
+
+// MirrorInfo is the mirroring configuration of an image, from rbd info
+type MirrorInfo struct {
+	Mode     string `json:"mode"`
+	State    string `json:"state"`
+	GlobalID string `json:"global_id"`
+	Primary  bool   `json:"primary"`
+}
+
+// PoolMirrorStatus is the mirroring status of a pool
+type PoolMirrorStatus struct {
+	Summary struct {
+		Health       string         `json:"health"`
+		DaemonHealth string         `json:"daemon_health"`
+		ImageHealth  string         `json:"image_health"`
+		States       map[string]int `json:"states"`
+	} `json:"summary"`
+}
+
+// EnableMirroring enables mirroring of the image in mode, the pool must be in image mode.
+// Journal mode enables the journaling feature on the image if necessary.
+func (img *Image) EnableMirroring(mode string) error {
+	defer InvalidateInfo(img)
+	switch mode {
+	case MirrorModeJournal:
+		if err := img.EnableFeatures(FeatureJournaling); err != nil && !errors.Is(err, ErrFeatureAlreadyEnabled) {
+			return err
+		}
+	case MirrorModeSnapshot:
+	default:
+		return fmt.Errorf("unknown mirror mode %v", mode)
+	}
+	return wrapErr(cmdRun(img.context(), imageErrs, img.cmdArgs("mirror", "image", "enable", mode)...), "error enabling mirroring on %v", img.FullName())
+}
+
+// DisableMirroring disables mirroring of the image. force is needed to disable mirroring on a non-primary image.
+func (img *Image) DisableMirroring(force bool) error {
+	defer InvalidateInfo(img)
+	args := []string{"mirror", "image", "disable"}
+	if force {
+		args = append(args, "--force")
+	}
+	return wrapErr(cmdRun(img.context(), imageErrs, img.cmdArgs(args...)...), "error disabling mirroring on %v", img.FullName())
+}
+
+// Promote makes the image primary, so it can be written. force promotes it even if the peer is still primary.
+func (img *Image) Promote(force bool) error {
+	defer InvalidateInfo(img)
+	args := []string{"mirror", "image", "promote"}
+	if force {
+		args = append(args, "--force")
+	}
+	return wrapErr(cmdRun(img.context(), imageErrs, img.cmdArgs(args...)...), "error promoting %v", img.FullName())
+}
+
+// Demote makes the image non-primary, so the peer can be promoted
+func (img *Image) Demote() error {
+	defer InvalidateInfo(img)
+	return wrapErr(cmdRun(img.context(), imageErrs, img.cmdArgs("mirror", "image", "demote")...), "error demoting %v", img.FullName())
+}
+
+// MirrorStatus returns the mirroring status of the image
+func (img *Image) MirrorStatus() (*ImageMirrorStatus, error) {
+	status := &ImageMirrorStatus{}
+	err := cmdJSON(img.context(), status, imageErrs, img.cmdArgs("mirror", "image", "status")...)
+	return status, wrapErr(err, "error getting mirror status of %v", img.FullName())
+}
+
+// EnableMirroring enables mirroring on the pool in image or pool mode
+func (pool *Pool) EnableMirroring(mode string) error {
+	if mode != MirrorPoolModeImage && mode != MirrorPoolModePool {
+		return fmt.Errorf("unknown pool mirror mode %v", mode)
+	}
+	return wrapErr(cmdRun(pool.context(), poolErrs, pool.cluster.cmdArgs("mirror", "pool", "enable", pool.Name(), mode)...), "error enabling mirroring on %v", pool.Name())
+}
+
+// DisableMirroring disables mirroring on the pool
+func (pool *Pool) DisableMirroring() error {
+	return wrapErr(cmdRun(pool.context(), poolErrs, pool.cluster.cmdArgs("mirror", "pool", "disable", pool.Name())...), "error disabling mirroring on %v", pool.Name())
+}
+
+// MirrorStatus returns the mirroring status of the pool
+func (pool *Pool) MirrorStatus() (*PoolMirrorStatus, error) {
+	status := &PoolMirrorStatus{}
+	err := cmdJSON(pool.context(), status, poolErrs, pool.cluster.cmdArgs("mirror", "pool", "status", pool.Name())...)
+	return status, wrapErr(err, "error getting mirror status of %v", pool.Name())
+}
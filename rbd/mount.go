@@ -2,10 +2,12 @@ package rbd
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -42,10 +44,47 @@ type optionalField struct {
 // ErrMountedElsewhere is returned when attempting to unmap a device that is still mounted
 var ErrMountedElsewhere = errors.New("device is still mounted in another location")
 
+// BindsSubdirectory returns true if the mount is a bind mount of a subdirectory of a filesystem,
+// rather than the root of the filesystem
+func (m *MountInfo) BindsSubdirectory() bool {
+	return m.Root != "/"
+}
+
+// ListMounts returns every mount in this process's mount namespace
+func ListMounts() ([]*MountInfo, error) {
+	return getMounts("")
+}
+
+// MountsForDevice returns every mount of the filesystem on blk, including bind mounts of its subdirectories.
+// Mounts are matched by device number as well as source, so they are found however blk was named when mounted.
+func MountsForDevice(blk string) ([]*MountInfo, error) {
+	return getMounts(blk)
+}
+
+// MountsUnder returns the mounts at or beneath path
+func MountsUnder(path string) ([]*MountInfo, error) {
+	return getMountInfoFromFile("/proc/self/mountinfo", func(m *MountInfo) bool {
+		return IsUnder(m.MountPoint, path)
+	})
+}
+
 func getMounts(blk string) ([]*MountInfo, error) {
 	return getMountInfoForDevFromFile("/proc/self/mountinfo", blk)
 }
 
+// primaryMount returns the mount of the root of the filesystem if there is one, otherwise the first mount
+func primaryMount(mounts []*MountInfo) *MountInfo {
+	for _, m := range mounts {
+		if !m.BindsSubdirectory() {
+			return m
+		}
+	}
+	if len(mounts) > 0 {
+		return mounts[0]
+	}
+	return nil
+}
+
 // Use empty string for blk to get anything mounted here
 func isMountedAt(blk, mountPoint string) (bool, error) {
 	mounts, err := getMounts(blk)
@@ -60,15 +99,10 @@ func isMountedAt(blk, mountPoint string) (bool, error) {
 	return false, nil
 }
 
-func getFs(blk string) (string, error) {
-	out, err := exec.Command("blkid", "-c", "/dev/null", "-p", "-s", "TYPE", "-o", "value", blk).Output()
-	if err != nil {
-		if exitErr, isExitErr := err.(*exec.ExitError); isExitErr {
-			return "", fmt.Errorf("error determining filesystem on %v: %v: %w", blk, string(exitErr.Stderr), err)
-		}
-		return "", fmt.Errorf("error determining filesystem on %v: %w", blk, err)
-	}
-	return strings.TrimSpace(string(out)), nil
+// IsUnder returns true if path is dir or is inside dir
+func IsUnder(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
 }
 
 func mount(blk, mountPoint, fs string, flags uintptr, data string) error {
@@ -84,6 +118,10 @@ func mount(blk, mountPoint, fs string, flags uintptr, data string) error {
 		}
 	}
 
+	if data == "" {
+		data = GetFileSystemProfile(fs).MountData
+	}
+
 	if err := os.MkdirAll(mountPoint, 0755); err != nil {
 		return fmt.Errorf("error creating directory: %v: %w", mountPoint, err)
 	}
@@ -106,102 +144,175 @@ func unmount(blk, mountPoint string) error {
 	return err
 }
 
-func mkfs(blk, fs string) error {
-	return exec.Command("mkfs."+fs, blk).Run()
+// CleanupMountPoint detaches anything still mounted at mountPoint, such as a filesystem
+// whose device has disappeared, and removes the mountpoint directory
+func CleanupMountPoint(mountPoint string) error {
+	mounted, err := isMountedAt("", mountPoint)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		if err = syscall.Unmount(mountPoint, syscall.MNT_DETACH); err != nil {
+			return fmt.Errorf("error detaching %v: %w", mountPoint, err)
+		}
+	}
+	if err = os.Remove(mountPoint); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing mountpoint %v: %w", mountPoint, err)
+	}
+	return nil
 }
 
-func isMountedElsewhere(blk, mountpoint string) error {
-	myNs, err := os.Readlink("/proc/self/ns/mnt")
+// DeadMount is an nbd device that is still mounted after its rbd-nbd process exited
+type DeadMount struct {
+	Device     string
+	MountPoint string
+}
+
+// DeadMountsUnder returns the nbd devices mounted at or beneath dir which are no longer mapped
+func DeadMountsUnder(dir string) ([]*DeadMount, error) {
+	mapped, err := mappedDevices()
 	if err != nil {
-		return fmt.Errorf("error determining my mnt namespace: %w", err)
+		return nil, err
 	}
-
-	myMounts, err := getMounts(blk)
+	alive := make(map[string]struct{}, len(mapped))
+	for _, m := range mapped {
+		alive[m.Device] = struct{}{}
+	}
+	mounts, err := MountsUnder(dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, m := range myMounts {
-		if m.MountPoint != mountpoint {
-			return fmt.Errorf("%v is mounted at %v: %w", blk, m.MountPoint, ErrMountedElsewhere)
+	dead := []*DeadMount{}
+	for _, m := range mounts {
+		if !strings.HasPrefix(m.Source, "/dev/nbd") {
+			continue
+		}
+		if _, ok := alive[m.Source]; !ok {
+			dead = append(dead, &DeadMount{Device: m.Source, MountPoint: m.MountPoint})
 		}
 	}
-	var myMount *MountInfo
-	if len(myMounts) > 0 {
-		myMount = myMounts[0]
+	return dead, nil
+}
+
+func mkfs(blk, fs string, extraArgs ...string) error {
+	args := append(append(append([]string{}, GetFileSystemProfile(fs).MkfsArgs...), extraArgs...), blk)
+	out := &bytes.Buffer{}
+	if err := executor.Run(context.Background(), nil, out, out, "mkfs."+fs, args...); err != nil {
+		return fmt.Errorf("error running mkfs.%v %v: %v: %w", fs, args, strings.TrimSpace(out.String()), err)
 	}
+	return nil
+}
 
-	namespaces := map[string]struct{}{myNs: struct{}{}}
-	proc, err := os.Open("/proc")
+// isMountedElsewhere returns ErrMountedElsewhere if blk is mounted anywhere but mountpoint, scan may be nil
+func isMountedElsewhere(blk, mountpoint string, scan *MountScan) error {
+	myNs, err := os.Readlink("/proc/self/ns/mnt")
 	if err != nil {
-		return err
+		return fmt.Errorf("error determining my mnt namespace: %w", err)
 	}
-	defer proc.Close()
-	procDirs, err := proc.Readdir(0)
+
+	nsMounts, err := scanNamespaceMounts(blk, scan)
 	if err != nil {
 		return err
 	}
-	for _, procDir := range procDirs {
-		if !procDir.IsDir() {
-			continue
+	var myMounts []*MountInfo
+	for _, nm := range nsMounts {
+		if nm.Namespace == myNs {
+			myMounts = append(myMounts, nm.Mount)
 		}
-		pid, err := strconv.Atoi(procDir.Name())
-		if err != nil {
-			continue
-		}
-		ns, err := os.Readlink("/proc/" + procDir.Name() + "/ns/mnt")
-		if err != nil {
-			// process could have ended, don't worry about it
-			continue
-		}
-		if _, ok := namespaces[ns]; ok {
-			continue
+	}
+	for _, m := range myMounts {
+		if m.MountPoint != mountpoint {
+			if m.BindsSubdirectory() {
+				return fmt.Errorf("%v is bind mounted from %v at %v: %w", blk, m.Root, m.MountPoint, ErrMountedElsewhere)
+			}
+			return fmt.Errorf("%v is mounted at %v: %w", blk, m.MountPoint, ErrMountedElsewhere)
 		}
-		pidMounts, err := getMountInfoForDevFromFile("/proc/"+procDir.Name()+"/mountinfo", blk)
-		if err != nil {
-			// process could have ended, don't worry about it
+	}
+	myMount := primaryMount(myMounts)
+
+	for _, nm := range nsMounts {
+		if nm.Namespace == myNs {
 			continue
 		}
-		for _, m := range pidMounts {
-			if myMount != nil {
-				if m.Parent.Shared != 0 && m.Parent.Shared == myMount.Parent.Shared {
-					// mounts are in the same peer group
-					continue
-				}
-				if m.Parent.Master != 0 && m.Parent.Master == myMount.Parent.Shared {
-					// mount will recieve events from me when I unmount
-					continue
-				}
+		m := nm.Mount
+		// a copy of my mount propagated to this namespace has the same root, a bind mount of a
+		// subdirectory does not and always holds the filesystem open
+		if myMount != nil && m.Root == myMount.Root && m.Parent != nil && myMount.Parent != nil {
+			if m.Parent.Shared != 0 && m.Parent.Shared == myMount.Parent.Shared {
+				// mounts are in the same peer group
+				continue
+			}
+			if m.Parent.Master != 0 && m.Parent.Master == myMount.Parent.Shared {
+				// mount will recieve events from me when I unmount
+				continue
 			}
-			return fmt.Errorf("%v is mounted at %v in pid %v ns %v with pg shared:%v master:%v: %w", blk, m.MountPoint, pid, ns, m.Shared, m.Master, ErrMountedElsewhere)
 		}
-		namespaces[ns] = struct{}{}
+		return fmt.Errorf("%v is mounted at %v in pid %v ns %v with pg shared:%v master:%v: %w", blk, m.MountPoint, nm.Pid, nm.Namespace, m.Shared, m.Master, ErrMountedElsewhere)
 	}
 	return nil
 }
 
+// getMountInfoForDevFromFile returns the mounts of blk from a mountinfo file, or every mount if blk is empty
 func getMountInfoForDevFromFile(MountInfoFile, blk string) ([]*MountInfo, error) {
+	if blk == "" {
+		return getMountInfoFromFile(MountInfoFile, nil)
+	}
+	match, err := deviceMatcher(blk)
+	if err != nil {
+		return nil, err
+	}
+	return getMountInfoFromFile(MountInfoFile, match)
+}
+
+// deviceMatcher matches mounts of blk by source, or by device number for mounts made through another
+// name for the device. Bind mounts keep the source and device number of the filesystem they bind.
+func deviceMatcher(blk string) (func(*MountInfo) bool, error) {
+	var dev *stDev
+	fi, err := os.Stat(blk)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error getting device number of %v: %w", blk, err)
+	}
+	if err == nil && fi.Mode()&os.ModeDevice != 0 {
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			rdev := uint64(st.Rdev) //nolint: unconvert
+			dev = &stDev{
+				major: int((rdev>>8)&0xfff | (rdev>>32)&^0xfff),
+				minor: int(rdev&0xff | (rdev>>12)&^0xff),
+			}
+		}
+	}
+	return func(m *MountInfo) bool {
+		return m.Source == blk || (dev != nil && m.StDev == *dev)
+	}, nil
+}
+
+// getMountInfoFromFile returns the mounts from a mountinfo file for which match returns true, or every mount if match is nil
+func getMountInfoFromFile(MountInfoFile string, match func(*MountInfo) bool) ([]*MountInfo, error) {
 	file, err := os.Open(MountInfoFile)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 	mounts := []*MountInfo{}
-	otherMounts := make(map[int]*MountInfo)
+	allMounts := make(map[int]*MountInfo)
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		m, err := parseMountinfoLine(scanner.Text())
 		if err != nil {
 			return mounts, err
 		}
-		if m.Source == blk || blk == "" {
+		if match == nil || match(m) {
 			mounts = append(mounts, m)
-		} else {
-			otherMounts[m.ID] = m
 		}
+		allMounts[m.ID] = m
 	}
 	for _, m := range mounts {
-		parent, ok := otherMounts[m.ParentID]
+		parent, ok := allMounts[m.ParentID]
 		if !ok {
+			if match == nil {
+				// the root mount's parent is outside of this namespace
+				continue
+			}
 			return mounts, fmt.Errorf("parent mount not found")
 		}
 		m.Parent = parent
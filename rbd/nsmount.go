@@ -0,0 +1,145 @@
+package rbd
+
+import (
+	"os"
+	"strconv"
+	"sync"
+)
+
+// NamespaceMount is a mount of a device in a mount namespace on the host
+type NamespaceMount struct {
+	// Namespace identifies the mount namespace, eg: mnt:[4026531840]
+	Namespace string
+	// Pid is a process in the namespace
+	Pid   int
+	Mount *MountInfo
+}
+
+// mountScanWorkers is the number of mountinfo files read at once
+const mountScanWorkers = 8
+
+// nsMounts is every mount in a mount namespace
+type nsMounts struct {
+	ns     string
+	pid    int
+	mounts []*MountInfo
+}
+
+// MountScan caches the mounts of other mount namespaces, so the mounted elsewhere checks of the unmounts it is
+// passed to, eg: during a reap, share one scan of /proc. This process's own mounts are always read fresh.
+// A nil MountScan caches nothing.
+type MountScan struct {
+	mu sync.Mutex
+	// others is the mounts of every namespace except this process's, read on first use
+	others []*nsMounts
+}
+
+// NewMountScan returns an empty MountScan
+func NewMountScan() *MountScan {
+	return &MountScan{}
+}
+
+// ScanNamespaceMounts returns the mounts of blk in every mount namespace on the host, including this process's.
+// Each namespace is read through the first process found in it.
+func ScanNamespaceMounts(blk string) ([]*NamespaceMount, error) {
+	return scanNamespaceMounts(blk, nil)
+}
+
+func scanNamespaceMounts(blk string, scan *MountScan) ([]*NamespaceMount, error) {
+	match, err := deviceMatcher(blk)
+	if err != nil {
+		return nil, err
+	}
+	myNs, err := os.Readlink("/proc/self/ns/mnt")
+	if err != nil {
+		return nil, err
+	}
+	mine, err := getMountInfoFromFile("/proc/self/mountinfo", nil)
+	if err != nil {
+		return nil, err
+	}
+	others, err := scan.otherNamespaceMounts(myNs)
+	if err != nil {
+		return nil, err
+	}
+
+	r := []*NamespaceMount{}
+	for _, nm := range append([]*nsMounts{{ns: myNs, pid: os.Getpid(), mounts: mine}}, others...) {
+		for _, m := range nm.mounts {
+			if match(m) {
+				r = append(r, &NamespaceMount{Namespace: nm.ns, Pid: nm.pid, Mount: m})
+			}
+		}
+	}
+	return r, nil
+}
+
+// otherNamespaceMounts returns the mounts of every namespace except myNs, reading them on first use
+func (scan *MountScan) otherNamespaceMounts(myNs string) ([]*nsMounts, error) {
+	if scan == nil {
+		return readNamespaceMounts(myNs)
+	}
+	scan.mu.Lock()
+	defer scan.mu.Unlock()
+	if scan.others != nil {
+		return scan.others, nil
+	}
+	others, err := readNamespaceMounts(myNs)
+	if err != nil {
+		return nil, err
+	}
+	scan.others = others
+	return others, nil
+}
+
+// readNamespaceMounts finds one process in every mount namespace except skipNs, then reads their mountinfo in parallel
+func readNamespaceMounts(skipNs string) ([]*nsMounts, error) {
+	proc, err := os.Open("/proc")
+	if err != nil {
+		return nil, err
+	}
+	defer proc.Close()
+	procDirs, err := proc.Readdirnames(0)
+	if err != nil {
+		return nil, err
+	}
+
+	// reading the namespace link is much cheaper than reading mountinfo, so dedupe first
+	seen := map[string]struct{}{skipNs: {}}
+	namespaces := []*nsMounts{}
+	for _, name := range procDirs {
+		pid, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		ns, err := os.Readlink("/proc/" + name + "/ns/mnt")
+		if err != nil {
+			// process could have ended, don't worry about it
+			continue
+		}
+		if _, ok := seen[ns]; ok {
+			continue
+		}
+		seen[ns] = struct{}{}
+		namespaces = append(namespaces, &nsMounts{ns: ns, pid: pid})
+	}
+
+	work := make(chan *nsMounts)
+	var wg sync.WaitGroup
+	for i := 0; i < mountScanWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for nm := range work {
+				// process could have ended, leaving the namespace without mounts, don't worry about it
+				nm.mounts, _ = getMountInfoFromFile("/proc/"+strconv.Itoa(nm.pid)+"/mountinfo", nil)
+			}
+		}()
+	}
+	for _, nm := range namespaces {
+		work <- nm
+	}
+	close(work)
+	wg.Wait()
+	return namespaces, nil
+}
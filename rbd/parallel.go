@@ -0,0 +1,66 @@
+package rbd
+
+import "sync"
+
+// DefaultParallelism is the number of devices InfoAll and DiskUsageAll work on at once when parallelism is 0.
+// The commands they run are also subject to the command limit.
+const DefaultParallelism = DefaultCmdLimit
+
+// InfoResult is the info of one device from InfoAll
+type InfoResult struct {
+	Dev  Dev
+	Info *DevInfo
+	Err  error
+}
+
+// DiskUsageResult is the usage of one image from DiskUsageAll
+type DiskUsageResult struct {
+	Image *Image
+	Usage *DiskUsage
+	Err   error
+}
+
+// eachParallel calls f with 0 through n-1, running up to parallelism calls at once
+func eachParallel(n, parallelism int, f func(i int)) {
+	if parallelism <= 0 {
+		parallelism = DefaultParallelism
+	}
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+}
+
+// InfoAll gets the info of every device, working on up to parallelism devices at once.
+// The results are in the order of devs, a device which failed has Err set.
+func InfoAll(devs []Dev, parallelism int) []*InfoResult {
+	r := make([]*InfoResult, len(devs))
+	eachParallel(len(devs), parallelism, func(i int) {
+		info, err := devs[i].Info()
+		r[i] = &InfoResult{Dev: devs[i], Info: info, Err: err}
+	})
+	return r
+}
+
+// DiskUsageAll gets the usage of every image with Image.DiskUsage, working on up to parallelism images at once.
+// The results are in the order of imgs, an image which failed has Err set.
+func DiskUsageAll(imgs []*Image, parallelism int) []*DiskUsageResult {
+	r := make([]*DiskUsageResult, len(imgs))
+	eachParallel(len(imgs), parallelism, func(i int) {
+		du, err := imgs[i].DiskUsage()
+		r[i] = &DiskUsageResult{Image: imgs[i], Usage: du, Err: err}
+	})
+	return r
+}
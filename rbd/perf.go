@@ -0,0 +1,97 @@
+package rbd
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrPerfUnavailable is returned when the rbd_support manager module can not report performance stats
+var ErrPerfUnavailable = errors.New("rbd perf stats unavailable")
+
+// ImagePerf is the i/o of an image by every client over the sampling period, from rbd perf image iostat
+type ImagePerf struct {
+	Pool      string
+	Namespace string
+	Image     string
+	// ReadOps and WriteOps are operations per second
+	ReadOps  float64
+	WriteOps float64
+	// ReadBytes and WriteBytes are bytes per second
+	ReadBytes  float64
+	WriteBytes float64
+	// ReadLatency and WriteLatency are the mean latency of an operation
+	ReadLatency  time.Duration
+	WriteLatency time.Duration
+}
+
+// imagePerfEntry is an image in rbd perf image iostat json
+type imagePerfEntry struct {
+	Pool          string      `json:"pool"`
+	PoolNamespace string      `json:"pool_namespace"`
+	Image         string      `json:"image"`
+	Rd            json.Number `json:"rd"`
+	RdBytes       json.Number `json:"rd_bytes"`
+	RdLatency     json.Number `json:"rd_latency"`
+	Wr            json.Number `json:"wr"`
+	WrBytes       json.Number `json:"wr_bytes"`
+	WrLatency     json.Number `json:"wr_latency"`
+}
+
+// jsonFloat converts a json number to a float64, or returns 0
+func jsonFloat(n json.Number) float64 {
+	f, _ := n.Float64()
+	return f
+}
+
+var perfErrs = exitCodeToErrMap(map[int]error{
+	2: ErrDoesNotExist,
+	// the rbd_support module is disabled, or still warming up
+	95: ErrPerfUnavailable,
+	11: ErrPerfUnavailable,
+})
+
+// ImagePerf returns the i/o of every image in the pool with recent i/o, busiest first, as rbd perf image iotop shows it.
+// Stats are collected by the rbd_support manager module, which takes a few seconds to start reporting an image.
+func (pool *Pool) ImagePerf() ([]*ImagePerf, error) {
+	entries := []*imagePerfEntry{}
+	err := cmdJSON(pool.context(), &entries, perfErrs, pool.cmdArgs("perf", "image", "iostat", "--iterations", "1")...)
+	if err != nil {
+		return nil, wrapErr(err, "error getting image perf stats for %v", pool.FullName())
+	}
+	r := make([]*ImagePerf, 0, len(entries))
+	for _, e := range entries {
+		p := &ImagePerf{
+			Pool:         e.Pool,
+			Namespace:    e.PoolNamespace,
+			Image:        e.Image,
+			ReadOps:      jsonFloat(e.Rd),
+			WriteOps:     jsonFloat(e.Wr),
+			ReadBytes:    jsonFloat(e.RdBytes),
+			WriteBytes:   jsonFloat(e.WrBytes),
+			ReadLatency:  time.Duration(jsonFloat(e.RdLatency)),
+			WriteLatency: time.Duration(jsonFloat(e.WrLatency)),
+		}
+		if p.Pool == "" {
+			p.Pool, p.Namespace = pool.Name(), pool.Namespace()
+		}
+		r = append(r, p)
+	}
+	sort.SliceStable(r, func(i, j int) bool { return r[i].ReadOps+r[i].WriteOps > r[j].ReadOps+r[j].WriteOps })
+	return r, nil
+}
+
+// Perf returns the i/o of the image, or zero i/o if it had none recently
+func (img *Image) Perf() (*ImagePerf, error) {
+	all, err := img.Pool().ImagePerf()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range all {
+		if p.Image == img.Name() {
+			return p, nil
+		}
+	}
+	return &ImagePerf{Pool: img.Pool().Name(), Namespace: img.Pool().Namespace(), Image: img.Name()}, nil
+}
@@ -1,12 +1,25 @@
 package rbd
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"strconv"
 )
 
-// Pool is an rbd pool
+// Pool is an rbd pool, or a namespace within one
 type Pool struct {
-	name string
+	name      string
+	namespace string
+	cluster   Cluster
+	ctx       context.Context
+}
+
+func newPool(cluster Cluster, name, namespace string, ctx context.Context) *Pool {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &Pool{name: name, namespace: namespace, cluster: cluster, ctx: ctx}
 }
 
 // Name is the pool name
@@ -14,43 +27,108 @@ func (pool *Pool) Name() string {
 	return pool.name
 }
 
-// GetPool gets a pool object (does not verify pool exists)
+// Namespace is the namespace within the pool, empty for the default namespace
+func (pool *Pool) Namespace() string {
+	return pool.namespace
+}
+
+// FullName is the full name in the format pool/namespace, or pool in the default namespace
+func (pool *Pool) FullName() string {
+	if pool.namespace == "" {
+		return pool.name
+	}
+	return pool.name + "/" + pool.namespace
+}
+
+// Cluster is the cluster the pool is in
+func (pool *Pool) Cluster() Cluster {
+	return pool.cluster
+}
+
+// GetPool gets a pool object in the default cluster (does not verify pool exists)
 func GetPool(name string) *Pool {
-	return &Pool{name}
+	return DefaultCluster().Pool(name)
+}
+
+// WithNamespace returns a copy of the pool whose images are in namespace, empty for the default namespace
+func (pool *Pool) WithNamespace(namespace string) *Pool {
+	return newPool(pool.cluster, pool.name, namespace, pool.ctx)
+}
+
+// WithContext returns a copy of the pool whose commands, and the commands of images and snapshots
+// gotten from it, are killed when ctx is done
+func (pool *Pool) WithContext(ctx context.Context) *Pool {
+	return newPool(pool.cluster, pool.name, pool.namespace, ctx)
+}
+
+func (pool *Pool) context() context.Context {
+	return pool.ctx
 }
 
 // ErrDoesNotExist is returned if the pool, image or snapshot does not exist
 var ErrDoesNotExist = errors.New("does not exist")
 
 func (pool *Pool) cmdArgs(args ...string) []string {
-	return append([]string{"--pool", pool.name}, args...)
+	r := []string{"--pool", pool.name}
+	if pool.namespace != "" {
+		r = append(r, "--namespace", pool.namespace)
+	}
+	return pool.cluster.cmdArgs(append(r, args...)...)
+}
+
+// destArgs returns the arguments naming image name in the pool as the destination of a command
+func (pool *Pool) destArgs(name string) []string {
+	r := []string{"--dest-pool", pool.name}
+	if pool.namespace != "" {
+		r = append(r, "--dest-namespace", pool.namespace)
+	}
+	return append(r, "--dest", name)
+}
+
+// owns returns true if m is a device mapped from an image in the pool's namespace
+func (pool *Pool) owns(m *mappedDevice) bool {
+	return m.Pool == pool.name && m.Namespace == pool.namespace
 }
 
 func (pool *Pool) getImage(name string) *Image {
 	return getImage(pool, name)
 }
 
+// createdImage returns an image this process just created, dropping any info cached for an earlier image with its name
+func (pool *Pool) createdImage(name string) *Image {
+	img := pool.getImage(name)
+	InvalidateInfo(img)
+	return img
+}
+
 var poolErrs = exitCodeToErrMap(map[int]error{2: ErrDoesNotExist})
 
 // Images returns the rbd images
 func (pool *Pool) Images() ([]*Image, error) {
-	imgNames := []string{}
-	err := cmdJSON(&imgNames, poolErrs, pool.cmdArgs("list")...)
-	images := make([]*Image, 0, len(imgNames))
-	for _, n := range imgNames {
-		images = append(images, pool.getImage(n))
-	}
+	images := []*Image{}
+	err := pool.EachImage(func(img *Image) error {
+		images = append(images, img)
+		return nil
+	})
 	return images, err
 }
 
+// EachImage calls fn with each rbd image as the list is read, without holding the whole list in memory.
+// If fn returns an error listing stops and the error is returned.
+func (pool *Pool) EachImage(fn func(*Image) error) error {
+	return activeBackend.eachImage(pool, func(name string) error {
+		return fn(pool.getImage(name))
+	})
+}
+
 func (pool *Pool) MappedImages() ([]*Image, error) {
-	mappedNBDs, err := mappedNBDs()
+	mapped, err := mappedDevices()
 	if err != nil {
 		return nil, err
 	}
 	mappedImages := []*Image{}
-	for _, nbd := range mappedNBDs {
-		if nbd.Pool == pool.Name() && nbd.Snapshot == "-" {
+	for _, nbd := range mapped {
+		if pool.owns(nbd) && nbd.Snapshot == "-" {
 			mappedImages = append(mappedImages, pool.getImage(nbd.Name))
 			/*
 				var mountTime time.Time
@@ -65,6 +143,35 @@ func (pool *Pool) MappedImages() ([]*Image, error) {
 	return mappedImages, nil
 }
 
+// MountsUnder returns where images in the pool are mounted at or beneath dir, keyed by image name
+func (pool *Pool) MountsUnder(dir string) (map[string]string, error) {
+	mapped, err := mappedDevices()
+	if err != nil {
+		return nil, err
+	}
+	devs := make(map[string]string)
+	for _, nbd := range mapped {
+		if pool.owns(nbd) && nbd.Snapshot == "-" {
+			devs[nbd.Device] = nbd.Name
+		}
+	}
+	r := make(map[string]string)
+	if len(devs) == 0 {
+		return r, nil
+	}
+	mounts, err := MountsUnder(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range mounts {
+		// a bind mount of a subdirectory of an image is not where the image is mounted
+		if name, ok := devs[m.Source]; ok && !m.BindsSubdirectory() {
+			r[name] = m.MountPoint
+		}
+	}
+	return r, nil
+}
+
 type devList struct {
 	Image    string `json:"image"`
 	Snapshot string `json:"snapshot"`
@@ -73,7 +180,7 @@ type devList struct {
 // Devices returns all rbd devices including images and snapshots
 func (pool *Pool) Devices() ([]Dev, error) {
 	devs := []*devList{}
-	err := cmdJSON(&devs, poolErrs, pool.cmdArgs("list", "--long")...)
+	err := cmdJSON(pool.context(), &devs, poolErrs, pool.cmdArgs("list", "--long")...)
 	images := make(map[string]*Image)
 	for _, d := range devs {
 		if d.Snapshot == "" {
@@ -92,6 +199,48 @@ func (pool *Pool) Devices() ([]Dev, error) {
 	return retDevs, err
 }
 
+// DiskUsage returns the space provisioned for and used by every image in the pool, not including snapshots.
+// The map is keyed by image name.
+func (pool *Pool) DiskUsage() (map[string]*DiskUsage, error) {
+	du := &diskUsageList{}
+	err := cmdJSON(pool.context(), du, poolErrs, pool.cmdArgs("du")...)
+	if err != nil {
+		return nil, err
+	}
+	r := make(map[string]*DiskUsage, len(du.Images))
+	for _, u := range du.Images {
+		if u.Snapshot == "" {
+			r[u.Name] = u
+		}
+	}
+	return r, nil
+}
+
+// Exists returns true if the pool exists
+func (pool *Pool) Exists() (bool, error) {
+	err := cmdRun(pool.context(), poolErrs, pool.cmdArgs("list")...)
+	if errors.Is(err, ErrDoesNotExist) {
+		return false, nil
+	}
+	return err == nil, wrapErr(err, "error checking for pool %v", pool.Name())
+}
+
+// Create creates the pool with pgNum placement groups, or the cluster default if pgNum is 0.
+// If appEnable is set, the pool is tagged with the rbd application and initialized for rbd.
+func (pool *Pool) Create(pgNum int, appEnable bool) error {
+	args := []string{"osd", "pool", "create", pool.Name()}
+	if pgNum > 0 {
+		args = append(args, strconv.Itoa(pgNum))
+	}
+	if err := cephRun(pool.context(), pool.cluster, nil, args...); err != nil {
+		return wrapErr(err, "error creating pool %v", pool.Name())
+	}
+	if !appEnable {
+		return nil
+	}
+	return wrapErr(cmdRun(pool.context(), poolErrs, pool.cluster.cmdArgs("pool", "init", pool.Name())...), "error initializing pool %v", pool.Name())
+}
+
 var imageErrs = exitCodeToErrMap(map[int]error{2: ErrDoesNotExist})
 
 // GetImage gets an image in the pool
@@ -109,28 +258,69 @@ var createErrs = exitCodeToErrMap(map[int]error{
 })
 
 // CreateImage creates an image in the pool
-func (pool *Pool) CreateImage(name string, size string, args ...string) (*Image, error) {
-	args = append([]string{"--image", name, "--size", size}, args...)
-	err := cmdRun(createErrs, pool.cmdArgs(args...)...)
+func (pool *Pool) CreateImage(name string, size Size, args ...string) (*Image, error) {
+	if err := ValidateImageName(name); err != nil {
+		return nil, err
+	}
+	err := activeBackend.createImage(pool, name, size, args...)
 	if err != nil && !errors.Is(err, ErrAlreadyExists) {
 		return nil, err
 	}
-	return pool.getImage(name), err
+	return pool.createdImage(name), err
+}
+
+// DefaultObjectSize is the object size of images created without --object-size
+const DefaultObjectSize = 4 << 20
+
+// ErrInvalidStriping is returned if striping options cannot be used
+var ErrInvalidStriping = errors.New("invalid striping")
+
+// StripingArgs returns the arguments for CreateImage to stripe an image. stripeUnit is in bytes, or may have a K or M suffix.
+// The stripe unit must evenly divide the object size.
+func StripingArgs(stripeUnit string, stripeCount int) ([]string, error) {
+	unit, err := strconv.ParseUint(stripeUnit, 10, 64)
+	if err != nil {
+		var s Size
+		s, err = ParseSize(stripeUnit)
+		unit = uint64(s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("stripe unit %v: %v: %w", stripeUnit, err, ErrInvalidStriping)
+	}
+	if unit == 0 || unit > DefaultObjectSize || DefaultObjectSize%unit != 0 {
+		return nil, fmt.Errorf("stripe unit %v must evenly divide the object size %v: %w", stripeUnit, DefaultObjectSize, ErrInvalidStriping)
+	}
+	if stripeCount < 1 {
+		return nil, fmt.Errorf("stripe count %v must be at least 1: %w", stripeCount, ErrInvalidStriping)
+	}
+	return []string{"--stripe-unit", strconv.FormatUint(unit, 10), "--stripe-count", strconv.Itoa(stripeCount)}, nil
 }
 
-// CreateImageWithFileSystem creates and formats an image
-func (pool *Pool) CreateImageWithFileSystem(name, size, fileSystem string, args ...string) (*Image, error) {
+// CreateImageWithFileSystem creates and formats an image. mkfsArgs are passed to mkfs after the filesystem profile's arguments.
+// If the image cannot be mapped or formatted it is removed, unless it already existed.
+func (pool *Pool) CreateImageWithFileSystem(name string, size Size, fileSystem string, mkfsArgs []string, args ...string) (*Image, error) {
 	img, err := pool.CreateImage(name, size, args...)
 	if err != nil {
 		return img, err
 	}
 	blk, err := img.Map()
 	if err != nil {
-		return img, err
+		return img, pool.removeFailedImage(img, err)
 	}
-	err = mkfs(blk, fileSystem)
+	err = mkfs(blk, fileSystem, mkfsArgs...)
 	if err != nil {
-		return img, err
+		if uerr := img.Unmap(); uerr != nil {
+			return img, fmt.Errorf("%w, and error unmapping %v to remove it: %v", err, img.FullName(), uerr)
+		}
+		return img, pool.removeFailedImage(img, err)
 	}
 	return img, img.Unmap()
 }
+
+// removeFailedImage removes an image which could not be formatted, returning err
+func (pool *Pool) removeFailedImage(img *Image, err error) error {
+	if rerr := img.Remove(); rerr != nil {
+		return fmt.Errorf("%w, and error removing %v: %v", err, img.FullName(), rerr)
+	}
+	return err
+}
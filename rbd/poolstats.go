@@ -0,0 +1,88 @@
+package rbd
+
+// PoolStats is the images, capacity and client i/o of a pool
+type PoolStats struct {
+	Pool      string
+	Namespace string
+	// Images, Snapshots and ProvisionedBytes count the images in the namespace, from rbd pool stats
+	Images           int64
+	Snapshots        int64
+	ProvisionedBytes int64
+	TrashImages      int64
+	// StoredBytes, UsedBytes, MaxAvailBytes and PercentUsed are for the whole pool, from ceph df.
+	// UsedBytes includes replication, StoredBytes does not.
+	StoredBytes   int64
+	UsedBytes     int64
+	MaxAvailBytes int64
+	PercentUsed   float64
+	Objects       int64
+	// ReadOps, WriteOps, ReadBytes and WriteBytes are per second by every client of the pool, from ceph osd pool stats
+	ReadOps    float64
+	WriteOps   float64
+	ReadBytes  float64
+	WriteBytes float64
+}
+
+type rbdPoolStats struct {
+	ImageCount            int64 `json:"image_count"`
+	ImageProvisionedBytes int64 `json:"image_provisioned_bytes"`
+	ImageSnapCount        int64 `json:"image_snap_count"`
+	TrashCount            int64 `json:"trash_count"`
+}
+
+type cephDf struct {
+	Pools []*struct {
+		Name  string `json:"name"`
+		Stats struct {
+			Stored      int64   `json:"stored"`
+			BytesUsed   int64   `json:"bytes_used"`
+			MaxAvail    int64   `json:"max_avail"`
+			PercentUsed float64 `json:"percent_used"`
+			Objects     int64   `json:"objects"`
+		} `json:"stats"`
+	} `json:"pools"`
+}
+
+type cephPoolIO struct {
+	PoolName     string `json:"pool_name"`
+	ClientIORate struct {
+		ReadBytesSec  float64 `json:"read_bytes_sec"`
+		WriteBytesSec float64 `json:"write_bytes_sec"`
+		ReadOpPerSec  float64 `json:"read_op_per_sec"`
+		WriteOpPerSec float64 `json:"write_op_per_sec"`
+	} `json:"client_io_rate"`
+}
+
+// PerfStats returns the images, capacity and client i/o of the pool. Capacity and i/o require the ceph binary.
+func (pool *Pool) PerfStats() (*PoolStats, error) {
+	s := &PoolStats{Pool: pool.Name(), Namespace: pool.Namespace()}
+
+	rs := &rbdPoolStats{}
+	if err := cmdJSON(pool.context(), rs, poolErrs, pool.cmdArgs("pool", "stats")...); err != nil {
+		return nil, wrapErr(err, "error getting stats for pool %v", pool.FullName())
+	}
+	s.Images, s.Snapshots, s.ProvisionedBytes, s.TrashImages = rs.ImageCount, rs.ImageSnapCount, rs.ImageProvisionedBytes, rs.TrashCount
+
+	df := &cephDf{}
+	if err := cephJSON(pool.context(), pool.cluster, df, nil, "df"); err != nil {
+		return nil, wrapErr(err, "error getting capacity of pool %v", pool.Name())
+	}
+	for _, p := range df.Pools {
+		if p.Name == pool.Name() {
+			s.StoredBytes, s.UsedBytes, s.MaxAvailBytes = p.Stats.Stored, p.Stats.BytesUsed, p.Stats.MaxAvail
+			s.PercentUsed, s.Objects = p.Stats.PercentUsed, p.Stats.Objects
+		}
+	}
+
+	io := []*cephPoolIO{}
+	if err := cephJSON(pool.context(), pool.cluster, &io, poolErrs, "osd", "pool", "stats", pool.Name()); err != nil {
+		return nil, wrapErr(err, "error getting i/o of pool %v", pool.Name())
+	}
+	for _, p := range io {
+		if p.PoolName == pool.Name() {
+			s.ReadOps, s.WriteOps = p.ClientIORate.ReadOpPerSec, p.ClientIORate.WriteOpPerSec
+			s.ReadBytes, s.WriteBytes = p.ClientIORate.ReadBytesSec, p.ClientIORate.WriteBytesSec
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,132 @@
+package rbd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrIO is returned when a device fails a health probe
+var ErrIO = errors.New("device i/o error")
+
+// DeviceHealth is the result of probing a device
+type DeviceHealth struct {
+	Device string
+	// Size is the size of the device according to the kernel, a disconnected nbd device has size 0
+	Size int64
+	// FSErrors is the filesystem error count for ext filesystems, or -1 if it is not available
+	FSErrors int64
+	// Err is set if the device could not be read
+	Err error
+}
+
+const probeSize = 4096
+
+// probingMutex protects probing, the devices with a direct read in flight. A read that hangs is abandoned, and
+// the device is not read again until it returns, so a dead device holds at most one goroutine and descriptor.
+var probingMutex = &sync.Mutex{}
+var probing = make(map[string]bool)
+
+// ProbeDevice checks the health of blk by reading its first block directly, bypassing the page cache.
+// Reads from a dead device can hang, so the read is abandoned after timeout, and the device fails its probes until
+// the abandoned read returns.
+func ProbeDevice(blk string, timeout time.Duration) *DeviceHealth {
+	h := &DeviceHealth{Device: blk, FSErrors: -1}
+	dev := filepath.Base(blk)
+
+	sectors, err := readSysInt(filepath.Join("/sys/block", dev, "size"))
+	if err != nil {
+		h.Err = err
+		return h
+	}
+	h.Size = sectors * 512
+	if h.Size == 0 {
+		h.Err = fmt.Errorf("%v has size 0: %w", blk, ErrIO)
+		return h
+	}
+
+	if n, err := readSysInt(filepath.Join("/sys/fs/ext4", dev, "errors_count")); err == nil {
+		h.FSErrors = n
+	}
+
+	probingMutex.Lock()
+	if probing[blk] {
+		probingMutex.Unlock()
+		h.Err = fmt.Errorf("an earlier read from %v has not completed: %w", blk, ErrIO)
+		return h
+	}
+	probing[blk] = true
+	probingMutex.Unlock()
+
+	errCh := make(chan error, 1)
+	go func() {
+		err := readDirect(blk)
+		probingMutex.Lock()
+		delete(probing, blk)
+		probingMutex.Unlock()
+		errCh <- err
+	}()
+	select {
+	case err = <-errCh:
+		if err != nil {
+			h.Err = fmt.Errorf("error reading %v: %v: %w", blk, err, ErrIO)
+		}
+	case <-time.After(timeout):
+		h.Err = fmt.Errorf("read from %v did not complete in %v: %w", blk, timeout, ErrIO)
+	}
+	return h
+}
+
+func readSysInt(path string) (int64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// readDirect reads the first block of blk with O_DIRECT so the read reaches the device
+func readDirect(blk string) error {
+	f, err := os.OpenFile(blk, os.O_RDONLY|syscall.O_DIRECT, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// O_DIRECT requires an aligned buffer, mmap is always page aligned
+	buf, err := syscall.Mmap(-1, 0, probeSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Munmap(buf) //nolint: errcheck
+	_, err = f.ReadAt(buf, 0)
+	return err
+}
+
+// FenceDevice kills the rbd-nbd process serving blk so no further i/o reaches the cluster through it.
+// Filesystems mounted from blk stay mounted, and the image can be reattached with Image.Reattach.
+func FenceDevice(blk string) error {
+	mapped, err := mappedDevices()
+	if err != nil {
+		return err
+	}
+	for _, m := range mapped {
+		if m.Device == blk {
+			if m.Type != DeviceTypeNBD {
+				return fmt.Errorf("%v is mapped with %v, only nbd devices can be fenced", blk, m.Type)
+			}
+			defer invalidateMappedCache()
+			if err = syscall.Kill(m.Pid, syscall.SIGKILL); err != nil {
+				return fmt.Errorf("error killing rbd-nbd pid %v for %v: %w", m.Pid, blk, err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%v: %w", blk, ErrNotMapped)
+}
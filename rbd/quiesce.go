@@ -0,0 +1,33 @@
+package rbd
+
+import (
+	"strings"
+	"sync"
+)
+
+var quiesceMutex = &sync.RWMutex{}
+var quiesceEnabled bool
+var quiesceHook string
+
+// SetQuiesce enables rbd-nbd's quiesce support for images mapped after it is called, so snapshots created by
+// any client run hook to freeze and unfreeze the filesystem. If hook is empty, rbd-nbd's default hook is used.
+// Requires rbd-nbd from pacific or later.
+func SetQuiesce(enabled bool, hook string) {
+	quiesceMutex.Lock()
+	defer quiesceMutex.Unlock()
+	quiesceEnabled, quiesceHook = enabled, hook
+}
+
+// quiesceArgs returns the map arguments enabling quiesce, if it is enabled
+func quiesceArgs() []string {
+	quiesceMutex.RLock()
+	defer quiesceMutex.RUnlock()
+	if !quiesceEnabled {
+		return nil
+	}
+	opts := []string{"quiesce"}
+	if quiesceHook != "" {
+		opts = append(opts, "quiesce-hook="+quiesceHook)
+	}
+	return []string{"--options", strings.Join(opts, ",")}
+}
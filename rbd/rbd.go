@@ -1,18 +1,61 @@
 package rbd
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"strings"
-
-	"github.com/o1egl/fwencoder"
+	"sync"
+	"time"
 )
 
-// DrDrpRbdBinPath is the path to the rbd binary
-var rbdBin string
-var fsFreezePath string
+// ErrNoRbdBinary is returned by operations which need the rbd binary when it can not be found
+var ErrNoRbdBinary = errors.New("unable to find rbd binary")
+
+// rbdBinEnv is the environment variable which overrides the rbd binary
+const rbdBinEnv = "RBD_BINARY"
+
+var rbdBinMutex = &sync.Mutex{}
+
+// rbdBinName is the rbd binary set by SetRbdBinary, rbdBinPath is where it was found
+var rbdBinName, rbdBinPath string
+
+// SetRbdBinary sets the name or path of the rbd binary, which may be a wrapper script that runs rbd
+// in a container. Empty restores the default, $RBD_BINARY if it is set, otherwise rbd from $PATH.
+// The binary is looked up when the first command is run.
+func SetRbdBinary(bin string) {
+	rbdBinMutex.Lock()
+	defer rbdBinMutex.Unlock()
+	rbdBinName, rbdBinPath = bin, ""
+}
+
+// rbdBin returns the path of the rbd binary, looking it up until it is found
+func rbdBin() (string, error) {
+	rbdBinMutex.Lock()
+	defer rbdBinMutex.Unlock()
+	if rbdBinPath != "" {
+		return rbdBinPath, nil
+	}
+	name := rbdBinName
+	if name == "" {
+		name = os.Getenv(rbdBinEnv)
+	}
+	if name == "" {
+		name = "rbd"
+	}
+	// not cached on failure, so rbd can be installed without restarting
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v, install ceph-common or set %v", ErrNoRbdBinary, err, rbdBinEnv)
+	}
+	rbdBinPath = path
+	return path, nil
+}
 
 func wrapErr(err error, errStr string, args ...interface{}) error {
 	if err == nil {
@@ -21,139 +64,278 @@ func wrapErr(err error, errStr string, args ...interface{}) error {
 	return fmt.Errorf(errStr+": %w", append(args, err)...)
 }
 
-func init() {
-	var err error
-	rbdBin, err = exec.LookPath("rbd")
-	if err != nil {
-		panic(fmt.Errorf("unable to find rbd binary: %w", err))
-	}
+// ErrTimeout is returned when an rbd command does not complete before the command timeout
+var ErrTimeout = errors.New("rbd command timed out")
+
+var cmdTimeout time.Duration
+
+// SetCmdTimeout sets the maximum time an rbd command may run before it is killed. Use 0 for no timeout.
+// It should be called before any commands are run.
+func SetCmdTimeout(d time.Duration) {
+	cmdTimeout = d
 }
 
-type cmdErrMap func(*exec.ExitError) error
+// cmdContext returns the context for a single command, parent with the command timeout applied
+func cmdContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if cmdTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, cmdTimeout)
+}
 
-func exitCodeToErrMap(m map[int]error) cmdErrMap {
-	return func(err *exec.ExitError) error {
-		if rErr, ok := m[err.ExitCode()]; ok {
-			return rErr
-		}
+// cmdTimeoutErr replaces err with ErrTimeout if the command was killed because ctx expired,
+// or wraps the context error if the command was killed because its parent was canceled
+func cmdTimeoutErr(ctx context.Context, err error, args []string) error {
+	if err == nil || ctx.Err() == nil {
 		return err
 	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && cmdTimeout > 0 {
+		return fmt.Errorf("%v after %v (%v): %w", args, cmdTimeout, err, ErrTimeout)
+	}
+	return fmt.Errorf("%v (%v): %w", args, err, ctx.Err())
 }
 
-func cmdJSON(v interface{}, errMap cmdErrMap, args ...string) error {
-	jsonDecode := func(v interface{}) func(io.Reader) error {
-		return func(r io.Reader) error {
-			return json.NewDecoder(r).Decode(v)
-		}
+// cmdErrMap maps a failed command to a package error, or returns nil if it has no mapping
+type cmdErrMap func(*CmdError) error
+
+func exitCodeToErrMap(m map[int]error) cmdErrMap {
+	return func(err *CmdError) error {
+		return m[err.ExitCode]
 	}
-	args = append([]string{"--format", "json"}, args...)
-	err := cmdDecode(jsonDecode(v), rbdBin, args...)
-	return cmdMapErr(err, errMap)
 }
 
-func cmdColumns(v interface{}, errMap cmdErrMap, args ...string) error {
-	colDecode := func(v interface{}) func(io.Reader) error {
-		return func(r io.Reader) error {
-			return fwencoder.UnmarshalReader(r, v)
-		}
+func cmdJSON(ctx context.Context, v interface{}, errMap cmdErrMap, args ...string) error {
+	args = append([]string{"--format", "json"}, args...)
+	bin, err := rbdBin()
+	if err != nil {
+		return err
 	}
-
-	err := cmdDecode(colDecode(v), rbdBin, args...)
-	return cmdMapErr(err, errMap)
+	return withRetry(ctx, args, func() error {
+		done := cmdAcquire(args)
+		ctx, cancel := cmdContext(ctx)
+		defer cancel()
+		stderr := &bytes.Buffer{}
+		err := executor.StreamJSON(ctx, v, stderr, bin, args...)
+		done(err)
+		return cmdTimeoutErr(ctx, cmdMapErr(err, errMap, stderr, bin, args), args)
+	})
 }
 
-func cmdOut(errMap cmdErrMap, args ...string) (string, error) {
-	out, err := exec.Command(rbdBin, args...).Output()
-	return strings.TrimSpace(string(out)), cmdMapErr(err, errMap)
+func cmdOut(ctx context.Context, errMap cmdErrMap, args ...string) (string, error) {
+	bin, err := rbdBin()
+	if err != nil {
+		return "", err
+	}
+	var out []byte
+	err = withRetry(ctx, args, func() error {
+		done := cmdAcquire(args)
+		ctx, cancel := cmdContext(ctx)
+		defer cancel()
+		stderr := &bytes.Buffer{}
+		var err error
+		out, err = executor.Output(ctx, stderr, bin, args...)
+		done(err)
+		return cmdTimeoutErr(ctx, cmdMapErr(err, errMap, stderr, bin, args), args)
+	})
+	return strings.TrimSpace(string(out)), err
 }
 
-func cmdRun(errMap cmdErrMap, args ...string) error {
-	err := exec.Command(rbdBin, args...).Run()
-	return cmdMapErr(err, errMap)
+func cmdRun(ctx context.Context, errMap cmdErrMap, args ...string) error {
+	bin, err := rbdBin()
+	if err != nil {
+		return err
+	}
+	return withRetry(ctx, args, func() error {
+		done := cmdAcquire(args)
+		ctx, cancel := cmdContext(ctx)
+		defer cancel()
+		stderr := &bytes.Buffer{}
+		err := executor.Run(ctx, nil, nil, stderr, bin, args...)
+		done(err)
+		return cmdTimeoutErr(ctx, cmdMapErr(err, errMap, stderr, bin, args), args)
+	})
 }
 
-func cmdDecode(decode func(io.Reader) error, name string, arg ...string) error {
-	cmd := exec.Command(name, arg...)
-	stdOut, err := cmd.StdoutPipe()
+// cmdJSONEach runs an rbd command whose output is a json array, calling decode to decode each element as it is
+// written so large lists are never held in memory. If decode returns an error the command is killed and the error
+// is returned. Elements may already have been passed to decode when a command fails, so it is not retried.
+func cmdJSONEach(ctx context.Context, errMap cmdErrMap, decode func(*json.Decoder) error, args ...string) error {
+	args = append([]string{"--format", "json"}, args...)
+	bin, err := rbdBin()
+	if err != nil {
+		return err
+	}
+	done := cmdAcquire(args)
+	ctx, cancel := cmdContext(ctx)
+	defer cancel()
+	stderr := &bytes.Buffer{}
+	pr, pw := io.Pipe()
+	exited := make(chan error, 1)
+	go func() {
+		err := executor.Run(ctx, nil, pw, stderr, bin, args...)
+		pw.Close()
+		exited <- err
+	}()
+
+	var decodeErr error
+	dec := json.NewDecoder(pr)
+	if decodeErr = expectDelim(dec, '['); decodeErr == nil {
+		for dec.More() {
+			if err = decode(dec); err != nil {
+				cancel()
+				pr.Close()
+				<-exited
+				done(err)
+				return err
+			}
+		}
+		decodeErr = expectDelim(dec, ']')
+	}
+	if decodeErr != nil {
+		// unblock the command so it can exit, its exit status usually explains the decode error
+		pr.Close()
+	}
+	err = <-exited
+	done(err)
 	if err != nil {
-		return fmt.Errorf("error setting up stdout for cmd %v %v: %w", cmd, arg, err)
+		return cmdTimeoutErr(ctx, cmdMapErr(err, errMap, stderr, bin, args), args)
 	}
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("error starting cmd %v %v: %w", cmd, arg, err)
+	if decodeErr != nil {
+		return fmt.Errorf("error decoding %v: %w", args, decodeErr)
 	}
-	if err := decode(stdOut); err != nil {
-		return fmt.Errorf("error decoding cmd %v %v: %w", cmd, arg, err)
+	return nil
+}
+
+// expectDelim reads the next token from dec, returning an error if it is not delim
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
 	}
-	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("error waiting on cmd %v %v: %w", cmd, arg, err)
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expected %v, got %v", delim, t)
 	}
 	return nil
 }
 
-func cmdMapErr(err error, errMap func(*exec.ExitError) error) error {
-	if exitErr, isExitErr := err.(*exec.ExitError); isExitErr {
-		return errMap(exitErr)
+// cmdStream runs an rbd command with stdin and stdout connected to r and w, either may be nil.
+// Transfers can legitimately take longer than the command timeout, so only ctx applies.
+func cmdStream(ctx context.Context, errMap cmdErrMap, r io.Reader, w io.Writer, args ...string) error {
+	bin, err := rbdBin()
+	if err != nil {
+		return err
+	}
+	done := cmdAcquire(args)
+	stderr := &bytes.Buffer{}
+	err = executor.Run(ctx, r, w, stderr, bin, args...)
+	done(err)
+	err = cmdMapErr(err, errMap, stderr, bin, args)
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%v: %w", err, ctx.Err())
 	}
 	return err
 }
 
-type mappedNBD struct {
-	Pid      int    `column:"pid"`
-	Pool     string `column:"pool"`
-	Name     string `column:"image"`
-	Snapshot string `column:"snap"`
-	Device   string `column:"device"`
+// cmdRunLong runs an rbd command which can legitimately run longer than the command timeout, such as a flatten,
+// so only ctx applies. It is not retried, a killed attempt may already have changed the image.
+func cmdRunLong(ctx context.Context, errMap cmdErrMap, args ...string) error {
+	return cmdStream(ctx, errMap, nil, nil, args...)
 }
 
-func mappedNBDs() ([]*mappedNBD, error) {
-	var mapped []*mappedNBD
-	err := cmdColumns(&mapped, nil, "nbd", "list")
-	return mapped, err
+// cmdMapErr converts a failed command, whose error may be wrapped, to a CmdError including stderr.
+// The failure is mapped to a package error using errMap, falling back to the mapping of common errors.
+func cmdMapErr(err error, errMap cmdErrMap, stderr *bytes.Buffer, name string, args []string) error {
+	var exitErr exitCoder
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	cmdErr := &CmdError{Args: append([]string{name}, args...), ExitCode: exitErr.ExitCode(), Stderr: strings.TrimSpace(stderr.String()), Err: err}
+	if errMap != nil {
+		if mErr := errMap(cmdErr); mErr != nil {
+			cmdErr.Err = mErr
+			return cmdErr
+		}
+	}
+	if mErr := commonErrs(cmdErr); mErr != nil {
+		cmdErr.Err = mErr
+	}
+	return cmdErr
 }
 
-//FSFreeze freezes a filesystem
-func FSFreeze(mountpoint string) error {
-	return fsFreeze(mountpoint, false)
+// Device types an image can be mapped with
+const (
+	DeviceTypeNBD  = "nbd"
+	DeviceTypeKRBD = "krbd"
+)
+
+type mappedDevice struct {
+	Pid       int
+	Pool      string
+	Namespace string
+	Name      string
+	Snapshot  string
+	Device    string
+	// Cookie is set on pacific and later if the device was mapped with one
+	Cookie string
+	// Type is DeviceTypeNBD or DeviceTypeKRBD
+	Type string
 }
 
-//FSUnfreeze freezes a filesystem
-func FSUnfreeze(mountpoint string) error {
-	return fsFreeze(mountpoint, true)
+// DefaultMappedCacheTTL is how long the list of mapped devices is cached by default
+const DefaultMappedCacheTTL = 2 * time.Second
+
+var mappedCacheMutex = &sync.Mutex{}
+var mappedCacheTTL = DefaultMappedCacheTTL
+var mappedCache []*mappedDevice
+var mappedCacheTime time.Time
+
+// SetMappedCacheTTL sets how long the list of mapped devices is cached. Use 0 to disable caching.
+// The cache is always invalidated when this process maps or unmaps a device.
+func SetMappedCacheTTL(d time.Duration) {
+	mappedCacheMutex.Lock()
+	defer mappedCacheMutex.Unlock()
+	mappedCacheTTL = d
+	mappedCache = nil
 }
 
-func fsFreeze(mountpoint string, unfreeze bool) error {
-	var err error
-	if fsFreezePath == "" {
-		fsFreezePath, err = exec.LookPath("fsfreeze")
-		if err != nil {
-			return err
-		}
-	}
-	op := "freeze"
-	if unfreeze {
-		op = "unfreeze"
-	}
+func invalidateMappedCache() {
+	mappedCacheMutex.Lock()
+	defer mappedCacheMutex.Unlock()
+	mappedCache = nil
+}
 
-	err = exec.Command(fsFreezePath, "--"+op, mountpoint).Run() //nolint: gas
+func mappedDevices() ([]*mappedDevice, error) {
+	mappedCacheMutex.Lock()
+	defer mappedCacheMutex.Unlock()
+	if mappedCache != nil && time.Since(mappedCacheTime) < mappedCacheTTL {
+		return mappedCache, nil
+	}
+	mapped, err := listDevices(DeviceTypeNBD, nbdArgs("list")...)
 	if err != nil {
-		return fmt.Errorf("failed to %v %v: %w", op, mountpoint, err)
+		return nil, err
 	}
-
-	return nil
+	// images mapped manually with the kernel client, which is only listed if the module is loaded
+	if _, err := os.Stat("/sys/bus/rbd"); err == nil {
+		krbds, err := listDevices(DeviceTypeKRBD, "showmapped")
+		if err != nil {
+			return nil, err
+		}
+		mapped = append(mapped, krbds...)
+	}
+	mappedCache, mappedCacheTime = mapped, time.Now()
+	return mapped, nil
 }
 
-func fsFreezeBlk(blk string) (func(), error) {
-	mounts, err := getMounts(blk)
+// MappedDeviceType returns the device type blk was mapped with, or ErrNotMapped if it is not a mapped rbd device
+func MappedDeviceType(blk string) (string, error) {
+	mapped, err := mappedDevices()
 	if err != nil {
-		return nil, fmt.Errorf("error getting mounts for %v: %w", blk, err)
+		return "", err
 	}
-	if len(mounts) == 0 {
-		if err = isMountedElsewhere(blk, ""); err != nil {
-			return nil, err
+	for _, m := range mapped {
+		if m.Device == blk {
+			return m.Type, nil
 		}
-	} else {
-		mountPoint := mounts[0].MountPoint
-		return func() { FSUnfreeze(mountPoint) }, FSFreeze(mountPoint)
 	}
-	return func() {}, nil
+	return "", fmt.Errorf("%v: %w", blk, ErrNotMapped)
 }
@@ -0,0 +1,88 @@
+package rbd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrShrinkNotAllowed is returned when resizing an image to a smaller size without allowing it to shrink
+var ErrShrinkNotAllowed = errors.New("shrinking an image is not allowed")
+
+var resizeErrs = exitCodeToErrMap(map[int]error{
+	2:  ErrDoesNotExist,
+	22: ErrShrinkNotAllowed,
+})
+
+// GrowFunc grows the filesystem fs on blk, mounted at mountPoint, to fill the device
+type GrowFunc func(blk, fs, mountPoint string) error
+
+// Resize changes the size of the image.
+// If the image grew and is mapped and mounted, each grow function is called with the device and mountpoint.
+func (img *Image) Resize(size Size, allowShrink bool, grow ...GrowFunc) error {
+	// the shrink check must not use a cached size
+	InvalidateInfo(img)
+	defer InvalidateInfo(img)
+	info, err := img.Info()
+	if err != nil {
+		return err
+	}
+	if size < info.Size && !allowShrink {
+		return fmt.Errorf("%v from %v to %v: %w", img.FullName(), info.Size, size, ErrShrinkNotAllowed)
+	}
+	if err = activeBackend.resize(img, size, allowShrink); err != nil {
+		return wrapErr(err, "error resizing %v to %v", img.FullName(), size)
+	}
+	if size <= info.Size {
+		return nil
+	}
+	return img.GrowMounted(grow...)
+}
+
+// GrowMounted calls each grow function with the device and mountpoint of the image, if it is mapped and mounted here,
+// eg: after the image was resized by another client
+func (img *Image) GrowMounted(grow ...GrowFunc) error {
+	if len(grow) == 0 {
+		return nil
+	}
+	blk, err := img.Device()
+	if err != nil || blk == "" {
+		return err
+	}
+	mounts, err := MountsForDevice(blk)
+	if err != nil || len(mounts) == 0 {
+		return err
+	}
+	fs, err := getFs(blk)
+	if err != nil {
+		return err
+	}
+	for _, g := range grow {
+		if err = g(blk, fs, primaryMount(mounts).MountPoint); err != nil {
+			return wrapErr(err, "error growing filesystem on %v", img.FullName())
+		}
+	}
+	return nil
+}
+
+// GrowFileSystem is a GrowFunc which grows xfs, ext and btrfs filesystems online
+func GrowFileSystem(blk, fs, mountPoint string) error {
+	var args []string
+	switch fs {
+	case "xfs":
+		args = []string{"xfs_growfs", mountPoint}
+	case "ext2", "ext3", "ext4":
+		args = []string{"resize2fs", blk}
+	case "btrfs":
+		args = []string{"btrfs", "filesystem", "resize", "max", mountPoint}
+	default:
+		return fmt.Errorf("growing %v filesystems is not supported", fs)
+	}
+	out := &bytes.Buffer{}
+	if err := executor.Run(context.Background(), nil, out, out, args[0], args[1:]...); err != nil {
+		return fmt.Errorf("error running %v: %v: %w", args, strings.TrimSpace(out.String()), err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package rbd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// RetryPolicy retries rbd commands which fail with transient errors, such as a brief loss of the monitors
+type RetryPolicy struct {
+	// Attempts is the total number of times a command is run, 1 or less disables retries
+	Attempts int
+	// Backoff is the wait before the first retry, it doubles for each retry after that
+	Backoff time.Duration
+	// MaxBackoff caps the wait between retries, 0 for no cap
+	MaxBackoff time.Duration
+	// Retryable returns true if a failed command should be retried, nil uses IsTransient
+	Retryable func(error) bool
+}
+
+var retryPolicy = &RetryPolicy{Attempts: 1}
+
+// SetRetryPolicy sets the retry policy of rbd commands, nil disables retries.
+// Commands which map or attach devices, and streaming and long running commands, are never retried.
+// IsTransient doesn't retry commands killed at the command timeout, which may have been applied, a custom Retryable
+// which does may see a retried command which changes the cluster, such as create, report ErrAlreadyExists.
+// It should be called before any commands are run.
+func SetRetryPolicy(p *RetryPolicy) {
+	if p == nil {
+		p = &RetryPolicy{Attempts: 1}
+	}
+	retryPolicy = p
+}
+
+// transientExitCodes are the errnos of rbd commands that may succeed if run again
+var transientExitCodes = map[int]struct{}{
+	4:   {}, // EINTR
+	11:  {}, // EAGAIN
+	110: {}, // ETIMEDOUT, usually the monitors could not be reached
+}
+
+var transientMessages = []string{
+	"Resource temporarily unavailable",
+	"Interrupted system call",
+	"Connection timed out",
+	"authenticate timed out",
+}
+
+// IsTransient returns true if err is from an rbd command which failed in a way that may succeed if run again.
+// A command killed at the command timeout is not transient, it may have been applied before it was killed.
+func IsTransient(err error) bool {
+	var cmdErr *CmdError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	if _, ok := transientExitCodes[cmdErr.ExitCode]; ok {
+		return true
+	}
+	for _, m := range transientMessages {
+		if strings.Contains(cmdErr.Stderr, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// noRetryOps are the operations which create state on this host, so a retry could duplicate it
+var noRetryOps = map[string]struct{}{
+	"map":    {},
+	"attach": {},
+}
+
+// retryableOp returns false if args run one of noRetryOps, itself or as a subcommand of device or nbd.
+// Only the operation's position is checked, an image may have the name of an operation.
+func retryableOp(args []string) bool {
+	op := strings.Fields(cmdOpName(args))
+	if len(op) > 1 && (op[0] == "device" || op[0] == "nbd") {
+		op = op[1:]
+	}
+	_, ok := noRetryOps[op[0]]
+	return !ok
+}
+
+// withRetry runs f, running it again under the retry policy while it returns a retryable error.
+// Waiting between attempts stops when ctx is done.
+func withRetry(ctx context.Context, args []string, f func() error) error {
+	p := retryPolicy
+	if !retryableOp(args) {
+		return f()
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsTransient
+	}
+	backoff := p.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = f()
+		if err == nil || attempt >= p.Attempts || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		recordRetry(cmdOpName(args))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		if backoff *= 2; p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package rbd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryableOp(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"--pool", "rbd", "device", "map", "--device-type", "nbd", "vol"}, false},
+		{[]string{"--pool", "rbd", "nbd", "map", "vol"}, false},
+		{[]string{"--pool", "rbd", "--image", "vol", "device", "attach", "--device", "/dev/nbd0"}, false},
+		{[]string{"--pool", "rbd", "map", "vol"}, false},
+		{[]string{"--format", "json", "--pool", "rbd", "--image", "map", "info"}, true},
+		{[]string{"--format", "json", "--pool", "rbd", "info", "map"}, true},
+		{[]string{"--pool", "rbd", "--image", "attach", "snap", "create", "--snap", "s1"}, true},
+		{[]string{"--pool", "rbd", "device", "list"}, true},
+	}
+	for _, tt := range tests {
+		if got := retryableOp(tt.args); got != tt.want {
+			t.Errorf("retryableOp(%v) = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	SetCmdTimeout(time.Minute)
+	defer SetCmdTimeout(0)
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"monitor timeout", &CmdError{ExitCode: 110, Err: ErrTimeout}, true},
+		{"eagain", &CmdError{ExitCode: 11, Err: fakeExitError(11)}, true},
+		{"message", &CmdError{ExitCode: 1, Stderr: "monclient(hunting): authenticate timed out after 300", Err: fakeExitError(1)}, true},
+		{"killed at the command timeout", cmdTimeoutErr(expiredContext(), &CmdError{ExitCode: -1, Err: fakeExitError(-1)}, []string{"snap", "create"}), false},
+		{"does not exist", &CmdError{ExitCode: 2, Err: ErrDoesNotExist}, false},
+		{"not a command", fmt.Errorf("error"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.want {
+				t.Errorf("IsTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// expiredContext returns a context whose deadline has passed
+func expiredContext() context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	cancel()
+	return ctx
+}
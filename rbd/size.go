@@ -0,0 +1,71 @@
+package rbd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Size is a size in bytes
+type Size int64
+
+// Size units
+const (
+	Byte Size = 1
+	KiB       = 1 << 10 * Byte
+	MiB       = 1 << 10 * KiB
+	GiB       = 1 << 10 * MiB
+	TiB       = 1 << 10 * GiB
+	PiB       = 1 << 10 * TiB
+)
+
+var sizeSuffixes = map[string]Size{"": MiB, "B": Byte, "K": KiB, "M": MiB, "G": GiB, "T": TiB, "P": PiB}
+
+// sizeUnits are the suffixes String uses, largest first
+var sizeUnits = []struct {
+	suffix string
+	size   Size
+}{{"P", PiB}, {"T", TiB}, {"G", GiB}, {"M", MiB}, {"K", KiB}}
+
+// ParseSize parses sizes as accepted by rbd --size, eg: 10G or 512M. A number without a suffix is megabytes.
+func ParseSize(size string) (Size, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	if len(s) > 2 && strings.HasSuffix(s, "B") && (s[len(s)-2] < '0' || s[len(s)-2] > '9') {
+		s = s[:len(s)-1] // GB -> G
+	}
+	if s == "" {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	suffix := ""
+	if last := s[len(s)-1]; last < '0' || last > '9' {
+		suffix, s = string(last), s[:len(s)-1]
+	}
+	mult, ok := sizeSuffixes[suffix]
+	if !ok {
+		return 0, fmt.Errorf("invalid size suffix in %q", size)
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", size, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("size %q is negative", size)
+	}
+	if n > math.MaxInt64/int64(mult) {
+		return 0, fmt.Errorf("size %q is too large", size)
+	}
+	return Size(n) * mult, nil
+}
+
+// String formats the size with the largest suffix that represents it exactly, eg: 10G, or in bytes eg: 1000B
+func (s Size) String() string {
+	if s != 0 {
+		for _, u := range sizeUnits {
+			if s%u.size == 0 {
+				return strconv.FormatInt(int64(s/u.size), 10) + u.suffix
+			}
+		}
+	}
+	return strconv.FormatInt(int64(s), 10) + "B"
+}
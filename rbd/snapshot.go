@@ -1,18 +1,29 @@
 package rbd
 
-import "syscall"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
 
 // Snapshot is a snapshot
 type Snapshot struct {
 	name  string
 	image *Image
+	// createdAt is set when the snapshot was listed with its timestamp
+	createdAt time.Time
+	// size is set when the snapshot was listed
+	size Size
 }
 
 type snapshotListEntry struct {
-	ID        int    `json:"id"`
-	Name      string `json:"name"`
-	Size      int64  `json:"size"`
-	Timestamp string `json:"timestamp"`
+	ID        int             `json:"id"`
+	Name      string          `json:"name"`
+	Size      Size            `json:"size"`
+	Timestamp CreateTimestamp `json:"timestamp"`
 }
 
 // Image is the image
@@ -23,7 +34,7 @@ func (snap *Snapshot) Image() *Image {
 var _ Dev = (*Snapshot)(nil) // compile check that Image satisfies  Dev
 
 func getSnapshot(img *Image, name string) *Snapshot {
-	return &Snapshot{name, img}
+	return &Snapshot{name: name, image: img}
 }
 
 // Name is the snapshot name
@@ -51,6 +62,36 @@ func (snap *Snapshot) Device() (string, error) {
 	return device(snap)
 }
 
+func (snap *Snapshot) context() context.Context {
+	return snap.Image().context()
+}
+
+// CreatedAt returns when the snapshot was created. It is known without another command for
+// snapshots from Image.Snapshots, except on releases which don't list snapshot timestamps.
+func (snap *Snapshot) CreatedAt() (time.Time, error) {
+	if !snap.createdAt.IsZero() {
+		return snap.createdAt, nil
+	}
+	info, err := snap.Info()
+	if err != nil {
+		return time.Time{}, wrapErr(err, "error getting create time of %v", snap.FullName())
+	}
+	return time.Time(info.CreateTimestamp), nil
+}
+
+// Size returns the size of the image when the snapshot was taken. It is known without another command for
+// snapshots from Image.Snapshots.
+func (snap *Snapshot) Size() (Size, error) {
+	if snap.size != 0 {
+		return snap.size, nil
+	}
+	info, err := snap.Info()
+	if err != nil {
+		return 0, wrapErr(err, "error getting size of %v", snap.FullName())
+	}
+	return info.Size, nil
+}
+
 func (snap *Snapshot) cmdArgs(args ...string) []string {
 	args = append([]string{"--snap", snap.Name()}, args...)
 	return snap.Image().cmdArgs(args...)
@@ -95,12 +136,110 @@ func (snap *Snapshot) Unmount(mountPoint string) error {
 
 // UnmountAndUnmap unmounts and unmaps the device
 func (snap *Snapshot) UnmountAndUnmap(mountPoint string) error {
-	return devUnmountAndUnmap(snap, mountPoint)
+	return devUnmountAndUnmap(snap, mountPoint, nil)
 }
 
-// Remove deletes the device from the pool
+// Remove deletes the device from the pool. Snapshots with clones are not removed and return ErrHasChildren.
+// A snapshot protected by Clone is unprotected first.
 func (snap *Snapshot) Remove() error {
-	return cmdRun(nil, snap.cmdArgs("snap", "remove", "--no-progress")...)
+	defer InvalidateInfo(snap)
+	children, err := snap.Children()
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return fmt.Errorf("%v is the parent of %v: %w", snap.FullName(), children[0].FullName(), ErrHasChildren)
+	}
+	if err = snap.unprotectForClone(); err != nil {
+		return err
+	}
+	return cmdRun(snap.context(), nil, snap.cmdArgs("snap", "remove", "--no-progress")...)
+}
+
+// ErrAlreadyProtected is returned when protecting a snapshot that is already protected
+var ErrAlreadyProtected = errors.New("snapshot is already protected")
+
+// ErrNotProtected is returned when unprotecting a snapshot that is not protected
+var ErrNotProtected = errors.New("snapshot is not protected")
+
+var protectErrs = exitCodeToErrMap(map[int]error{
+	2:  ErrDoesNotExist,
+	16: ErrAlreadyProtected,
+})
+
+var unprotectErrs = exitCodeToErrMap(map[int]error{
+	2:  ErrDoesNotExist,
+	16: ErrHasChildren,
+	22: ErrNotProtected,
+})
+
+// Protect protects the snapshot from removal, which older clusters require before cloning
+func (snap *Snapshot) Protect() error {
+	defer InvalidateInfo(snap)
+	return wrapErr(cmdRun(snap.context(), protectErrs, snap.cmdArgs("snap", "protect")...), "error protecting %v", snap.FullName())
+}
+
+// Unprotect allows the snapshot to be removed. Snapshots with clones cannot be unprotected and return ErrHasChildren.
+func (snap *Snapshot) Unprotect() error {
+	defer InvalidateInfo(snap)
+	return wrapErr(cmdRun(snap.context(), unprotectErrs, snap.cmdArgs("snap", "unprotect")...), "error unprotecting %v", snap.FullName())
+}
+
+// errParentNotProtected is returned by clusters using clone v1 when cloning an unprotected snapshot
+var errParentNotProtected = errors.New("parent snapshot must be protected")
+
+func cloneErrors(err *CmdError) error {
+	switch err.ExitCode {
+	case 2:
+		return ErrDoesNotExist
+	case 17:
+		return ErrAlreadyExists
+	case 22:
+		if strings.Contains(err.Stderr, "must be protected") {
+			return errParentNotProtected
+		}
+	}
+	return nil
+}
+
+// Clone creates a copy on write clone of the snapshot named name in destPool.
+// If the cluster requires the parent to be protected (clone v1), the snapshot is protected first, and
+// ReleaseCloneProtection unprotects it once its clones are gone. Clusters with clone v2 skip protection.
+func (snap *Snapshot) Clone(destPool *Pool, name string, args ...string) (*Image, error) {
+	if err := ValidateImageName(name); err != nil {
+		return nil, err
+	}
+	// if the format can't be detected, eg: without the ceph binary, clone and protect only if rbd requires it
+	if format, err := snap.Pool().Cluster().CloneFormat(); err == nil && format == CloneFormatV1 {
+		if err = snap.protectForClone(); err != nil {
+			return nil, err
+		}
+	}
+	args = snap.cmdArgs(append(append([]string{"clone"}, destPool.destArgs(name)...), args...)...)
+	_, err := cmdOut(snap.context(), cloneErrors, args...)
+	if errors.Is(err, errParentNotProtected) {
+		if err = snap.protectForClone(); err != nil {
+			return nil, err
+		}
+		_, err = cmdOut(snap.context(), cloneErrors, args...)
+	}
+	if err != nil && !errors.Is(err, ErrAlreadyExists) {
+		return nil, wrapErr(err, "error cloning %v to %v/%v", snap.FullName(), destPool.FullName(), name)
+	}
+	return destPool.createdImage(name), err
+}
+
+// Rollback reverts the image to the contents of the snapshot. The image must not be mapped, otherwise ErrDeviceBusy is returned.
+func (snap *Snapshot) Rollback() error {
+	defer InvalidateInfo(snap.Image())
+	blk, err := snap.Image().Device()
+	if err != nil {
+		return err
+	}
+	if blk != "" {
+		return fmt.Errorf("%v is mapped to %v: %w", snap.Image().FullName(), blk, ErrDeviceBusy)
+	}
+	return wrapErr(cmdRun(snap.context(), imageErrs, snap.cmdArgs("snap", "rollback", "--no-progress")...), "error rolling back %v", snap.FullName())
 }
 
 // FileSystem returns the filesystem of the image
@@ -0,0 +1,15 @@
+package rbd
+
+import "strconv"
+
+// Sparsify deallocates the objects of the image which contain only zeros, reclaiming space in the pool.
+// sparseSize is the smallest run of zeros to deallocate in bytes, or 0 for the rbd default.
+// A large image can take longer than the command timeout, so it is only bounded by the image's context.
+func (img *Image) Sparsify(sparseSize int) error {
+	args := []string{"sparsify", "--no-progress"}
+	if sparseSize > 0 {
+		args = append(args, "--sparse-size", strconv.Itoa(sparseSize))
+	}
+	err := cmdRunLong(img.context(), imageErrs, img.cmdArgs(args...)...)
+	return wrapErr(err, "error sparsifying %v", img.FullName())
+}
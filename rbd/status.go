@@ -0,0 +1,118 @@
+package rbd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrHasWatchers is returned when removing an image which a client, on this or another host, has open
+var ErrHasWatchers = errors.New("image has watchers")
+
+// ErrMigrating is returned when removing an image which is the source or destination of a live migration
+var ErrMigrating = errors.New("image is being migrated")
+
+// Watcher is a client which has the image open
+type Watcher struct {
+	Address string `json:"address"`
+	Client  int64  `json:"client"`
+	Cookie  uint64 `json:"cookie"`
+}
+
+func (w *Watcher) String() string {
+	return fmt.Sprintf("client.%v at %v", w.Client, w.Address)
+}
+
+// HasWatchersError identifies the clients which have an image open
+type HasWatchersError struct {
+	Image    string
+	Watchers []*Watcher
+}
+
+func (e *HasWatchersError) Error() string {
+	clients := make([]string, 0, len(e.Watchers))
+	for _, w := range e.Watchers {
+		clients = append(clients, w.String())
+	}
+	return fmt.Sprintf("%v is open by %v: %v", e.Image, strings.Join(clients, ", "), ErrHasWatchers)
+}
+
+// Unwrap returns ErrHasWatchers
+func (e *HasWatchersError) Unwrap() error {
+	return ErrHasWatchers
+}
+
+// Is also matches ErrDeviceBusy, which rbd returns when removing an image with watchers
+func (e *HasWatchersError) Is(target error) bool {
+	return target == ErrDeviceBusy
+}
+
+// MigrationStatus is the state of a live migration, see rbd migration prepare
+type MigrationStatus struct {
+	SourcePool       string `json:"source_pool_name"`
+	SourceNamespace  string `json:"source_pool_namespace"`
+	SourceImage      string `json:"source_image_name"`
+	SourceImageID    string `json:"source_image_id"`
+	DestPool         string `json:"dest_pool_name"`
+	DestNamespace    string `json:"dest_pool_namespace"`
+	DestImage        string `json:"dest_image_name"`
+	DestImageID      string `json:"dest_image_id"`
+	State            string `json:"state"`
+	StateDescription string `json:"state_description"`
+}
+
+// ImageStatus is the status of an image
+type ImageStatus struct {
+	Watchers []*Watcher `json:"watchers"`
+	// Migration is set while the image is the source or destination of a live migration
+	Migration *MigrationStatus `json:"migration,omitempty"`
+	// Mirror is set if mirroring is enabled on the image
+	Mirror *ImageMirrorStatus `json:"mirror,omitempty"`
+}
+
+// Status returns the watchers of the image, and its migration and mirroring state
+func (img *Image) Status() (*ImageStatus, error) {
+	status := &ImageStatus{Watchers: []*Watcher{}}
+	err := cmdJSON(img.context(), status, imageErrs, img.cmdArgs("status")...)
+	if err != nil {
+		return nil, wrapErr(err, "error getting status of %v", img.FullName())
+	}
+	info, err := img.Info()
+	if err != nil {
+		return nil, err
+	}
+	if info.Mirroring != nil && info.Mirroring.State == "enabled" {
+		if status.Mirror, err = img.MirrorStatus(); err != nil {
+			return nil, err
+		}
+	}
+	return status, nil
+}
+
+// Watchers returns the clients which have the image open, including this host if it is mapped here
+func (img *Image) Watchers() ([]*Watcher, error) {
+	status, err := img.Status()
+	if err != nil {
+		return nil, err
+	}
+	return status.Watchers, nil
+}
+
+// checkSafeToRemove returns a *HasWatchersError if any client has the image open, or ErrMigrating if it is being migrated.
+// An image that does not exist is safe, the caller's command reports that it does not exist.
+func (img *Image) checkSafeToRemove() error {
+	status, err := img.Status()
+	if errors.Is(err, ErrDoesNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(status.Watchers) > 0 {
+		return &HasWatchersError{Image: img.FullName(), Watchers: status.Watchers}
+	}
+	if status.Migration != nil {
+		return fmt.Errorf("%v is %v: %w", img.FullName(), status.Migration.State, ErrMigrating)
+	}
+	return nil
+}
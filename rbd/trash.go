@@ -0,0 +1,79 @@
+package rbd
+
+import (
+	"fmt"
+	"time"
+)
+
+// TrashEntry is an image in the trash
+type TrashEntry struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Source    string `json:"source"`
+	DeletedAt string `json:"deleted_at"`
+	Status    string `json:"status"`
+}
+
+var trashMoveErrs = exitCodeToErrMap(map[int]error{
+	2:  ErrDoesNotExist,
+	16: ErrDeviceBusy,
+})
+
+var trashRestoreErrs = exitCodeToErrMap(map[int]error{
+	2:  ErrDoesNotExist,
+	17: ErrAlreadyExists,
+})
+
+// TrashList lists the images in the pool's trash
+func (pool *Pool) TrashList() ([]*TrashEntry, error) {
+	entries := []*TrashEntry{}
+	err := cmdJSON(pool.context(), &entries, poolErrs, pool.cmdArgs("trash", "list", "--long")...)
+	return entries, wrapErr(err, "error listing trash in %v", pool.FullName())
+}
+
+// TrashMove moves the image to the trash. It cannot be purged until delay has passed, but can be restored until it is purged.
+// Images open by any client return a *HasWatchersError, which also matches ErrDeviceBusy.
+func (img *Image) TrashMove(delay time.Duration) error {
+	defer InvalidateInfo(img)
+	if err := img.checkSafeToRemove(); err != nil {
+		return wrapErr(err, "error moving %v to trash", img.FullName())
+	}
+	args := []string{"trash", "move"}
+	if delay > 0 {
+		args = append(args, "--expires-at", time.Now().Add(delay).UTC().Format("2006-01-02 15:04:05"))
+	}
+	return wrapErr(cmdRun(img.context(), trashMoveErrs, img.cmdArgs(args...)...), "error moving %v to trash", img.FullName())
+}
+
+// TrashRestore restores an image from the trash by id. If name is empty, the image is restored with its original name.
+func (pool *Pool) TrashRestore(id, name string) (*Image, error) {
+	args := []string{"trash", "restore", "--image-id", id}
+	if name != "" {
+		if err := ValidateImageName(name); err != nil {
+			return nil, err
+		}
+		args = append(args, "--image", name)
+	} else {
+		entries, err := pool.TrashList()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.ID == id {
+				name = e.Name
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("%v in trash in %v: %w", id, pool.FullName(), ErrDoesNotExist)
+		}
+	}
+	if err := cmdRun(pool.context(), trashRestoreErrs, pool.cmdArgs(args...)...); err != nil {
+		return nil, wrapErr(err, "error restoring %v from trash in %v", id, pool.FullName())
+	}
+	return pool.createdImage(name), nil
+}
+
+// TrashPurge removes the images in the pool's trash whose delay has passed
+func (pool *Pool) TrashPurge() error {
+	return wrapErr(cmdRun(pool.context(), poolErrs, pool.cmdArgs("trash", "purge", "--no-progress")...), "error purging trash in %v", pool.Name())
+}
@@ -0,0 +1,142 @@
+package rbd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Notifications sent to watchers of an image, as named by rbd watch
+const (
+	WatchOpHeaderUpdate = "HeaderUpdate"
+	WatchOpResize       = "Resize"
+	WatchOpSnapCreate   = "SnapCreate"
+	WatchOpSnapRemove   = "SnapRemove"
+)
+
+// WatchEvent is a notification received by a watch on an image
+type WatchEvent struct {
+	// Op is the notification, eg: WatchOpResize, or [unknown] if it had no payload
+	Op string
+	// NotifierID is the id of the client which sent the notification
+	NotifierID string
+}
+
+// Watch watches the image until ctx is done, sending the notifications it receives, such as resizes and snapshots
+// by other clients. It returns once the watch is established, which is subject to the command timeout and limit.
+// The channel is closed when the watch ends.
+// Most changes to an image are sent as WatchOpHeaderUpdate, so receivers should check what changed.
+func (img *Image) Watch(ctx context.Context) (<-chan *WatchEvent, error) {
+	// rbd watch runs until a line is read from stdin. An os pipe is used so the command can exit on
+	// its own without waiting for stdin to be closed.
+	bin, err := rbdBin()
+	if err != nil {
+		return nil, err
+	}
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("error creating stdin for watch on %v: %w", img.FullName(), err)
+	}
+	stdoutR, stdoutW := io.Pipe()
+	stderr := &bytes.Buffer{}
+	args := img.cmdArgs("watch")
+
+	// starting the watch holds a command slot and is killed after the command timeout, once it is established
+	// it runs until ctx is done without holding a slot
+	release := cmdAcquire(args)
+	runCtx, kill := context.WithCancel(ctx)
+	startCtx, cancelStart := cmdContext(runCtx)
+	established := make(chan struct{})
+	go func() {
+		<-startCtx.Done()
+		select {
+		case <-established:
+		default:
+			kill()
+		}
+	}()
+
+	exited, done := make(chan struct{}), make(chan error, 1)
+	go func() {
+		err := executor.Run(runCtx, stdinR, stdoutW, stderr, bin, args...)
+		close(exited)
+		stdinR.Close()
+		stdoutW.Close()
+		done <- cmdMapErr(err, imageErrs, stderr, bin, args)
+	}()
+	go func() {
+		select {
+		case <-runCtx.Done():
+		case <-exited:
+		}
+		stdinW.Close()
+	}()
+
+	scanner := bufio.NewScanner(stdoutR)
+	started := false
+	for !started && scanner.Scan() {
+		started = strings.HasPrefix(scanner.Text(), "press enter to exit")
+	}
+	if !started {
+		_, _ = io.Copy(ioutil.Discard, stdoutR)
+		err := cmdTimeoutErr(startCtx, <-done, args)
+		if err == nil {
+			err = fmt.Errorf("rbd watch exited")
+		}
+		cancelStart()
+		kill()
+		release(err)
+		return nil, wrapErr(err, "error watching %v", img.FullName())
+	}
+	close(established)
+	cancelStart()
+	release(nil)
+
+	events := make(chan *WatchEvent)
+	go func() {
+		defer close(events)
+		defer kill()
+		for scanner.Scan() {
+			e := parseWatchEvent(scanner.Text())
+			if e == nil {
+				continue
+			}
+			InvalidateInfo(img)
+			select {
+			case events <- e:
+			case <-ctx.Done():
+			}
+		}
+		_, _ = io.Copy(ioutil.Discard, stdoutR)
+		<-done
+	}()
+	return events, nil
+}
+
+// parseWatchEvent parses a line such as:
+// img received notification: notify_id=1, cookie=2, notifier_id=3, bl.length=4, notify_op=Resize
+func parseWatchEvent(line string) *WatchEvent {
+	i := strings.Index(line, "received notification:")
+	if i < 0 {
+		return nil
+	}
+	e := &WatchEvent{}
+	for _, kv := range strings.Split(line[i+len("received notification:"):], ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "notify_op":
+			e.Op = parts[1]
+		case "notifier_id":
+			e.NotifierID = parts[1]
+		}
+	}
+	return e
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
+	log "github.com/sirupsen/logrus"
+)
+
+// reconcileRetry is how often reconcile retries the docker api while waiting for it
+const reconcileRetry = 5 * time.Second
+
+// setRequested records that docker has mounted or unmounted a volume since the plugin started, so reconcile leaves it alone
+func (rd *RbdDriver) setRequested(name string) {
+	rd.requestedMutex.Lock()
+	defer rd.requestedMutex.Unlock()
+	rd.requested[name] = struct{}{}
+}
+
+func (rd *RbdDriver) wasRequested(name string) bool {
+	rd.requestedMutex.Lock()
+	defer rd.requestedMutex.Unlock()
+	_, ok := rd.requested[name]
+	return ok
+}
+
+// waitForDocker waits up to wait for the docker api, which may not be serving yet when the plugin starts with the engine.
+// It stops waiting when ctx is done.
+func (rd *RbdDriver) waitForDocker(ctx context.Context, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		_, err := rd.docker.Containers(false)
+		if err == nil {
+			return nil
+		}
+		if !time.Now().Before(deadline) || ctx.Err() != nil {
+			return err
+		}
+		log.WithError(err).Debug("waiting for the docker api")
+		select {
+		case <-time.After(reconcileRetry):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// reconcile brings the host in line with docker after the plugin starts, such as after a reboot or a crash of the plugin.
+// Images mounted for volumes no running container uses are unmounted and unmapped, images mapped but not mounted are
+// unmapped, empty mountpoints are removed, and the resize watches of volumes still in use are restarted.
+// Volumes docker mounts or unmounts while it runs are left alone, as are mounted images if docker can't be reached.
+// It stops between images when ctx is done, the driver must not be drained until it has returned.
+func (rd *RbdDriver) reconcile(ctx context.Context, wait time.Duration) {
+	defer rd.track()()
+	dockerUp := false
+	if rd.docker != nil {
+		if err := rd.waitForDocker(ctx, wait); err != nil {
+			log.WithError(err).Warn("error listing containers, leaving mounted images alone")
+		} else {
+			dockerUp = true
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	mapped, err := rd.pool.MappedImages()
+	if err != nil {
+		log.WithError(err).Error("error getting mapped images to reconcile")
+		return
+	}
+	// the mounts of other namespaces are scanned once for this pass, not for the handlers running alongside it
+	scan := rbd.NewMountScan()
+	for _, img := range mapped {
+		if ctx.Err() != nil {
+			return
+		}
+		rd.reconcileImage(img, dockerUp, scan)
+	}
+	rd.removeEmptyMountPoints()
+}
+
+// reconcileImage unmounts and unmaps img unless a running container uses it. The containers are only checked if
+// dockerUp is set, otherwise a mounted img is kept.
+func (rd *RbdDriver) reconcileImage(img *rbd.Image, dockerUp bool, scan *rbd.MountScan) {
+	_, log, unlock := rd.imgReqInit(img.Name())
+	defer unlock()
+	if rd.wasRequested(img.Name()) {
+		return
+	}
+
+	mp := rd.mountPoint(img)
+	mounted, err := img.IsMountedAt(mp)
+	if err != nil {
+		log.WithError(err).Error("error determining if mounted")
+		return
+	}
+	if mounted {
+		// checked for each image, a container may have started since reconcile began
+		var containers []*volumeContainer
+		if dockerUp {
+			if containers, err = rd.containersUsing(img.Name(), false); err != nil {
+				log.WithError(err).Warn("error getting the containers using the volume, keeping it mounted")
+			}
+		}
+		if !dockerUp || err != nil || len(containers) > 0 {
+			log.WithField("containers", containerNames(containers)).Info("volume is in use, keeping it mounted")
+			if rd.growOnResize {
+				rd.watchResize(img, log)
+			}
+			return
+		}
+	}
+
+	err = img.UnmountAndUnmapWithScan(mp, scan)
+	if errors.Is(err, rbd.ErrMountedElsewhere) {
+		log.WithError(err).Info("device still in use, not unmounting")
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("error unmounting and unmapping unused image")
+		return
+	}
+	if mounted {
+		log.Info("unmounted and unmapped volume no container uses")
+	} else {
+		log.Info("unmapped image which was not mounted")
+	}
+	_ = rd.cleanupMountPoint(mp, log)
+}
+
+// removeEmptyMountPoints removes the directories under the mountpoint which nothing is mounted on
+func (rd *RbdDriver) removeEmptyMountPoints() {
+	entries, err := ioutil.ReadDir(rd.mountpoint)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Error("error reading mountpoint directory")
+		}
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		func() {
+			_, log, unlock := rd.imgReqInit(e.Name())
+			defer unlock()
+			mp := filepath.Join(rd.mountpoint, e.Name())
+			mounts, err := rbd.MountsUnder(mp)
+			if err != nil {
+				log.WithError(err).Error("error checking for mounts")
+				return
+			}
+			if len(mounts) > 0 {
+				return
+			}
+			// a directory with files in it was not left by the driver
+			if err = os.Remove(mp); err != nil {
+				log.WithError(err).WithField("mountpoint", mp).Debug("not removing mountpoint")
+				return
+			}
+			log.WithField("mountpoint", mp).Info("removed empty mountpoint")
+		}()
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
+	log "github.com/sirupsen/logrus"
+)
+
+// cloneSuffix ends the names of the images mount --clone creates
+const cloneSuffix = "-clone"
+
+// cloneOfMetaKey is set on images created by mount --clone to the name of the snapshot they were cloned from
+const cloneOfMetaKey = "rbd-snap.clone-of"
+
+// cloneName is the name of the image mount --clone creates for img
+func cloneName(prefix string, img *rbd.Image) string {
+	return img.Name() + "." + prefix + cloneSuffix
+}
+
+// snapClone returns the clone mount --clone created of img and the name of the snapshot it was cloned from,
+// or nil if there isn't one
+func snapClone(prefix string, img *rbd.Image) (*rbd.Image, string, error) {
+	clone, err := img.Pool().GetImage(cloneName(prefix, img))
+	if errors.Is(err, rbd.ErrDoesNotExist) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	parent, err := clone.GetMeta(cloneOfMetaKey)
+	if errors.Is(err, rbd.ErrDoesNotExist) {
+		return nil, "", fmt.Errorf("%v exists but was not created by rbd-snap", clone.FullName())
+	}
+	return clone, parent, err
+}
+
+// isSnapClone returns true if img was created by mount --clone, other commands leave these alone
+func isSnapClone(img *rbd.Image) (bool, error) {
+	if !strings.HasSuffix(img.Name(), cloneSuffix) {
+		return false, nil
+	}
+	_, err := img.GetMeta(cloneOfMetaKey)
+	if errors.Is(err, rbd.ErrDoesNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// removeSnapClone unmounts, unmaps and removes clone of img, then releases the protection of the snapshot it was cloned
+// from, so prune can remove it
+func removeSnapClone(img, clone *rbd.Image, parent, mountPoint string) error {
+	if err := clone.UnmountAndUnmap(mountPoint); err != nil {
+		return err
+	}
+	if err := clone.Remove(); err != nil {
+		return err
+	}
+	snap, err := img.GetSnapshot(parent)
+	if errors.Is(err, rbd.ErrDoesNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return snap.ReleaseCloneProtection()
+}
+
+// mountClone clones snap to a temporary image and mounts it read-write at mountPoint, replacing a clone of an older snapshot.
+// With dryRun it only logs what it would remove, clone and mount.
+func mountClone(prefix string, img *rbd.Image, snap *rbd.Snapshot, mountPoint, fileSystem string, dryRun bool, log *log.Entry) error {
+	clone, parent, err := snapClone(prefix, img)
+	if err != nil {
+		log.WithError(err).Error("error getting clone")
+		return err
+	}
+	if clone != nil && parent == snap.Name() {
+		if mounted, err := clone.IsMountedAt(mountPoint); err != nil {
+			log.WithError(err).Error("error determining if mounted")
+			return err
+		} else if mounted {
+			log.Debug("already mounted")
+			report.mounted(img, mountPoint)
+			return nil
+		}
+	} else if clone != nil && dryRun {
+		log.WithField("clone", clone.FullName()).Info("would remove clone of older snapshot")
+		clone = nil
+	} else if clone != nil {
+		if err = removeSnapClone(img, clone, parent, mountPoint); err != nil {
+			log.WithError(err).WithField("clone", clone.FullName()).Error("error removing clone of older snapshot")
+			return err
+		}
+		clone = nil
+	}
+
+	// a read-only mapping of the snapshot mounted by a run without --clone
+	if err = unmountDev(snap, mountPoint, dryRun, log); err != nil {
+		log.WithError(err).Errorf("error unmounting and unmapping %v", snap.FullName())
+		return err
+	}
+	if dryRun {
+		if clone == nil {
+			log.Info("would clone")
+		}
+		log.Info("would map and mount clone")
+		return nil
+	}
+
+	if clone == nil {
+		if clone, err = snap.Clone(img.Pool(), cloneName(prefix, img)); err != nil {
+			log.WithError(err).Error("error cloning")
+			return err
+		}
+		if err = clone.SetMeta(cloneOfMetaKey, snap.Name()); err != nil {
+			log.WithError(err).Error("error marking clone")
+			if rErr := removeSnapClone(img, clone, snap.Name(), mountPoint); rErr != nil {
+				log.WithError(rErr).WithField("clone", clone.FullName()).Error("error removing unmarked clone")
+			}
+			return err
+		}
+	}
+	log = log.WithField("clone", clone.FullName())
+
+	if fileSystem == "" {
+		if fileSystem, err = snap.FileSystem(); err != nil {
+			log.WithError(err).Error("error getting filesystem")
+			return err
+		}
+	}
+	log = log.WithField("fs", fileSystem)
+
+	mountData := ""
+	if fileSystem == "xfs" {
+		// the clone has the uuid of the image, which may be mounted too
+		mountData = "nouuid"
+	}
+
+	// try unmounting just in case something else is mounted there. Ignore errors
+	_ = syscall.Unmount(mountPoint, 0)
+
+	if err = clone.MapAndMount(mountPoint, fileSystem, 0, mountData); err != nil {
+		log.WithError(err).Error("error mounting")
+		return err
+	}
+	report.mounted(img, mountPoint)
+	log.Info("mounted")
+	return nil
+}
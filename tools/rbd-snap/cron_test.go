@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// bits returns the bitset of values
+func bits(values ...int) uint64 {
+	var b uint64
+	for _, v := range values {
+		b |= 1 << uint(v)
+	}
+	return b
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     uint64
+		wantErr  bool
+	}{
+		{"*", 0, 7, bits(0, 1, 2, 3, 4, 5, 6, 7), false},
+		{"5", 0, 59, bits(5), false},
+		{"1-3", 0, 59, bits(1, 2, 3), false},
+		{"*/15", 0, 59, bits(0, 15, 30, 45), false},
+		{"5/15", 0, 59, bits(5, 20, 35, 50), false},
+		{"1-10/3", 0, 59, bits(1, 4, 7, 10), false},
+		{"1,3,5", 0, 7, bits(1, 3, 5), false},
+		{"1-2,30,40-59/10", 0, 59, bits(1, 2, 30, 40, 50), false},
+		{"*/5,1", 1, 12, bits(1, 6, 11), false},
+		{"60", 0, 59, 0, true},
+		{"0", 1, 31, 0, true},
+		{"5-1", 0, 59, 0, true},
+		{"*/0", 0, 59, 0, true},
+		{"*/x", 0, 59, 0, true},
+		{"a", 0, 59, 0, true},
+		{"1-", 0, 59, 0, true},
+		{"1,", 0, 59, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			got, err := parseCronField(tt.field, tt.min, tt.max)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCronField() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseCronField() = %b, want %b", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{"*/15 2-6 * * 1,3,5", false},
+		{"@daily", false},
+		{"@hourly", false},
+		{"0 0 * * 7", false},
+		{"* * * *", true},
+		{"* * * * * *", true},
+		{"@reboot", true},
+		{"0 24 * * *", true},
+		{"0 0 * 13 *", true},
+		{"0 0 * * 8", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			if _, err := parseCron(tt.spec); (err != nil) != tt.wantErr {
+				t.Errorf("parseCron() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2023-08-01 was a tuesday
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2023, month, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"step", "*/15 * * * *", at(8, 9, 10, 7), at(8, 9, 10, 15)},
+		{"after a match", "0 * * * *", at(8, 9, 10, 0), at(8, 9, 11, 0)},
+		{"seconds are ignored", "* * * * *", at(8, 9, 10, 0).Add(30 * time.Second), at(8, 9, 10, 1)},
+		{"next day", "0 2 * * *", at(8, 9, 3, 0), at(8, 10, 2, 0)},
+		{"range and list", "30 2-6 * * 1,3,5", at(8, 8, 7, 0), at(8, 9, 2, 30)},
+		{"day of month", "0 0 13 * *", at(8, 1, 0, 0), at(8, 13, 0, 0)},
+		{"day of week", "0 0 * * 5", at(8, 1, 0, 0), at(8, 4, 0, 0)},
+		{"day of month or week, week first", "0 0 13 * 5", at(8, 1, 0, 0), at(8, 4, 0, 0)},
+		{"day of month or week, month first", "0 0 13 * 5", at(8, 12, 0, 0), at(8, 13, 0, 0)},
+		{"sunday as 7", "0 0 * * 7", at(8, 9, 0, 0), at(8, 13, 0, 0)},
+		{"sunday as 0", "0 0 * * 0", at(8, 9, 0, 0), at(8, 13, 0, 0)},
+		{"month", "0 0 1 1 *", at(8, 9, 0, 0), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"leap day", "0 0 29 2 *", at(8, 9, 0, 0), time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"never", "0 0 30 2 *", at(8, 9, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCron(tt.spec)
+			if err != nil {
+				t.Fatalf("parseCron() error = %v", err)
+			}
+			if got := c.next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("next(%v) = %v, want %v", tt.from, got, tt.want)
+			}
+		})
+	}
+}
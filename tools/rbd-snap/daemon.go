@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/docker"
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
+	log "github.com/sirupsen/logrus"
+)
+
+// jsonDuration is a duration written as a string in json, eg: "720h"
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations must be strings, eg: \"24h\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(v)
+	return nil
+}
+
+// durationOr returns d, or def if d is not set
+func durationOr(d *jsonDuration, def time.Duration) time.Duration {
+	if d == nil {
+		return def
+	}
+	return time.Duration(*d)
+}
+
+// daemonSchedule is a command the daemon runs on a cron schedule. Options left out take the defaults of the command's flags.
+type daemonSchedule struct {
+	// Name identifies the schedule in logs, the command and its index if empty
+	Name string `json:"name"`
+	// Schedule is a five field cron schedule, or one of @hourly, @daily, @weekly, @monthly or @yearly
+	Schedule string `json:"schedule"`
+	// Command is snap, prune or mount
+	Command string `json:"command"`
+	// Prefix is the snapshot name prefix, --prefix if empty
+	Prefix   string   `json:"prefix"`
+	Patterns []string `json:"patterns"`
+	// Suffix and IncludeHostname replace --suffix and --include-hostname for this schedule if either is set
+	Suffix          string `json:"suffix"`
+	IncludeHostname bool   `json:"include_hostname"`
+
+	OnlyMapped      *bool         `json:"only_mapped"`
+	SkipUnchanged   bool          `json:"skip_unchanged"`
+	ConsistentGroup bool          `json:"consistent_group"`
+	FreezeTimeout   *jsonDuration `json:"freeze_timeout"`
+	PauseContainers bool          `json:"pause_containers"`
+	// DockerSocket is the socket of the docker engine whose containers are paused, --docker-socket if empty
+	DockerSocket string `json:"docker_socket"`
+
+	Age               *jsonDuration `json:"age"`
+	KeepLast          int           `json:"keep_last"`
+	UnprotectOrphaned bool          `json:"unprotect_orphaned"`
+
+	MountDir   string `json:"mount_dir"`
+	FileSystem string `json:"filesystem"`
+	Clone      bool   `json:"clone"`
+	All        bool   `json:"all"`
+
+	spec *cronSpec
+	next time.Time
+}
+
+// daemonConfig is the config file of the daemon
+type daemonConfig struct {
+	Schedules []*daemonSchedule `json:"schedules"`
+}
+
+// loadDaemonConfig reads and checks the config file at path, filling in defaults
+func loadDaemonConfig(path, prefix string) ([]*daemonSchedule, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+	conf := &daemonConfig{}
+	if err = json.Unmarshal(b, conf); err != nil {
+		return nil, fmt.Errorf("error parsing %v: %w", path, err)
+	}
+	if len(conf.Schedules) == 0 {
+		return nil, fmt.Errorf("%v has no schedules", path)
+	}
+	for i, s := range conf.Schedules {
+		if s.Name == "" {
+			s.Name = fmt.Sprintf("%v-%v", s.Command, i)
+		}
+		if s.Prefix == "" {
+			s.Prefix = prefix
+		}
+		switch s.Command {
+		case "snap":
+		case "mount":
+			if s.Clone && s.All {
+				return nil, fmt.Errorf("schedule %v: clone and all can't be used together", s.Name)
+			}
+		case "prune":
+			if durationOr(s.Age, 0) < 0 || s.KeepLast < 0 {
+				return nil, fmt.Errorf("schedule %v: age and keep_last must not be negative", s.Name)
+			}
+			if s.Age != nil && *s.Age == 0 && s.KeepLast == 0 {
+				return nil, fmt.Errorf("schedule %v: age or keep_last must be greater than 0", s.Name)
+			}
+		default:
+			return nil, fmt.Errorf("schedule %v: command must be snap, prune or mount, not %q", s.Name, s.Command)
+		}
+		if len(s.Patterns) == 0 {
+			return nil, fmt.Errorf("schedule %v has no patterns", s.Name)
+		}
+		if s.spec, err = parseCron(s.Schedule); err != nil {
+			return nil, fmt.Errorf("schedule %v: %w", s.Name, err)
+		}
+	}
+	return conf.Schedules, nil
+}
+
+// run runs the schedule's command once
+func (s *daemonSchedule) run(opts *runOptions) error {
+	if s.Suffix != "" || s.IncludeHostname {
+		defer func(suffix string) { snapSuffix = suffix }(snapSuffix)
+		if err := setSnapSuffix(s.Suffix, s.IncludeHostname); err != nil {
+			return err
+		}
+	}
+	return opts.run(s.Command, s.Prefix, func() error {
+		switch s.Command {
+		case "snap":
+			rbd.SetFreezeTimeout(durationOr(s.FreezeTimeout, defaultFreezeTimeout))
+			var hooks []rbd.FreezeHook
+			if s.PauseContainers {
+				client := dockerClient
+				if s.DockerSocket != "" {
+					client = docker.NewClient(s.DockerSocket)
+				}
+				hooks = append(hooks, pauseContainersHook(client))
+			}
+			onlyMapped := s.OnlyMapped == nil || *s.OnlyMapped
+			if s.ConsistentGroup {
+				return snapGroup(s.Prefix, onlyMapped, s.SkipUnchanged, opts.dryRun, hooks, s.Patterns...)
+			}
+			return snap(s.Prefix, onlyMapped, s.SkipUnchanged, opts.dryRun, hooks, s.Patterns...)
+		case "prune":
+			return prune(s.Prefix, durationOr(s.Age, defaultPruneAge), s.KeepLast, s.UnprotectOrphaned, opts.dryRun, s.Patterns...)
+		case "mount":
+			mountDir := s.MountDir
+			if mountDir == "" {
+				mountDir = defaultMountDir
+			}
+			return mount(s.Prefix, mountDir, s.FileSystem, s.Clone, s.All, opts.dryRun, s.Patterns...)
+		}
+		return fmt.Errorf("unknown command %v", s.Command)
+	})
+}
+
+// daemon runs the schedules in the config file at path until it is interrupted. Runs happen one at a time,
+// a schedule which comes due during another's run starts when it completes, and times missed while running are skipped.
+func daemon(opts *runOptions, path, prefix string) error {
+	schedules, err := loadDaemonConfig(path, prefix)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, s := range schedules {
+		if s.next = s.spec.next(now); s.next.IsZero() {
+			return fmt.Errorf("schedule %v: %q never runs", s.Name, s.Schedule)
+		}
+		log.WithField("schedule", s.Name).WithField("next", s.next).Info("scheduled")
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	for {
+		earliest := schedules[0].next
+		for _, s := range schedules[1:] {
+			if s.next.Before(earliest) {
+				earliest = s.next
+			}
+		}
+		timer := time.NewTimer(time.Until(earliest))
+		select {
+		case <-sig:
+			timer.Stop()
+			log.Info("stopping")
+			return nil
+		case <-timer.C:
+		}
+
+		for _, s := range schedules {
+			if time.Now().Before(s.next) {
+				continue
+			}
+			log := log.WithField("schedule", s.Name).WithField("command", s.Command).WithField("prefix", s.Prefix)
+			log.Info("starting scheduled run")
+			if err := s.run(opts); err != nil {
+				log.WithError(err).Error("scheduled run failed")
+			} else {
+				log.Info("scheduled run complete")
+			}
+			s.next = s.spec.next(time.Now())
+		}
+	}
+}
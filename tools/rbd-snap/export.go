@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
+	log "github.com/sirupsen/logrus"
+)
+
+// exportSink stores export streams, name is a relative path such as pool/image@snapshot.diff,
+// and size roughly how large the stream will be, or 0 if it isn't known
+type exportSink interface {
+	store(name string, size int64, export func(io.Writer) error) error
+}
+
+// dirSink writes each export to a file under a directory, renaming it into place once complete
+type dirSink string
+
+func (d dirSink) store(name string, size int64, export func(io.Writer) error) error {
+	dest := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(dest + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = export(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		_ = os.Remove(dest + ".tmp")
+		return err
+	}
+	return os.Rename(dest+".tmp", dest)
+}
+
+// stdoutSink writes a single export to stdout, a stream of several could not be told apart
+type stdoutSink struct {
+	mu   sync.Mutex
+	used bool
+}
+
+func (s *stdoutSink) store(name string, size int64, export func(io.Writer) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used {
+		return fmt.Errorf("not exporting %v, only one image can be exported to stdout", name)
+	}
+	s.used = true
+	return export(os.Stdout)
+}
+
+// s3Sink uploads each export to a bucket, under a key prefix
+type s3Sink struct {
+	client *s3Client
+	bucket string
+	prefix string
+}
+
+func (s *s3Sink) store(name string, size int64, export func(io.Writer) error) error {
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(export(pw)) }()
+	err := s.client.Upload(s.bucket, path.Join(s.prefix, name), size, pr)
+	// stop the export if the upload failed first
+	pr.CloseWithError(err)
+	return err
+}
+
+// newExportSink returns the sink for dest, which is a directory, - for stdout, or s3://bucket/prefix
+func newExportSink(dest, s3Endpoint string) (exportSink, error) {
+	switch {
+	case dest == "":
+		return nil, errors.New("an export destination is required")
+	case dest == "-":
+		return &stdoutSink{}, nil
+	case strings.HasPrefix(dest, "s3://"):
+		parts := strings.SplitN(strings.TrimPrefix(dest, "s3://"), "/", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("%v has no bucket", dest)
+		}
+		client, err := newS3Client(s3Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		s := &s3Sink{client: client, bucket: parts[0]}
+		if len(parts) == 2 {
+			s.prefix = parts[1]
+		}
+		return s, nil
+	}
+	return dirSink(dest), nil
+}
+
+// exportName is the name of an export of snap, incremental from since if it is not nil
+func exportName(snap, since *rbd.Snapshot) string {
+	pool := snap.Pool()
+	name := snap.ImageName()
+	if since != nil {
+		name = snap.Image().Name() + "@" + since.Name() + ".." + snap.Name()
+	}
+	return path.Join(pool.Name(), pool.Namespace(), name+".diff")
+}
+
+// export writes the newest snapshot of each image matching patterns to sink as an rbd export-diff stream.
+// If incremental is set, only the changes since the previous snapshot are written, if there is one.
+func export(prefix string, sink exportSink, incremental, dryRun bool, patterns ...string) error {
+	exportF := func(img *rbd.Image, settings imageSettings, log *log.Entry) error {
+		prefix := settings.prefix
+		snaps, err := prefixedSnaps(prefix, img)
+		if err != nil {
+			log.WithError(err).Error("error getting snapshots")
+			return err
+		}
+		if len(snaps) == 0 {
+			log.Warn("no snapshots to export")
+			report.skipped(img, "no snapshots")
+			return nil
+		}
+		snap := snaps[0].snap
+		var since *rbd.Snapshot
+		if incremental && len(snaps) > 1 {
+			since = snaps[1].snap
+		}
+		name := exportName(snap, since)
+		log = log.WithField("snapshot", snap.Name()).WithField("export", name)
+		if since != nil {
+			log = log.WithField("since", since.Name())
+		}
+		if dryRun {
+			log.Info("would export")
+			return nil
+		}
+		// the stream is at most about the size of the image when the snapshot was taken
+		size, err := snap.Size()
+		if err != nil {
+			log.WithError(err).Warn("error getting size")
+		}
+		if err = sink.store(name, int64(size), func(w io.Writer) error { return snap.ExportDiff(since, w) }); err != nil {
+			log.WithError(err).Error("error exporting")
+			return err
+		}
+		report.exported(img, name)
+		log.Info("exported")
+		return nil
+	}
+
+	return loopImgsWithSettings(imageSettings{prefix: prefix}, exportF, log.NewEntry(log.StandardLogger()), patterns...)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
+	"github.com/sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
+)
+
+// snapGroup snapshots the images matching patterns as a consistent set: the filesystems of all of them are frozen
+// before any is snapshotted, and unfrozen once all the snapshots are taken. Images are selected as by snap, and if
+// any image can't be checked nothing is snapshotted. With dryRun it only logs the images it would snapshot.
+func snapGroup(prefix string, onlyMapped, skipUnchanged, dryRun bool, hooks []rbd.FreezeHook, patterns ...string) error {
+	now := time.Now()
+	log := log.WithField("snapshot", newSnapName(prefix, now))
+
+	mu := &sync.Mutex{}
+	imgs := []*rbd.Image{}
+	// the names of the snapshots, which differ if the prefix of an image is overridden in its metadata
+	names := map[*rbd.Image]string{}
+	selectF := func(img *rbd.Image, settings imageSettings, log *logrus.Entry) error {
+		prefix := settings.prefix
+		blk, err := img.Device()
+		if err != nil {
+			log.WithError(err).Error("error getting device")
+			return err
+		}
+		if blk == "" && onlyMapped {
+			log.Debug("not mapped")
+			report.skipped(img, "not mapped")
+			return nil
+		}
+		if skipUnchanged {
+			since, _, err := unchangedSince(prefix, img, blk != "")
+			if err != nil {
+				log.WithError(err).Error("error getting changes since the newest snapshot")
+				return err
+			}
+			if since != nil {
+				log.WithField("since", since.Name()).Info("skipping unchanged image")
+				report.skipped(img, "unchanged since "+since.Name())
+				return nil
+			}
+		}
+		if dryRun {
+			log.WithField("blk", blk).WithField("freeze", blk != "").Info("would create snapshot with the group")
+		}
+		// img may carry the context of the image timeout, which ends when selection does
+		img = img.WithContext(context.Background())
+		mu.Lock()
+		imgs = append(imgs, img)
+		names[img] = newSnapName(prefix, now)
+		mu.Unlock()
+		return nil
+	}
+	if err := loopImgsWithSettings(imageSettings{prefix: prefix}, selectF, log, patterns...); err != nil {
+		log.WithError(err).Error("not snapshotting the group, not every image could be checked")
+		return err
+	}
+	if len(imgs) == 0 {
+		log.Warn("no images to snapshot")
+		return nil
+	}
+	if dryRun {
+		log.WithField("images", len(imgs)).Info("would freeze and snapshot images together")
+		return nil
+	}
+
+	// lock every image in the same order every time so concurrent group snapshots can't deadlock
+	sort.Slice(imgs, func(i, j int) bool { return imgs[i].FullName() < imgs[j].FullName() })
+	for _, img := range imgs {
+		defer rbd.LockName(img.FullName())()
+	}
+
+	unfreeze, err := rbd.FreezeImages(imgs, hooks...)
+	if err != nil {
+		log.WithError(err).Error("error freezing")
+		report.runErr(err)
+		return err
+	}
+	errs := newErrCollector()
+	wg := &sync.WaitGroup{}
+	for _, img := range imgs {
+		imgSlots <- struct{}{}
+		wg.Add(1)
+		go func(img *rbd.Image) {
+			defer wg.Done()
+			defer func() { <-imgSlots }()
+			log := log.WithField("image", img.FullName()).WithField("snapshot", names[img])
+			snap, err := img.CreateSnapshot(names[img])
+			report.done(img, err)
+			if err != nil {
+				log.WithError(err).Error("error creating snapshot")
+				errs.add(err)
+				return
+			}
+			report.created(img, snap.Name())
+		}(img)
+	}
+	wg.Wait()
+	if err = unfreeze(); err != nil {
+		if errors.Is(err, rbd.ErrFreezeTimeout) {
+			log.WithError(err).Error("a filesystem was unfrozen before every snapshot was taken, the snapshots may not be consistent")
+		} else {
+			log.WithError(err).Error("error unfreezing")
+		}
+		report.runErr(err)
+		errs.add(err)
+	}
+	if err = errs.err(); err != nil {
+		return err
+	}
+	log.WithField("images", len(imgs)).Info("group snapshot complete")
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
+	log "github.com/sirupsen/logrus"
+)
+
+// latestLink is the symlink in an image's history directory to the directory of its newest snapshot
+const latestLink = "latest"
+
+// historyName is the name of the directory a snapshot is mounted on in its image's history directory
+func historyName(s *datedSnap) string {
+	return s.created.UTC().Format(time.RFC3339)
+}
+
+// mountHistory mounts every snapshot of img taken with prefix read-only at imgDir/<time>, points imgDir/latest at the
+// newest, and removes the directories of snapshots which are gone. With dryRun it only logs what it would unmount and mount.
+func mountHistory(prefix string, img *rbd.Image, imgDir, fileSystem string, dryRun bool, log *log.Entry) error {
+	snaps, err := prefixedSnaps(prefix, img)
+	if err != nil {
+		log.WithError(err).Error("error getting snapshots")
+		return err
+	}
+	if len(snaps) == 0 {
+		log.Error("no snapshots")
+		return ErrNoSnapshots
+	}
+
+	// the newest snapshot mounted on imgDir itself, by mount without --all
+	for _, s := range snaps {
+		if err = unmountDev(s.snap, imgDir, dryRun, log); err != nil {
+			log.WithError(err).Errorf("error unmounting and unmapping %v", s.snap.FullName())
+			return err
+		}
+	}
+
+	errs := newErrCollector()
+	names := map[string]struct{}{latestLink: {}}
+	for _, s := range snaps {
+		name := historyName(s)
+		names[name] = struct{}{}
+		errs.add(mountHistorySnap(s.snap, filepath.Join(imgDir, name), fileSystem, dryRun, log.WithField("snapshot", s.snap.Name())))
+	}
+	if dryRun {
+		log.WithField("latest", historyName(snaps[0])).Info("would link latest")
+		return errs.err()
+	}
+
+	if err = setLatestLink(imgDir, historyName(snaps[0])); err != nil {
+		log.WithError(err).Error("error updating latest link")
+		errs.add(err)
+	}
+
+	entries, err := ioutil.ReadDir(imgDir)
+	if err != nil {
+		log.WithError(err).Error("error reading history directory")
+		errs.add(err)
+		return errs.err()
+	}
+	for _, e := range entries {
+		if _, ok := names[e.Name()]; ok || !e.IsDir() {
+			continue
+		}
+		// a directory still in use is a mount of something else, leave it alone
+		if err = os.Remove(filepath.Join(imgDir, e.Name())); err != nil {
+			log.WithError(err).WithField("dir", e.Name()).Warn("error removing directory of a snapshot which is gone")
+			continue
+		}
+		log.WithField("dir", e.Name()).Debug("removed directory of a snapshot which is gone")
+	}
+	if err = errs.err(); err != nil {
+		return err
+	}
+	report.mounted(img, imgDir)
+	log.WithField("snapshots", len(snaps)).Info("mounted history")
+	return nil
+}
+
+// mountHistorySnap maps snap and mounts it read-only at mountPoint if it is not already. With dryRun it only logs that it would.
+func mountHistorySnap(snap *rbd.Snapshot, mountPoint, fileSystem string, dryRun bool, log *log.Entry) error {
+	log = log.WithField("mountpoint", mountPoint)
+	if mounted, err := snap.IsMountedAt(mountPoint); err != nil {
+		log.WithError(err).Error("error determining if mounted")
+		return err
+	} else if mounted {
+		log.Debug("already mounted")
+		return nil
+	}
+	if dryRun {
+		log.Info("would map and mount")
+		return nil
+	}
+	var err error
+	if fileSystem == "" {
+		if fileSystem, err = snap.FileSystem(); err != nil {
+			log.WithError(err).Error("error getting filesystem")
+			return err
+		}
+	}
+	mountData := ""
+	if fileSystem == "xfs" {
+		// every snapshot of an image has the same uuid
+		mountData = "norecovery,nouuid"
+	}
+	if err = snap.MapAndMount(mountPoint, fileSystem, syscall.MS_RDONLY, mountData); err != nil {
+		log.WithError(err).Error("error mounting")
+		return err
+	}
+	log.Debug("mounted")
+	return nil
+}
+
+// setLatestLink points the latest link in imgDir at name, replacing it atomically
+func setLatestLink(imgDir, name string) error {
+	link := filepath.Join(imgDir, latestLink)
+	if cur, err := os.Readlink(link); err == nil && cur == name {
+		return nil
+	}
+	tmp := link + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(name, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+// isHistoryMount returns true if m is where mount --all mounted s
+func isHistoryMount(s *datedSnap, m *rbd.MountInfo) bool {
+	if filepath.Base(m.MountPoint) != historyName(s) {
+		return false
+	}
+	fi, err := os.Lstat(filepath.Join(filepath.Dir(m.MountPoint), latestLink))
+	return err == nil && fi.Mode()&os.ModeSymlink != 0
+}
+
+// unmountHistorySnap unmounts and unmaps s if mount --all mounted it, so it can be pruned
+func unmountHistorySnap(s *datedSnap) error {
+	blk, err := s.snap.Device()
+	if err != nil || blk == "" {
+		return err
+	}
+	mounts, err := rbd.MountsForDevice(blk)
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		if !isHistoryMount(s, m) {
+			continue
+		}
+		if err = s.snap.UnmountAndUnmap(m.MountPoint); err != nil {
+			return err
+		}
+		_ = os.Remove(m.MountPoint)
+	}
+	return nil
+}
+
+// unmountHistory removes the latest link and the empty snapshot directories mount --all left in imgDir
+func unmountHistory(imgDir string) error {
+	if err := os.Remove(filepath.Join(imgDir, latestLink)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	entries, err := ioutil.ReadDir(imgDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if err = os.Remove(filepath.Join(imgDir, e.Name())); err != nil && !errors.Is(err, syscall.ENOTEMPTY) && !errors.Is(err, syscall.EBUSY) {
+			return err
+		}
+	}
+	return nil
+}
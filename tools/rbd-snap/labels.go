@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/docker"
+)
+
+// dockerLabel selects only images whose docker volume, or a container using the volume, has this label, either
+// key or key=value. Volumes are matched to images by name, as the plugin names images after their volumes.
+var dockerLabel string
+
+// dockerClient is the client of --docker-socket, used to find labelled volumes and containers to pause
+var dockerClient *docker.Client
+
+// labelledVolumes returns the names of the docker volumes with dockerLabel, and the volumes mounted by containers with it
+func labelledVolumes() (map[string]struct{}, error) {
+	vols, err := dockerClient.Volumes(dockerLabel)
+	if err != nil {
+		return nil, fmt.Errorf("error listing volumes with label %v: %w", dockerLabel, err)
+	}
+	r := make(map[string]struct{}, len(vols))
+	for _, v := range vols {
+		r[v.Name] = struct{}{}
+	}
+	containers, err := dockerClient.ContainersWithLabel(dockerLabel)
+	if err != nil {
+		return nil, fmt.Errorf("error listing containers with label %v: %w", dockerLabel, err)
+	}
+	for _, c := range containers {
+		for _, m := range c.Mounts {
+			if m.Type == "volume" {
+				r[m.Name] = struct{}{}
+			}
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
+	log "github.com/sirupsen/logrus"
+)
+
+// listDev is the mount status of an image or snapshot, which is only known on this host
+type listDev struct {
+	Device      string   `json:"device,omitempty"`
+	MountPoints []string `json:"mountpoints,omitempty"`
+}
+
+// listSnap is a snapshot printed by list
+type listSnap struct {
+	Name    string    `json:"name"`
+	Size    rbd.Size  `json:"size"`
+	Created time.Time `json:"created"`
+	listDev
+}
+
+// listImage is an image printed by list
+type listImage struct {
+	Pool      string      `json:"pool"`
+	Namespace string      `json:"namespace,omitempty"`
+	Name      string      `json:"name"`
+	Size      rbd.Size    `json:"size"`
+	Snapshots []*listSnap `json:"snapshots"`
+	listDev
+}
+
+// devStatus returns the device d is mapped to on this host, and where that device is mounted
+func devStatus(d rbd.Dev) (listDev, error) {
+	r := listDev{}
+	blk, err := d.Device()
+	if err != nil || blk == "" {
+		return r, err
+	}
+	r.Device = blk
+	mounts, err := rbd.MountsForDevice(blk)
+	if err != nil {
+		return r, err
+	}
+	for _, m := range mounts {
+		r.MountPoints = append(r.MountPoints, m.MountPoint)
+	}
+	return r, nil
+}
+
+// list prints the images matching patterns with their snapshots, as a table or as json
+func list(asJSON bool, patterns ...string) error {
+	mu := &sync.Mutex{}
+	images := []*listImage{}
+
+	listF := func(img *rbd.Image, log *log.Entry) error {
+		info, err := img.Info()
+		if err != nil {
+			log.WithError(err).Error("error getting info")
+			return err
+		}
+		li := &listImage{Pool: img.Pool().Name(), Namespace: img.Pool().Namespace(), Name: img.Name(), Size: info.Size, Snapshots: []*listSnap{}}
+		if li.listDev, err = devStatus(img); err != nil {
+			log.WithError(err).Error("error getting mount status")
+			return err
+		}
+
+		snaps, err := img.Snapshots()
+		if err != nil {
+			log.WithError(err).Error("error getting snapshots")
+			return err
+		}
+		for _, snap := range snaps {
+			log := log.WithField("snapshot", snap.Name())
+			ls := &listSnap{Name: snap.Name()}
+			if ls.Size, err = snap.Size(); err != nil {
+				log.WithError(err).Error("error getting size")
+				return err
+			}
+			if ls.Created, err = snap.CreatedAt(); err != nil {
+				log.WithError(err).Error("error getting create time")
+				return err
+			}
+			if ls.listDev, err = devStatus(snap); err != nil {
+				log.WithError(err).Error("error getting mount status")
+				return err
+			}
+			li.Snapshots = append(li.Snapshots, ls)
+		}
+
+		mu.Lock()
+		images = append(images, li)
+		mu.Unlock()
+		return nil
+	}
+
+	err := loopImgs(listF, log.NewEntry(log.StandardLogger()), patterns...)
+	sort.Slice(images, func(i, j int) bool {
+		a, b := images[i], images[j]
+		if a.Pool != b.Pool {
+			return a.Pool < b.Pool
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if jErr := enc.Encode(images); jErr != nil {
+			return jErr
+		}
+		return err
+	}
+	for _, li := range images {
+		name := li.Pool + "/" + li.Name
+		if li.Namespace != "" {
+			name = li.Pool + "/" + li.Namespace + "/" + li.Name
+		}
+		fmt.Printf("%v\t%v\t%v\t%v\n", name, li.Size, li.Device, strings.Join(li.MountPoints, ","))
+		for _, ls := range li.Snapshots {
+			fmt.Printf("  @%v\t%v\t%v\t%v\t%v\n", ls.Name, ls.Size, ls.Created.Format(time.RFC3339), ls.Device, strings.Join(ls.MountPoints, ","))
+		}
+	}
+	return err
+}
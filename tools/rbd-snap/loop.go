@@ -1,14 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
-	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -77,77 +79,172 @@ func (ec *errCollector) ignore(err error) {
 	ec.errs = filteredErrs
 }
 
-func loopSnaps(f func(*rbd.Snapshot, *log.Entry) error, log *log.Entry, patterns ...string) error {
-	imgF := func(img *rbd.Image, log *logrus.Entry) error {
-		snaps, err := img.Snapshots()
-		if err != nil {
-			log.WithError(err).Error("error getting snapshots")
-			return err
-		}
+// imgSlots limits how many images loopImgs operates on at once, across every pattern
+var imgSlots = make(chan struct{}, rbd.DefaultParallelism)
 
-		errs := newErrCollector()
-		snapWg := &sync.WaitGroup{}
+// setParallel sets how many images are operated on at once
+func setParallel(n int) error {
+	if n < 1 {
+		return fmt.Errorf("parallel must be at least 1")
+	}
+	imgSlots = make(chan struct{}, n)
+	return nil
+}
 
-		for _, snap := range snaps {
-			snapWg.Add(1)
-			go func(snap *rbd.Snapshot) {
-				defer snapWg.Done()
-				log := log.WithField("snapshot", snap.Name())
-				if err := f(snap, log); err != nil {
-					errs.add(err)
-				}
-			}(snap)
+// ErrImageTimeout is returned for an image whose work did not complete within the image timeout
+var ErrImageTimeout = errors.New("image timed out")
+
+// imageTimeout bounds the work on each image, 0 for no limit
+var imageTimeout time.Duration
+
+// withImageTimeout runs f on img, giving up after imageTimeout. The image's rbd commands are killed when it
+// expires, but work which can't be interrupted, such as a hung mount, is abandoned still running.
+// finished is closed once f has returned, whether or not it was abandoned.
+func withImageTimeout(img *rbd.Image, f func(*rbd.Image) error) (finished <-chan struct{}, err error) {
+	fin := make(chan struct{})
+	if imageTimeout <= 0 {
+		defer close(fin)
+		return fin, f(img)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), imageTimeout)
+	done := make(chan error, 1)
+	go func() {
+		defer close(fin)
+		defer cancel()
+		done <- f(img.WithContext(ctx))
+	}()
+	select {
+	case err := <-done:
+		return fin, err
+	case <-ctx.Done():
+		return fin, fmt.Errorf("%v not done after %v: %w", img.FullName(), imageTimeout, ErrImageTimeout)
+	}
+}
+
+// includeRe and excludeRe further filter the images matched by patterns by their full names, eg: pool/image or
+// pool/namespace/image. Globs can't express exclusions, and go regular expressions have no negative lookahead, so both are needed.
+var includeRe, excludeRe *regexp.Regexp
+
+// setImageRegex sets the regular expressions matched images must, and must not, match. Empty expressions don't filter.
+func setImageRegex(include, exclude string) error {
+	var err error
+	includeRe, excludeRe = nil, nil
+	if include != "" {
+		if includeRe, err = regexp.Compile(include); err != nil {
+			return fmt.Errorf("invalid regex: %w", err)
 		}
-		snapWg.Wait()
+	}
+	if exclude != "" {
+		if excludeRe, err = regexp.Compile(exclude); err != nil {
+			return fmt.Errorf("invalid exclude regex: %w", err)
+		}
+	}
+	return nil
+}
 
-		return errs.err()
+// regexMatch returns true if the full name of img passes the include and exclude regular expressions
+func regexMatch(img *rbd.Image) bool {
+	name := img.FullName()
+	if includeRe != nil && !includeRe.MatchString(name) {
+		return false
 	}
-	return loopImgs(imgF, log, patterns...)
+	return excludeRe == nil || !excludeRe.MatchString(name)
 }
 
 func loopImgs(f func(*rbd.Image, *log.Entry) error, log *log.Entry, patterns ...string) error {
 	errs := newErrCollector()
 
+	var labelled map[string]struct{}
+	if dockerLabel != "" {
+		var err error
+		if labelled, err = labelledVolumes(); err != nil {
+			log.WithError(err).Error("error finding labelled volumes")
+			report.runErr(err)
+			return err
+		}
+	}
+
 	patternWg := &sync.WaitGroup{}
 	for _, pattern := range patterns {
 		patternWg.Add(1)
 		go func(pattern string) {
 			defer patternWg.Done()
 			snapWg := &sync.WaitGroup{}
-			patternParts := strings.SplitN(pattern, "/", 2)
-			if len(patternParts) != 2 {
+			// image names can not contain /, so a third part is a namespace
+			patternParts := strings.SplitN(pattern, "/", 3)
+			if len(patternParts) < 2 {
 				log.Error("invalid pattern")
-				errs.add(fmt.Errorf("invalid pattern %v", pattern))
+				err := fmt.Errorf("invalid pattern %v", pattern)
+				report.runErr(err)
+				errs.add(err)
 				return
 			}
-			poolName, pattern := patternParts[0], patternParts[1]
-			log := log.WithField("pool", poolName).WithField("pattern", pattern)
-			pool := rbd.GetPool(poolName)
-			imgs, err := pool.Images()
-			if err != nil {
-				log.WithError(err).Error("error listing images")
-				errs.add(fmt.Errorf("error listing images in %v: %w", pool, err))
+			poolName, namespace, pattern := patternParts[0], "", patternParts[1]
+			if len(patternParts) == 3 {
+				namespace, pattern = patternParts[1], patternParts[2]
+			}
+			log := log.WithField("pool", poolName).WithField("namespace", namespace).WithField("pattern", pattern)
+			pool := rbd.GetPool(poolName).WithNamespace(namespace)
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				log.WithError(err).Error("invalid pattern")
+				err := fmt.Errorf("invalid pattern %v: %w", pattern, err)
+				report.runErr(err)
+				errs.add(err)
 				return
 			}
-			for _, img := range imgs {
+			err := pool.EachImage(func(img *rbd.Image) error {
+				log := log.WithField("image", img.Name())
+				// the pattern was checked above, so Match can not fail
+				if m, _ := filepath.Match(pattern, img.Name()); !m {
+					log.Debug("no match")
+					return nil
+				}
+				if !regexMatch(img) {
+					log.Debug("no regex match")
+					return nil
+				}
+				if _, ok := labelled[img.Name()]; labelled != nil && !ok {
+					log.Debug("volume not labelled")
+					return nil
+				}
+				if clone, err := isSnapClone(img); err != nil {
+					log.WithError(err).Error("error checking for a clone created by mount --clone")
+					report.runErr(err)
+					errs.add(err)
+					return nil
+				} else if clone {
+					log.Debug("skipping clone created by mount --clone")
+					return nil
+				}
+				// waiting for a slot also pauses the listing until a worker is free
+				imgSlots <- struct{}{}
 				snapWg.Add(1)
-				go func(img *rbd.Image) {
+				go func() {
 					defer snapWg.Done()
-					log := log.WithField("image", img.Name())
-					if m, err := filepath.Match(pattern, img.Name()); err != nil {
-						log.WithError(err).Error("error comparing image name to pattern")
-						errs.add(err)
-						return
-					} else if !m {
-						log.Debug("no match")
-						return
+					defer func() { <-imgSlots }()
+					// serialize with anything else in this process operating on the image
+					finished, err := withImageTimeout(img, func(img *rbd.Image) error {
+						return rbd.WithLock(img, func() error { return f(img, log) })
+					})
+					report.done(img, err)
+					if errors.Is(err, ErrImageTimeout) {
+						log.WithError(err).Error("timed out, waiting for the abandoned work to return")
 					}
-					if err := f(img, log); err != nil {
+					if err != nil {
 						errs.add(err)
 					}
-				}(img)
-			}
+					// abandoned work keeps its slot, and the run waits for it so it can't change the report of a later run
+					<-finished
+				}()
+				return nil
+			})
 			snapWg.Wait()
+			if err != nil {
+				log.WithError(err).Error("error listing images")
+				err = fmt.Errorf("error listing images in %v: %w", pool.FullName(), err)
+				report.runErr(err)
+				errs.add(err)
+			}
 		}(pattern)
 	}
 	patternWg.Wait()
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"time"
 
+	"github.com/TrilliumIT/docker-rbd-plugin/docker"
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
@@ -12,6 +15,14 @@ const (
 	version = "0.1.0"
 )
 
+// defaultFreezeTimeout, defaultMountDir and defaultPruneAge are the defaults of the snap, mount and prune flags,
+// and of daemon schedules which leave them out
+const (
+	defaultFreezeTimeout = 30 * time.Second
+	defaultMountDir      = "/mnt/rbd"
+	defaultPruneAge      = 30 * 24 * time.Hour
+)
+
 func main() {
 	verbose := false
 
@@ -19,8 +30,15 @@ func main() {
 	app.Name = "rbd-snap"
 	app.Version = version
 	app.Description = "manage filesystem consistent snapshots of rbds"
-	app.ArgsUsage = "pattern of rbds to operate on"
+	app.ArgsUsage = "pattern of rbds to operate on, pool/pattern or pool/namespace/pattern"
 	var prefix string
+	var parallel int
+	var regex, excludeRegex string
+	var dockerSocket string
+	var suffix string
+	var includeHostname bool
+	opts := &runOptions{}
+	cluster := rbd.Cluster{}
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:        "prefix",
@@ -33,16 +51,124 @@ func main() {
 			Usage:       "verbose output",
 			Destination: &verbose,
 		},
+		cli.IntFlag{
+			Name:        "parallel",
+			Usage:       "number of images to operate on at once",
+			Value:       rbd.DefaultParallelism,
+			Destination: &parallel,
+		},
+		cli.StringFlag{
+			Name:        "suffix",
+			Usage:       "append this to snapshot names, only snapshots with the same suffix are pruned, exported or reported",
+			Destination: &suffix,
+		},
+		cli.BoolFlag{
+			Name:        "include-hostname",
+			Usage:       "append the short hostname to snapshot names, before --suffix, so schedules on several hosts are kept apart",
+			Destination: &includeHostname,
+		},
+		cli.StringFlag{
+			Name:        "regex",
+			Usage:       "only operate on images matched by the patterns whose full name, pool/image or pool/namespace/image, matches this regular expression",
+			Destination: &regex,
+		},
+		cli.StringFlag{
+			Name:        "exclude-regex",
+			Usage:       "don't operate on images whose full name matches this regular expression, eg: -tmp$",
+			Destination: &excludeRegex,
+		},
+		cli.StringFlag{
+			Name:        "docker-label",
+			Usage:       "only operate on images whose docker volume, or a container using it, has this label, key or key=value, eg: backup=true",
+			Destination: &dockerLabel,
+		},
+		cli.StringFlag{
+			Name:        "docker-socket, docker_socket",
+			Usage:       "docker engine api socket used to find labelled volumes and containers to pause",
+			Value:       docker.DefaultSocket,
+			Destination: &dockerSocket,
+		},
+		cli.DurationFlag{
+			Name:        "image-timeout",
+			Usage:       "report an image as failed if its work takes longer than this and kill its rbd commands, the run still waits for work which can't be interrupted (0 to disable)",
+			Destination: &imageTimeout,
+		},
+		cli.StringFlag{
+			Name:        "lock-dir",
+			Usage:       "directory for the lock which stops snap, mount, unmount, prune and export runs with the same prefix overlapping (empty to disable)",
+			Value:       "/run/lock",
+			Destination: &opts.lockDir,
+		},
+		cli.StringFlag{
+			Name:        "report",
+			Usage:       "write a json summary of each snap, prune, mount, unmount or export run to this file, - for stdout",
+			Destination: &opts.reportPath,
+		},
+		cli.StringFlag{
+			Name:        "on-failure-exec",
+			Usage:       "shell command run with the json report on stdin when a run fails for any image",
+			Destination: &opts.onFailureExec,
+		},
+		cli.StringFlag{
+			Name:        "webhook-url",
+			Usage:       "url the json report is posted to when a run fails for any image",
+			Destination: &opts.webhookURL,
+		},
+		cli.BoolFlag{
+			Name:        "dry-run",
+			Usage:       "log the snapshots which would be created, removed, mapped or mounted without changing anything",
+			Destination: &opts.dryRun,
+		},
+		cli.StringFlag{
+			Name:        "cluster",
+			Usage:       "ceph cluster name (empty for ceph)",
+			Destination: &cluster.Name,
+		},
+		cli.StringFlag{
+			Name:        "id",
+			Usage:       "ceph client id, without the client. prefix (empty for admin)",
+			Destination: &cluster.ID,
+		},
+		cli.StringFlag{
+			Name:        "conf",
+			Usage:       "ceph config file (empty for the default of the cluster)",
+			Destination: &cluster.Conf,
+		},
+		cli.StringFlag{
+			Name:        "keyring",
+			Usage:       "ceph keyring (empty for the default of the client)",
+			Destination: &cluster.Keyring,
+		},
 	}
 	app.Before = func(c *cli.Context) error {
 		if verbose {
 			log.SetLevel(log.DebugLevel)
 		}
-		return nil
+		rbd.SetDefaultCluster(cluster)
+		if err := setSnapSuffix(suffix, includeHostname); err != nil {
+			return err
+		}
+		if err := setImageRegex(regex, excludeRegex); err != nil {
+			return err
+		}
+		dockerClient = docker.NewClient(dockerSocket)
+		return setParallel(parallel)
 	}
 	var onlyMapped bool
+	var skipUnchanged bool
+	var consistentGroup bool
+	var freezeTimeout time.Duration
+	var pauseContainers bool
 	var mountPointDir, fileSystem string
+	var mountClone, mountAll bool
 	var pruneAge time.Duration
+	var keepLast int
+	var unprotectOrphaned bool
+	var listJSON bool
+	var maxAge time.Duration
+	var exportDest, s3Endpoint string
+	var exportSince bool
+	var configPath string
 	app.Commands = []cli.Command{
 		{
 			Name:  "snap",
@@ -53,9 +179,40 @@ func main() {
 					Usage:       "only snapshot mapped rbd images",
 					Destination: &onlyMapped,
 				},
+				cli.BoolFlag{
+					Name:        "skip-unchanged",
+					Usage:       "don't snapshot images which have not been written since their newest snapshot",
+					Destination: &skipUnchanged,
+				},
+				cli.BoolFlag{
+					Name:        "consistent-group",
+					Usage:       "freeze every matched filesystem before taking any snapshot, so the snapshots are consistent with each other",
+					Destination: &consistentGroup,
+				},
+				cli.DurationFlag{
+					Name:        "freeze_timeout",
+					Usage:       "unfreeze filesystems after this long even if the snapshot has not completed (0 to disable)",
+					Value:       defaultFreezeTimeout,
+					Destination: &freezeTimeout,
+				},
+				cli.BoolFlag{
+					Name:        "pause_containers",
+					Usage:       "pause containers using an image while its filesystem is frozen",
+					Destination: &pauseContainers,
+				},
 			},
 			Action: func(c *cli.Context) error {
-				return snap(prefix, onlyMapped, c.Args()...)
+				rbd.SetFreezeTimeout(freezeTimeout)
+				var hooks []rbd.FreezeHook
+				if pauseContainers {
+					hooks = append(hooks, pauseContainersHook(dockerClient))
+				}
+				return opts.run(c.Command.Name, prefix, func() error {
+					if consistentGroup {
+						return snapGroup(prefix, onlyMapped, skipUnchanged, opts.dryRun, hooks, c.Args()...)
+					}
+					return snap(prefix, onlyMapped, skipUnchanged, opts.dryRun, hooks, c.Args()...)
+				})
 			},
 		},
 		{
@@ -65,7 +222,7 @@ func main() {
 				cli.StringFlag{
 					Name:        "mount_dir",
 					Usage:       "directory to create image mountpoints",
-					Value:       "/mnt/rbd",
+					Value:       defaultMountDir,
 					Destination: &mountPointDir,
 				},
 				cli.StringFlag{
@@ -74,30 +231,152 @@ func main() {
 					Value:       "",
 					Destination: &fileSystem,
 				},
+				cli.BoolFlag{
+					Name:        "clone",
+					Usage:       "mount a read-write clone of the snapshot rather than the snapshot itself, for journal replay or restore testing",
+					Destination: &mountClone,
+				},
+				cli.BoolFlag{
+					Name:        "all",
+					Usage:       "mount every snapshot at <mount_dir>/<image>/<time>, with a latest link to the newest, to browse the history of images",
+					Destination: &mountAll,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if mountClone && mountAll {
+					return fmt.Errorf("--clone and --all can't be used together")
+				}
+				return opts.run(c.Command.Name, prefix, func() error {
+					return mount(prefix, mountPointDir, fileSystem, mountClone, mountAll, opts.dryRun, c.Args()...)
+				})
+			},
+		},
+		{
+			Name:  "unmount",
+			Usage: "unmount and unmap snapshots mounted by mount, removing clones mounted with --clone",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "mount_dir",
+					Usage:       "directory image mountpoints were created in",
+					Value:       defaultMountDir,
+					Destination: &mountPointDir,
+				},
 			},
 			Action: func(c *cli.Context) error {
-				return mount(prefix, mountPointDir, fileSystem, c.Args()...)
+				return opts.run(c.Command.Name, prefix, func() error { return unmount(prefix, mountPointDir, opts.dryRun, c.Args()...) })
+			},
+		},
+		{
+			Name:  "list",
+			Usage: "list images with their snapshots, sizes, creation times and where they are mounted",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "json",
+					Usage:       "print json",
+					Destination: &listJSON,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return list(listJSON, c.Args()...)
+			},
+		},
+		{
+			Name:  "status",
+			Usage: "report the age of the newest snapshot and the size of each image, exiting non-zero if any snapshot is older than --max-age",
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:        "max-age",
+					Usage:       "images whose newest snapshot is older than this are stale",
+					Value:       25 * time.Hour,
+					Destination: &maxAge,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return status(prefix, maxAge, c.Args()...)
+			},
+		},
+		{
+			Name:      "export",
+			Usage:     "write the newest snapshot of each image as an export-diff stream, for backups off the cluster",
+			ArgsUsage: "PATTERN...",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "dest",
+					Usage:       "directory to write exports to, - for stdout (one image only), or s3://bucket/prefix",
+					Destination: &exportDest,
+				},
+				cli.BoolFlag{
+					Name:        "since",
+					Usage:       "export only the changes since the previous snapshot, if there is one",
+					Destination: &exportSince,
+				},
+				cli.StringFlag{
+					Name:        "s3-endpoint",
+					Usage:       "url of the s3 compatible endpoint for s3:// destinations, credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY",
+					Value:       "https://s3.amazonaws.com",
+					Destination: &s3Endpoint,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				sink, err := newExportSink(exportDest, s3Endpoint)
+				if err != nil {
+					return err
+				}
+				return opts.run(c.Command.Name, prefix, func() error { return export(prefix, sink, exportSince, opts.dryRun, c.Args()...) })
+			},
+		},
+		{
+			Name:  "daemon",
+			Usage: "run snap, prune and mount on cron schedules from a config file until interrupted",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "config",
+					Usage:       "json config file listing the schedules",
+					Value:       "/etc/rbd-snap.json",
+					Destination: &configPath,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return daemon(opts, configPath, prefix)
 			},
 		},
 		{
 			Name:  "prune",
-			Usage: "delete old snapshots",
+			Usage: "delete old snapshots, keeping those with clones or mounted outside of mount --all",
 			Flags: []cli.Flag{
 				cli.DurationFlag{
 					Name:        "age",
-					Usage:       "keep snapshots newer than this",
-					Value:       30 * 24 * time.Hour,
+					Usage:       "keep snapshots newer than this (0 to prune by --keep-last alone)",
+					Value:       defaultPruneAge,
 					Destination: &pruneAge,
 				},
+				cli.IntFlag{
+					Name:        "keep-last",
+					Usage:       "always keep this many of the newest snapshots of each image, regardless of --age",
+					Destination: &keepLast,
+				},
+				cli.BoolFlag{
+					Name:        "unprotect-orphaned",
+					Usage:       "unprotect protected snapshots without clones so they can be pruned, rather than skipping them",
+					Destination: &unprotectOrphaned,
+				},
 			},
 			Action: func(c *cli.Context) error {
-				return prune(prefix, pruneAge, c.Args()...)
+				if pruneAge < 0 || keepLast < 0 {
+					return fmt.Errorf("--age and --keep-last must not be negative")
+				}
+				if pruneAge == 0 && keepLast == 0 {
+					return fmt.Errorf("--age or --keep-last must be greater than 0")
+				}
+				return opts.run(c.Command.Name, prefix, func() error { return prune(prefix, pruneAge, keepLast, unprotectOrphaned, opts.dryRun, c.Args()...) })
 			},
 		},
 	}
 
+	// exits 1 if everything failed, or 2 if some images failed and others succeeded
 	err := app.Run(os.Args)
 	if err != nil {
-		log.Fatal(err)
+		log.Error(err)
+		os.Exit(exitCode(err))
 	}
 }
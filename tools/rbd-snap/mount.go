@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 	"path/filepath"
-	"strings"
 	"syscall"
 
 	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
@@ -13,48 +12,76 @@ import (
 // ErrNoSnapshots is returned if there are no snapshots
 var ErrNoSnapshots = errors.New("no snapshots")
 
-func mount(prefix, mountPointDir, fileSystem string, patterns ...string) error {
-	mountF := func(img *rbd.Image, log *log.Entry) error {
+// mount mounts the latest snapshot of each image matching patterns under mountPointDir, unmounting older ones.
+// With clone, the snapshot is cloned to a temporary image which is mounted read-write. With all, every snapshot is
+// mounted under a directory for the image, see mountHistory. With dryRun it only logs what it would unmount and mount.
+func mount(prefix, mountPointDir, fileSystem string, clone, all, dryRun bool, patterns ...string) error {
+	mountF := func(img *rbd.Image, settings imageSettings, log *log.Entry) error {
 		mountPoint := filepath.Join(mountPointDir, img.Name())
 		log = log.WithField("mountpoint", mountPoint)
-
-		if err := img.UnmountAndUnmap(mountPoint); errors.Is(err, rbd.ErrMountedElsewhere) {
+		prefix := settings.prefix
+		if err := unmountDev(img, mountPoint, dryRun, log); errors.Is(err, rbd.ErrMountedElsewhere) {
 			log.WithError(err).Errorf("%v is mounted elsewhere", img.FullName())
 			return err
 		} else if err != nil {
 			log.WithError(err).Errorf("error unmounting and unmapping %v", img.FullName())
 			return err
 		}
+		if all {
+			return mountHistory(prefix, img, mountPoint, fileSystem, dryRun, log)
+		}
 
-		snaps, err := img.Snapshots()
+		// newest first, matched by prefix and suffix as prune does
+		snaps, err := prefixedSnaps(prefix, img)
 		if err != nil {
 			log.WithError(err).Error("error getting snapshots")
 			return err
 		}
-
-		// iterate in revese order to get most recent snapshot first
-		var snap *rbd.Snapshot
-		for i := len(snaps) - 1; i >= 0; i-- {
-			if strings.HasPrefix(snaps[i].Name(), prefix) {
-				if snap == nil {
-					snap = snaps[i]
-					continue
-				}
-				if err = snaps[i].UnmountAndUnmap(mountPoint); errors.Is(err, rbd.ErrMountedElsewhere) {
-					log.WithError(err).Errorf("%v is mounted elsewhere", snaps[i].FullName())
-					return err
-				} else if err != nil {
-					log.WithError(err).Errorf("error unmounting and unmapping %v", snaps[i].FullName())
-					return err
-				}
-			}
-		}
-		if snap == nil {
+		if len(snaps) == 0 {
 			log.Error("no snapshots")
 			return ErrNoSnapshots
 		}
+		for _, s := range snaps[1:] {
+			if err = unmountDev(s.snap, mountPoint, dryRun, log); errors.Is(err, rbd.ErrMountedElsewhere) {
+				log.WithError(err).Errorf("%v is mounted elsewhere", s.snap.FullName())
+				return err
+			} else if err != nil {
+				log.WithError(err).Errorf("error unmounting and unmapping %v", s.snap.FullName())
+				return err
+			}
+		}
+		snap := snaps[0].snap
 		log = log.WithField("snapshot", snap.Name())
 
+		if clone {
+			return mountClone(prefix, img, snap, mountPoint, fileSystem, dryRun, log)
+		}
+		if c, parent, err := snapClone(prefix, img); err != nil {
+			log.WithError(err).Error("error getting clone")
+			return err
+		} else if c != nil && dryRun {
+			log.WithField("clone", c.FullName()).Info("would remove clone")
+		} else if c != nil {
+			if err = removeSnapClone(img, c, parent, mountPoint); err != nil {
+				log.WithError(err).WithField("clone", c.FullName()).Error("error removing clone")
+				return err
+			}
+		}
+
+		// if already mounted, do nothing
+		if mounted, err := snap.IsMountedAt(mountPoint); mounted {
+			log.Debug("already mounted")
+			report.mounted(img, mountPoint)
+			return nil
+		} else if err != nil {
+			log.WithError(err).Error("error determining if mounted")
+			return err
+		}
+		if dryRun {
+			log.Info("would map and mount")
+			return nil
+		}
+
 		blk, err := snap.Map()
 		if err != nil {
 			log.WithError(err).Error("error mapping")
@@ -77,15 +104,6 @@ func mount(prefix, mountPointDir, fileSystem string, patterns ...string) error {
 			mountData = "norecovery"
 		}
 
-		// if already mounted, do nothing
-		if mounted, err := snap.IsMountedAt(mountPoint); mounted {
-			log.Debug("already mounted")
-			return nil
-		} else if err != nil {
-			log.WithError(err).Error("error determining if mounted")
-			return err
-		}
-
 		// try unmounting just in case something else is mounted there. Ignore errors
 		_ = syscall.Unmount(mountPoint, 0)
 
@@ -94,11 +112,13 @@ func mount(prefix, mountPointDir, fileSystem string, patterns ...string) error {
 			log.WithError(err).Error("error mounting")
 			return err
 		}
+		report.mounted(img, mountPoint)
 		log.Info("mounted")
 		return nil
 	}
 
-	err := loopImgs(mountF, log.NewEntry(log.StandardLogger()), patterns...)
+	err := loopImgsWithSettings(imageSettings{prefix: prefix}, mountF, log.NewEntry(log.StandardLogger()), patterns...)
+	report.skipErr(ErrNoSnapshots)
 	if errCol, ok := err.(*errCollector); ok {
 		errCol.ignore(ErrNoSnapshots)
 		err = errCol.err()
@@ -108,3 +128,93 @@ func mount(prefix, mountPointDir, fileSystem string, patterns ...string) error {
 	}
 	return err
 }
+
+// unmountDev unmounts and unmaps d from mountPoint. With dryRun it only logs that it would, if d is mounted there.
+func unmountDev(d rbd.Dev, mountPoint string, dryRun bool, log *log.Entry) error {
+	if !dryRun {
+		return d.UnmountAndUnmap(mountPoint)
+	}
+	mounted, err := d.IsMountedAt(mountPoint)
+	if err == nil && mounted {
+		log.WithField("dev", d.FullName()).Info("would unmount and unmap")
+	}
+	return err
+}
+
+// unmount unmounts and unmaps the snapshots mount mounted under mountPointDir for the images matching patterns,
+// removing the clones created by mount --clone. With dryRun it only logs what it would unmount and remove.
+func unmount(prefix, mountPointDir string, dryRun bool, patterns ...string) error {
+	unmountF := func(img *rbd.Image, settings imageSettings, log *log.Entry) error {
+		mountPoint := filepath.Join(mountPointDir, img.Name())
+		log = log.WithField("mountpoint", mountPoint)
+		prefix := settings.prefix
+
+		snaps, err := prefixedSnaps(prefix, img)
+		if err != nil {
+			log.WithError(err).Error("error getting snapshots")
+			return err
+		}
+		for _, s := range snaps {
+			snap := s.snap
+			log := log.WithField("snapshot", snap.Name())
+			blk, err := snap.Device()
+			if err != nil {
+				log.WithError(err).Error("error getting device")
+				return err
+			} else if blk == "" {
+				continue
+			}
+			// snapshots mounted by mount --all are in a directory for each snapshot under mountPoint
+			target := mountPoint
+			mounts, err := rbd.MountsForDevice(blk)
+			if err != nil {
+				log.WithError(err).Error("error getting mounts")
+				return err
+			}
+			for _, m := range mounts {
+				if filepath.Dir(m.MountPoint) == mountPoint {
+					target = m.MountPoint
+				}
+			}
+			log = log.WithField("mountpoint", target)
+			if dryRun {
+				log.Info("would unmount and unmap")
+				continue
+			}
+			if err = snap.UnmountAndUnmap(target); err != nil {
+				log.WithError(err).Error("error unmounting and unmapping")
+				return err
+			}
+			log.Info("unmounted")
+		}
+
+		if !dryRun {
+			if err = unmountHistory(mountPoint); err != nil {
+				log.WithError(err).Error("error removing snapshot directories")
+				return err
+			}
+		}
+
+		c, parent, err := snapClone(prefix, img)
+		if err != nil {
+			log.WithError(err).Error("error getting clone")
+			return err
+		}
+		if c == nil {
+			return nil
+		}
+		log = log.WithField("clone", c.FullName())
+		if dryRun {
+			log.Info("would unmount and remove clone")
+			return nil
+		}
+		if err = removeSnapClone(img, c, parent, mountPoint); err != nil {
+			log.WithError(err).Error("error removing clone")
+			return err
+		}
+		log.Info("removed clone")
+		return nil
+	}
+
+	return loopImgsWithSettings(imageSettings{prefix: prefix}, unmountF, log.NewEntry(log.StandardLogger()), patterns...)
+}
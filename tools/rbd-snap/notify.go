@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// notifyTimeout bounds each failure notification, so a hung hook can't hold the run lock
+const notifyTimeout = time.Minute
+
+// notifyFailure runs onFailureExec with sh -c and posts to webhookURL, each with the report as json, if the run failed.
+// Errors are logged, the run has already failed.
+func notifyFailure(r *runReport, onFailureExec, webhookURL string) {
+	if r.Result == "ok" || (onFailureExec == "" && webhookURL == "") {
+		return
+	}
+	r.mu.Lock()
+	body, err := json.Marshal(r)
+	r.mu.Unlock()
+	if err != nil {
+		log.WithError(err).Error("error encoding report for failure notification")
+		return
+	}
+	if onFailureExec != "" {
+		if err = execHook(onFailureExec, r, body); err != nil {
+			log.WithError(err).WithField("command", onFailureExec).Error("error running failure command")
+		}
+	}
+	if webhookURL != "" {
+		if err = postWebhook(webhookURL, body); err != nil {
+			log.WithError(err).Error("error calling failure webhook")
+		}
+	}
+}
+
+// execHook runs command with the report on stdin, and its result in the environment
+func execHook(command string, r *runReport, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command) //nolint: gas
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"RBD_SNAP_COMMAND="+r.Command,
+		"RBD_SNAP_PREFIX="+r.Prefix,
+		"RBD_SNAP_RESULT="+r.Result,
+		fmt.Sprintf("RBD_SNAP_FAILED=%v", r.Failed),
+		fmt.Sprintf("RBD_SNAP_PROCESSED=%v", r.Processed),
+	)
+	return cmd.Run()
+}
+
+// postWebhook posts body to url as json
+func postWebhook(url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%v returned %v: %s", url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
+	"github.com/sirupsen/logrus"
+)
+
+// image metadata keys which override the command line for one image, eg: rbd image-meta set rbd/db rbd-snap.keep-last 48
+const (
+	metaPrefix   = "rbd-snap.prefix"
+	metaKeepLast = "rbd-snap.keep-last"
+	metaAge      = "rbd-snap.age"
+)
+
+// imageSettings are the options which can be overridden per image
+type imageSettings struct {
+	prefix   string
+	pruneAge time.Duration
+	keepLast int
+}
+
+// forImage returns s with the overrides set in the metadata of img
+func (s imageSettings) forImage(img *rbd.Image) (imageSettings, error) {
+	meta, err := img.ListMeta()
+	if err != nil {
+		return s, err
+	}
+	if v, ok := meta[metaPrefix]; ok {
+		if v == "" {
+			return s, fmt.Errorf("%v of %v is empty", metaPrefix, img.FullName())
+		}
+		s.prefix = v
+	}
+	if v, ok := meta[metaKeepLast]; ok {
+		if s.keepLast, err = strconv.Atoi(v); err != nil || s.keepLast < 0 {
+			return s, fmt.Errorf("%v of %v must be a number of snapshots, not %q", metaKeepLast, img.FullName(), v)
+		}
+	}
+	if v, ok := meta[metaAge]; ok {
+		if s.pruneAge, err = time.ParseDuration(v); err != nil || s.pruneAge < 0 {
+			return s, fmt.Errorf("%v of %v must be a duration, eg: 720h, not %q", metaAge, img.FullName(), v)
+		}
+	}
+	return s, nil
+}
+
+// loopImgsWithSettings is loopImgs for commands whose options can be overridden in image metadata. The metadata of
+// each image is read once, and f is passed defaults with the image's overrides.
+func loopImgsWithSettings(defaults imageSettings, f func(*rbd.Image, imageSettings, *logrus.Entry) error, log *logrus.Entry, patterns ...string) error {
+	return loopImgs(func(img *rbd.Image, log *logrus.Entry) error {
+		settings, err := defaults.forImage(img)
+		if err != nil {
+			log.WithError(err).Error("error getting image settings")
+			return err
+		}
+		if settings.prefix != defaults.prefix {
+			log = log.WithField("prefix", settings.prefix)
+		}
+		return f(img, settings, log)
+	}, log, patterns...)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/docker"
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
+	log "github.com/sirupsen/logrus"
+)
+
+// pauseContainersHook returns a freeze hook which pauses the running containers using an image's volume
+// or mountpoint, so applications such as databases are idle while the filesystem is frozen
+func pauseContainersHook(client *docker.Client) rbd.FreezeHook {
+	return func(img *rbd.Image, mountPoint string) (func() error, error) {
+		log := log.WithField("image", img.FullName()).WithField("mountpoint", mountPoint)
+		containers, err := client.ContainersUsing("", img.Name(), mountPoint, false)
+		if err != nil {
+			return nil, fmt.Errorf("error finding containers using %v: %w", img.FullName(), err)
+		}
+		paused := []string{}
+		unpause := func() error {
+			var err error
+			for _, id := range paused {
+				if uerr := client.Unpause(id); uerr != nil {
+					log.WithField("container", id).WithError(uerr).Error("error unpausing container")
+					if err == nil {
+						err = uerr
+					}
+					continue
+				}
+				log.WithField("container", id).Debug("unpaused container")
+			}
+			return err
+		}
+		for _, c := range containers {
+			// containers paused by someone else are left as they are
+			if c.State != "running" {
+				continue
+			}
+			if err = client.Pause(c.ID); err != nil {
+				_ = unpause()
+				return nil, fmt.Errorf("error pausing container %v: %w", c.ID, err)
+			}
+			log.WithField("container", c.ID).Debug("paused container")
+			paused = append(paused, c.ID)
+		}
+		return unpause, nil
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -10,32 +12,249 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func prune(prefix string, pruneAge time.Duration, pattern ...string) error {
-	pruneBefore := time.Now().Add(-pruneAge)
-	log := log.WithField("before", pruneBefore)
-	log.Info("pruning snapshots")
+// snapCreated returns when a snapshot taken by snap was created, from its name, or from the cluster if the
+// name can't be parsed. ok is false for snapshots without prefix or the current suffix, which this schedule didn't take.
+func snapCreated(prefix string, snap *rbd.Snapshot) (created time.Time, ok bool, err error) {
+	if !strings.HasPrefix(snap.Name(), prefix+"_") {
+		return time.Time{}, false, nil
+	}
+	stamp := strings.TrimPrefix(snap.Name(), prefix+"_")
+	if snapSuffix != "" {
+		if !strings.HasSuffix(stamp, "_"+snapSuffix) {
+			return time.Time{}, false, nil
+		}
+		stamp = strings.TrimSuffix(stamp, "_"+snapSuffix)
+	} else if strings.Contains(stamp, "_") {
+		// a suffix, or a longer prefix, of another schedule
+		return time.Time{}, false, nil
+	}
+	if created, err = time.Parse(time.RFC3339, stamp); err == nil {
+		return created, true, nil
+	}
+	created, err = snap.CreatedAt()
+	return created, true, err
+}
+
+// datedSnap is a snapshot taken by rbd-snap and when it was created
+type datedSnap struct {
+	snap    *rbd.Snapshot
+	created time.Time
+}
 
-	pruneF := func(snap *rbd.Snapshot, log *logrus.Entry) error {
-		created, err := time.Parse(time.RFC3339, strings.TrimPrefix(snap.Name(), prefix+"_"))
+// prefixedSnaps returns the snapshots of img taken by rbd-snap, newest first
+func prefixedSnaps(prefix string, img *rbd.Image) ([]*datedSnap, error) {
+	snaps, err := img.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	r := make([]*datedSnap, 0, len(snaps))
+	for _, snap := range snaps {
+		created, ok, err := snapCreated(prefix, snap)
 		if err != nil {
-			return fmt.Errorf("error parsing create time for %v", snap.FullName())
+			return nil, err
 		}
-		log = log.WithField("created", created)
-		if pruneBefore.Before(created) {
-			log.Debug("skipping newer snapshot")
-			return nil
+		if ok {
+			r = append(r, &datedSnap{snap: snap, created: created})
 		}
-		if err = snap.UnmountAndUnmap(""); err != nil { // safety check
-			log.WithError(err).Error("error safety unmounting")
+	}
+	sort.SliceStable(r, func(i, j int) bool { return r[i].created.After(r[j].created) })
+	return r, nil
+}
+
+// prune removes snapshots older than pruneAge, except the keepLast newest of each image. These and prefix can be
+// overridden in an image's metadata. Snapshots with clones are kept, as are snapshots mounted anywhere but
+// under mount --all's directories, and protected snapshots unless unprotectOrphaned is set. With dryRun it only logs the snapshots it would remove.
+func prune(prefix string, pruneAge time.Duration, keepLast int, unprotectOrphaned, dryRun bool, pattern ...string) error {
+	pruneBefore := time.Now().Add(-pruneAge)
+	log := log.WithField("before", pruneBefore).WithField("keep_last", keepLast)
+	log.Info("pruning snapshots")
+
+	defaults := imageSettings{prefix: prefix, pruneAge: pruneAge, keepLast: keepLast}
+	pruneF := func(img *rbd.Image, settings imageSettings, log *logrus.Entry) error {
+		if settings.pruneAge == 0 && settings.keepLast == 0 {
+			err := fmt.Errorf("the age and keep last of %v are both 0, which would prune every snapshot", img.FullName())
+			log.WithError(err).Error("invalid image settings")
 			return err
 		}
-		if err = snap.Remove(); err != nil {
-			log.WithError(err).Error("error removing")
+		pruneBefore := pruneBefore
+		if settings != defaults {
+			pruneBefore = time.Now().Add(-settings.pruneAge)
+			log = log.WithField("before", pruneBefore).WithField("keep_last", settings.keepLast)
+		}
+		snaps, err := prefixedSnaps(settings.prefix, img)
+		if err != nil {
+			log.WithError(err).Error("error getting snapshots")
 			return err
 		}
-		log.Info("pruned")
+		errs := newErrCollector()
+		for i, s := range snaps {
+			log := log.WithField("snapshot", s.snap.Name()).WithField("created", s.created)
+			if keep := keepSnap(i, s, settings.keepLast, pruneBefore); keep != "" {
+				log.Debug(keep)
+				continue
+			}
+			errs.add(pruneSnap(img, s, unprotectOrphaned, dryRun, log))
+		}
+		return errs.err()
+	}
+
+	return loopImgsWithSettings(defaults, pruneF, log, pattern...)
+}
+
+// keepSnap returns why the i'th newest snapshot s is too new to prune, or "" if it is old enough.
+// The keepLast newest snapshots are kept, as are snapshots created after pruneBefore.
+func keepSnap(i int, s *datedSnap, keepLast int, pruneBefore time.Time) string {
+	if i < keepLast {
+		return "keeping one of the newest snapshots"
+	}
+	if pruneBefore.Before(s.created) {
+		return "skipping newer snapshot"
+	}
+	return ""
+}
+
+// pruneSnap removes snap, skipping it if it has clones, if it is mounted outside of mount --all's directories, or if it
+// is protected and unprotectOrphaned is not set. Nothing is changed until snap is known to be removed, then it is
+// unmounted from mount --all's directory and unprotected. With dryRun it only logs whether it would remove snap.
+func pruneSnap(img *rbd.Image, s *datedSnap, unprotectOrphaned, dryRun bool, log *logrus.Entry) error {
+	snap := s.snap
+	mounted, err := mountedOutsideHistory(s)
+	if err != nil {
+		log.WithError(err).Error("error determining if mounted")
+		return err
+	}
+	if mounted != "" {
+		log.WithField("mountpoint", mounted).Warn("skipping mounted snapshot")
+		report.keptSnap(img, snap.Name(), "mounted")
+		return nil
+	}
+	d, err := decidePrune(snap, unprotectOrphaned, log)
+	if err != nil || d.keep != "" {
+		report.keptSnap(img, snap.Name(), d.keep)
+		return err
+	}
+	if dryRun {
+		if d.unprotect {
+			log.Info("would unprotect orphaned snapshot")
+		}
+		log.Info("would prune")
+		return nil
+	}
+
+	keep, err := unmountPruned(s, log)
+	if err == nil && keep == "" && d.unprotect {
+		keep, err = unprotectPruned(snap, log)
+	}
+	if err != nil || keep != "" {
+		report.keptSnap(img, snap.Name(), keep)
+		return err
+	}
+	err = snap.Remove()
+	if errors.Is(err, rbd.ErrHasChildren) {
+		log.WithError(err).Warn("skipping snapshot with clones")
+		report.keptSnap(img, snap.Name(), "has clones")
 		return nil
 	}
+	if err != nil {
+		log.WithError(err).Error("error removing")
+		return err
+	}
+	report.removed(img, snap.Name())
+	log.Info("pruned")
+	return nil
+}
 
-	return loopSnaps(pruneF, log, pattern...)
+// pruneDecision is what prune does with a snapshot old enough to be pruned
+type pruneDecision struct {
+	// keep is why the snapshot is kept, "" if it is removed
+	keep string
+	// unprotect is set if the snapshot's protection must be removed before it can be
+	unprotect bool
+}
+
+// decidePrune decides whether snap can be pruned. Snapshots with clones are kept, as are protected snapshots
+// unless unprotectOrphaned is set. Protection added by cloning is released by Remove once the clones are gone.
+func decidePrune(snap *rbd.Snapshot, unprotectOrphaned bool, log *logrus.Entry) (pruneDecision, error) {
+	children, err := snap.Children()
+	if err != nil {
+		log.WithError(err).Error("error getting clones")
+		return pruneDecision{}, err
+	}
+	if len(children) > 0 {
+		log.WithField("clone", children[0].FullName()).Warn("skipping snapshot with clones")
+		return pruneDecision{keep: "has clones"}, nil
+	}
+	info, err := snap.Info()
+	if err != nil {
+		log.WithError(err).Error("error getting info")
+		return pruneDecision{}, err
+	}
+	if !info.Protected {
+		return pruneDecision{}, nil
+	}
+	cloneProtected, err := snap.CloneProtected()
+	if err != nil {
+		log.WithError(err).Error("error getting clone protection")
+		return pruneDecision{}, err
+	}
+	if cloneProtected {
+		return pruneDecision{}, nil
+	}
+	if !unprotectOrphaned {
+		log.Warn("skipping protected snapshot, --unprotect-orphaned removes protection from snapshots without clones")
+		return pruneDecision{keep: "protected"}, nil
+	}
+	return pruneDecision{unprotect: true}, nil
+}
+
+// unprotectPruned unprotects snap so it can be removed, returning "has clones" if it was cloned since prune
+// decided to remove it
+func unprotectPruned(snap *rbd.Snapshot, log *logrus.Entry) (string, error) {
+	err := snap.Unprotect()
+	if errors.Is(err, rbd.ErrHasChildren) {
+		log.WithError(err).Warn("skipping snapshot cloned while pruning")
+		return "has clones", nil
+	}
+	if err != nil && !errors.Is(err, rbd.ErrNotProtected) {
+		log.WithError(err).Error("error unprotecting")
+		return "", err
+	}
+	log.Info("unprotected orphaned snapshot")
+	return "", nil
+}
+
+// unmountPruned unmounts and unmaps s where mount --all mounted it, returning "mounted" if it was mounted
+// anywhere else since prune decided to remove it
+func unmountPruned(s *datedSnap, log *logrus.Entry) (string, error) {
+	if err := unmountHistorySnap(s); err != nil {
+		log.WithError(err).Error("error unmounting from history")
+		return "", err
+	}
+	if err := s.snap.UnmountAndUnmap(""); errors.Is(err, rbd.ErrMountedElsewhere) { // safety check
+		log.WithError(err).Warn("skipping mounted snapshot")
+		return "mounted", nil
+	} else if err != nil {
+		log.WithError(err).Error("error safety unmounting")
+		return "", err
+	}
+	return "", nil
+}
+
+// mountedOutsideHistory returns where s is mounted in any mount namespace, other than where mount --all mounted it,
+// or "" if it isn't. pruneSnap keeps these snapshots.
+func mountedOutsideHistory(s *datedSnap) (string, error) {
+	blk, err := s.snap.Device()
+	if err != nil || blk == "" {
+		return "", err
+	}
+	mounts, err := rbd.ScanNamespaceMounts(blk)
+	if err != nil {
+		return "", err
+	}
+	for _, nm := range mounts {
+		if !isHistoryMount(s, nm.Mount) {
+			return nm.Mount.MountPoint, nil
+		}
+	}
+	return "", nil
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
+)
+
+// fakeRbd answers every rbd command with the json in out
+type fakeRbd struct {
+	out string
+}
+
+func (f *fakeRbd) Run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, name string, args ...string) error {
+	return errors.New("not implemented")
+}
+
+func (f *fakeRbd) Output(ctx context.Context, stderr io.Writer, name string, args ...string) ([]byte, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeRbd) StreamJSON(ctx context.Context, v interface{}, stderr io.Writer, name string, args ...string) error {
+	return json.NewDecoder(strings.NewReader(f.out)).Decode(v)
+}
+
+// withFakeRbd runs rbd commands with f until the returned function is called
+func withFakeRbd(f *fakeRbd) func() {
+	// the binary is only looked up, never run
+	rbd.SetRbdBinary(os.Args[0])
+	rbd.SetExecutor(f)
+	return func() {
+		rbd.SetExecutor(nil)
+		rbd.SetRbdBinary("")
+	}
+}
+
+func TestSnapCreated(t *testing.T) {
+	defer withFakeRbd(&fakeRbd{out: `{"name":"vol1","size":1073741824,"format":2,"create_timestamp":1691583000}`})()
+	img, err := rbd.GetPool("rbd").GetImage("vol1")
+	if err != nil {
+		t.Fatalf("GetImage() error = %v", err)
+	}
+	stamp := time.Date(2023, 8, 9, 12, 10, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		suffix string
+		want   time.Time
+		wantOk bool
+	}{
+		{"daily_2023-08-09T12:10:00Z", "", stamp, true},
+		{"daily_2023-08-09T12:10:00Z_host1", "", time.Time{}, false},
+		{"daily_2023-08-09T12:10:00Z_host1", "host1", stamp, true},
+		{"daily_2023-08-09T12:10:00Z_host2", "host1", time.Time{}, false},
+		{"daily_2023-08-09T12:10:00Z", "host1", time.Time{}, false},
+		{"daily_weekly_2023-08-09T12:10:00Z", "", time.Time{}, false},
+		{"weekly_2023-08-09T12:10:00Z", "", time.Time{}, false},
+		{"daily2023-08-09T12:10:00Z", "", time.Time{}, false},
+		{"daily", "", time.Time{}, false},
+		// names which can't be parsed are dated by the cluster
+		{"daily_manual", "", time.Unix(1691583000, 0), true},
+		{"daily_manual_host1", "host1", time.Unix(1691583000, 0), true},
+	}
+	defer func(suffix string) { snapSuffix = suffix }(snapSuffix)
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+tt.suffix, func(t *testing.T) {
+			snapSuffix = tt.suffix
+			snap, err := img.GetSnapshot(tt.name)
+			if err != nil {
+				t.Fatalf("GetSnapshot() error = %v", err)
+			}
+			created, ok, err := snapCreated("daily", snap)
+			if err != nil {
+				t.Fatalf("snapCreated() error = %v", err)
+			}
+			if ok != tt.wantOk || !created.Equal(tt.want) {
+				t.Errorf("snapCreated() = %v, %v, want %v, %v", created, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestKeepSnap(t *testing.T) {
+	now := time.Now()
+	pruneBefore := now.Add(-24 * time.Hour)
+	// newest first, as returned by prefixedSnaps
+	snaps := []*datedSnap{
+		{created: now.Add(-1 * time.Hour)},
+		{created: now.Add(-23 * time.Hour)},
+		{created: now.Add(-25 * time.Hour)},
+		{created: now.Add(-48 * time.Hour)},
+		{created: now.Add(-72 * time.Hour)},
+	}
+	tests := []struct {
+		name     string
+		keepLast int
+		before   time.Time
+		want     []bool
+	}{
+		{"age only", 0, pruneBefore, []bool{true, true, false, false, false}},
+		{"keep last within age", 1, pruneBefore, []bool{true, true, false, false, false}},
+		{"keep last beyond age", 4, pruneBefore, []bool{true, true, true, true, false}},
+		{"keep last only", 2, now, []bool{true, true, false, false, false}},
+		{"keep all", 5, now, []bool{true, true, true, true, true}},
+		{"created at the cut-off", 0, now.Add(-25 * time.Hour), []bool{true, true, false, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, s := range snaps {
+				if kept := keepSnap(i, s, tt.keepLast, tt.before) != ""; kept != tt.want[i] {
+					t.Errorf("keepSnap(%v) kept = %v, want %v", i, kept, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
+)
+
+const (
+	// exitFailure is the exit code when nothing succeeded
+	exitFailure = 1
+	// exitPartialFailure is the exit code when some images failed and others succeeded
+	exitPartialFailure = 2
+)
+
+// ErrPartialFailure is returned when some images failed and others succeeded
+var ErrPartialFailure = errors.New("partial failure")
+
+// partialError is the error of a run in which some images succeeded
+type partialError struct {
+	error
+}
+
+func (e *partialError) Is(target error) bool {
+	return target == ErrPartialFailure
+}
+
+func (e *partialError) Unwrap() error {
+	return e.error
+}
+
+// exitCode returns the exit code for an error returned by a command
+func exitCode(err error) int {
+	if errors.Is(err, ErrPartialFailure) {
+		return exitPartialFailure
+	}
+	return exitFailure
+}
+
+// imageReport is what a run did to one image
+type imageReport struct {
+	Image   string   `json:"image"`
+	Created []string `json:"created,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	// Kept are snapshots prune could not remove, with the reason
+	Kept     []string `json:"kept,omitempty"`
+	Mounted  string   `json:"mounted,omitempty"`
+	Exported []string `json:"exported,omitempty"`
+	Skipped  string   `json:"skipped,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	err      error
+}
+
+// runReport is the summary of a snap, prune, mount, unmount or export run
+type runReport struct {
+	mu       *sync.Mutex
+	images   map[string]*imageReport
+	Command  string         `json:"command"`
+	Prefix   string         `json:"prefix"`
+	DryRun   bool           `json:"dry_run,omitempty"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Result   string         `json:"result"`
+	Images   []*imageReport `json:"images"`
+	// Processed, Failed, Created and Removed count images and snapshots over the whole run
+	Processed int `json:"processed"`
+	Failed    int `json:"failed"`
+	Created   int `json:"created"`
+	Removed   int `json:"removed"`
+	// Errors are errors not tied to an image, such as invalid patterns or failures listing a pool
+	Errors []string `json:"errors,omitempty"`
+}
+
+// report is the report of the current run, nil outside of one. Its methods do nothing on nil.
+var report *runReport
+
+func newRunReport(command, prefix string, dryRun bool) *runReport {
+	return &runReport{
+		mu:      &sync.Mutex{},
+		images:  map[string]*imageReport{},
+		Command: command,
+		Prefix:  prefix,
+		DryRun:  dryRun,
+		Started: time.Now(),
+		Images:  []*imageReport{},
+	}
+}
+
+// update calls f with the report of img, creating it if needed
+func (r *runReport) update(img *rbd.Image, f func(*imageReport)) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ir, ok := r.images[img.FullName()]
+	if !ok {
+		ir = &imageReport{Image: img.FullName()}
+		r.images[img.FullName()] = ir
+	}
+	f(ir)
+}
+
+func (r *runReport) created(img *rbd.Image, snap string) {
+	r.update(img, func(ir *imageReport) { ir.Created = append(ir.Created, snap) })
+}
+
+func (r *runReport) removed(img *rbd.Image, snap string) {
+	r.update(img, func(ir *imageReport) { ir.Removed = append(ir.Removed, snap) })
+}
+
+func (r *runReport) keptSnap(img *rbd.Image, snap, reason string) {
+	if reason == "" {
+		return
+	}
+	r.update(img, func(ir *imageReport) { ir.Kept = append(ir.Kept, snap+": "+reason) })
+}
+
+func (r *runReport) mounted(img *rbd.Image, mountPoint string) {
+	r.update(img, func(ir *imageReport) { ir.Mounted = mountPoint })
+}
+
+func (r *runReport) exported(img *rbd.Image, name string) {
+	r.update(img, func(ir *imageReport) { ir.Exported = append(ir.Exported, name) })
+}
+
+func (r *runReport) skipped(img *rbd.Image, reason string) {
+	r.update(img, func(ir *imageReport) { ir.Skipped = reason })
+}
+
+// runErr records an error not tied to an image
+func (r *runReport) runErr(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Errors = append(r.Errors, err.Error())
+}
+
+// done records that work on img finished with err
+func (r *runReport) done(img *rbd.Image, err error) {
+	r.update(img, func(ir *imageReport) { ir.err = err })
+}
+
+// skipErr records images which failed with target as skipped rather than failed
+func (r *runReport) skipErr(target error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, ir := range r.images {
+		if errors.Is(ir.err, target) {
+			ir.Skipped = ir.err.Error()
+			ir.err = nil
+		}
+	}
+}
+
+// finish completes the report from the result of the run, returning err wrapped as a partialError
+// if some images succeeded
+func (r *runReport) finish(err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Finished = time.Now()
+	r.Images = r.Images[:0]
+	r.Processed, r.Failed, r.Created, r.Removed = 0, 0, 0, 0
+	for _, ir := range r.images {
+		r.Images = append(r.Images, ir)
+		r.Processed++
+		r.Created += len(ir.Created)
+		r.Removed += len(ir.Removed)
+		if ir.err != nil {
+			r.Failed++
+			ir.Error = ir.err.Error()
+		}
+	}
+	sort.Slice(r.Images, func(i, j int) bool { return r.Images[i].Image < r.Images[j].Image })
+
+	if err != nil && r.Failed == 0 && len(r.Errors) == 0 {
+		// the run failed before reaching any image, eg: it could not take the run lock
+		r.Errors = append(r.Errors, err.Error())
+	}
+
+	switch {
+	case err == nil:
+		r.Result = "ok"
+	case r.Failed < r.Processed:
+		r.Result = "partial failure"
+		return &partialError{err}
+	default:
+		r.Result = "failure"
+	}
+	return err
+}
+
+// write writes the report as json to path, - for stdout
+func (r *runReport) write(path string) error {
+	r.mu.Lock()
+	b, err := json.MarshalIndent(r, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	if err = ioutil.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("error writing report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// runOptions are the global options of snap, prune, mount, unmount and export runs
+type runOptions struct {
+	dryRun        bool
+	lockDir       string
+	reportPath    string
+	onFailureExec string
+	webhookURL    string
+}
+
+// run runs f, the work of command, holding the run lock for prefix. Dry runs change nothing so they don't need it.
+// The run is summarized in a report, which is written to reportPath if it is set, and sent to the failure hooks if it failed.
+func (o *runOptions) run(command, prefix string, f func() error) error {
+	report = newRunReport(command, prefix, o.dryRun)
+	r := report
+	defer func() { report = nil }()
+	var err error
+	if o.dryRun {
+		err = f()
+	} else {
+		err = withRunLock(o.lockDir, prefix, f)
+	}
+	err = r.finish(err)
+	if o.reportPath != "" {
+		if wErr := r.write(o.reportPath); wErr != nil {
+			log.WithError(wErr).Error("error writing report")
+		}
+	}
+	notifyFailure(r, o.onFailureExec, o.webhookURL)
+	return err
+}
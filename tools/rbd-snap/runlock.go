@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrAlreadyRunning is returned when another rbd-snap run with the same prefix holds the run lock
+var ErrAlreadyRunning = errors.New("another rbd-snap run with the same prefix is running")
+
+// withRunLock runs f holding an exclusive lock on a file in lockDir named for prefix, so overlapping runs,
+// eg: from cron, don't freeze the same filesystems at once. The lock is released if the process dies.
+func withRunLock(lockDir, prefix string, f func() error) error {
+	if lockDir == "" {
+		return f()
+	}
+	if err := os.MkdirAll(lockDir, 0755); err != nil {
+		return fmt.Errorf("error creating lock directory: %w", err)
+	}
+	// the prefix is escaped so one containing / or .. can't name a file outside lockDir
+	path := filepath.Join(lockDir, "rbd-snap."+url.PathEscape(prefix)+".lock")
+	lf, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening lock file: %w", err)
+	}
+	defer lf.Close()
+	if err = syscall.Flock(int(lf.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return fmt.Errorf("%v is locked: %w", path, ErrAlreadyRunning)
+		}
+		return fmt.Errorf("error locking %v: %w", path, err)
+	}
+	log.WithField("lock", path).Debug("acquired run lock")
+	// closing the file releases the lock
+	return f()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithRunLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbd-snap-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lockDir := filepath.Join(dir, "locks")
+
+	tests := []struct {
+		prefix string
+		file   string
+	}{
+		{"daily", "rbd-snap.daily.lock"},
+		{"../../daily", "rbd-snap...%2F..%2Fdaily.lock"},
+		{"a/b", "rbd-snap.a%2Fb.lock"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			err := withRunLock(lockDir, tt.prefix, func() error {
+				// a second run with the same prefix can't take the lock
+				if err := withRunLock(lockDir, tt.prefix, func() error { return nil }); !errors.Is(err, ErrAlreadyRunning) {
+					t.Errorf("nested withRunLock() error = %v, want %v", err, ErrAlreadyRunning)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("withRunLock() error = %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(lockDir, tt.file)); err != nil {
+				t.Errorf("lock file: %v", err)
+			}
+		})
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("lock files were created outside of the lock directory: %v", entries)
+	}
+}
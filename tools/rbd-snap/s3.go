@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// s3PartSize is the size of each part of a multipart upload, uploads expected to be too large for
+	// s3MaxParts of them get larger parts, see s3PartSizeFor
+	s3PartSize = 64 << 20
+	// s3MaxParts is the most parts S3 allows in a multipart upload
+	s3MaxParts = 10000
+)
+
+// s3PartBufs are the buffers of uploads with the default part size, reused so each upload doesn't allocate one
+var s3PartBufs = sync.Pool{New: func() interface{} { b := make([]byte, s3PartSize); return &b }}
+
+// s3PartSizeFor returns the part size of an upload expected to be about size bytes, 0 if unknown. Larger uploads get
+// larger parts so they fit in s3MaxParts, with room for the upload to be somewhat larger than expected.
+func s3PartSizeFor(size int64) int64 {
+	partSize := (size/(s3MaxParts*9/10) + 1<<20) &^ (1<<20 - 1)
+	if partSize < s3PartSize {
+		return s3PartSize
+	}
+	return partSize
+}
+
+// s3Client uploads objects to an S3 compatible endpoint with path style requests signed with signature v4
+type s3Client struct {
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// newS3Client returns a client for endpoint, eg: https://s3.example.com, with credentials from
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, and the region from AWS_REGION (us-east-1 if unset)
+func newS3Client(endpoint string) (*s3Client, error) {
+	c := &s3Client{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		region:    os.Getenv("AWS_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		client:    &http.Client{},
+	}
+	if c.endpoint == "" {
+		return nil, fmt.Errorf("an s3 endpoint is required")
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required for s3")
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	return c, nil
+}
+
+// s3Escape escapes s as signature v4 requires, leaving only unreserved characters, and / if path is set
+func s3Escape(s string, path bool) string {
+	b := &strings.Builder{}
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data)) //nolint: errcheck
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalQuery encodes query as signature v4 requires, sorted by key, with spaces as %20 rather than +
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		params = append(params, s3Escape(k, false)+"="+s3Escape(query.Get(k), false))
+	}
+	return strings.Join(params, "&")
+}
+
+// sign signs req with signature v4 as of now. path and rawQuery are the escaped path and canonical query of req,
+// and payloadHash the hex sha256 of its body.
+func (c *s3Client) sign(req *http.Request, path, rawQuery, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate, date := now.Format("20060102T150405Z"), now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		rawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		"host;x-amz-content-sha256;x-amz-date",
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	signingKey := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+c.secretKey), date), c.region), "s3"), "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%v",
+		c.accessKey, scope, hex.EncodeToString(hmacSHA256(signingKey, toSign))))
+}
+
+// do sends a signed request for key in bucket, returning the response if it succeeded
+func (c *s3Client) do(method, bucket, key string, query url.Values, body []byte) (*http.Response, error) {
+	path := "/" + s3Escape(bucket, false) + "/" + s3Escape(key, true)
+	rawQuery := canonicalQuery(query)
+	req, err := http.NewRequest(method, c.endpoint+path+"?"+rawQuery, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, path, rawQuery, sha256Hex(body), time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error calling s3: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("s3 %v %v returned %v: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// Upload writes r to key in bucket with a multipart upload, so the size need not be known in advance.
+// size is roughly how much will be read from r, which sets the part size, or 0 if it isn't known.
+func (c *s3Client) Upload(bucket, key string, size int64, r io.Reader) error {
+	resp, err := c.do(http.MethodPost, bucket, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	initiated := &struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	err = xml.NewDecoder(resp.Body).Decode(initiated)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error starting upload of %v: %w", key, err)
+	}
+
+	if err = c.uploadParts(bucket, key, initiated.UploadID, s3PartSizeFor(size), r); err != nil {
+		if _, aErr := c.do(http.MethodDelete, bucket, key, url.Values{"uploadId": {initiated.UploadID}}, nil); aErr == nil {
+			return err
+		}
+		return fmt.Errorf("%w, and the upload could not be aborted", err)
+	}
+	return nil
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+func (c *s3Client) uploadParts(bucket, key, uploadID string, partSize int64, r io.Reader) error {
+	var buf []byte
+	if partSize == s3PartSize {
+		pooled := s3PartBufs.Get().(*[]byte)
+		defer s3PartBufs.Put(pooled)
+		buf = *pooled
+	} else {
+		buf = make([]byte, partSize)
+	}
+	parts := []s3Part{}
+	for n := 1; ; n++ {
+		size, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		// the last part may be empty if the data is a multiple of the part size, but an empty upload needs one part
+		if size > 0 || len(parts) == 0 {
+			if n > s3MaxParts {
+				return fmt.Errorf("%v is larger than %v parts of %v, the most one upload can hold", key, s3MaxParts, partSize)
+			}
+			resp, err := c.do(http.MethodPut, bucket, key, url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}, buf[:size])
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			parts = append(parts, s3Part{PartNumber: n, ETag: resp.Header.Get("ETag")})
+		}
+		if last {
+			break
+		}
+	}
+
+	body, err := xml.Marshal(&struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPost, bucket, key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// completing can fail after the response has started, which is reported in the body
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(result, []byte("<Error>")) {
+		return fmt.Errorf("error completing upload of %v: %s", key, result)
+	}
+	return nil
+}
@@ -2,30 +2,132 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 )
 
-func snap(prefix string, onlyMapped bool, patterns ...string) error {
-	snapName := prefix + "_" + time.Now().UTC().Format(time.RFC3339)
-	log := log.WithField("snapshot", snapName)
+// snapSuffix is appended to the names of snapshots, so schedules on several hosts can snapshot the same images
+// and prune their own snapshots independently. Snapshots with a different suffix are left alone.
+var snapSuffix string
 
-	snapF := func(img *rbd.Image, log *logrus.Entry) error {
-		_, err := img.CreateConsistentSnapshot(snapName, onlyMapped)
+// setSnapSuffix sets the suffix of snapshot names to suffix, preceded by the short hostname if includeHostname is set
+func setSnapSuffix(suffix string, includeHostname bool) error {
+	parts := []string{}
+	if includeHostname {
+		host, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("error getting hostname: %w", err)
+		}
+		parts = append(parts, strings.SplitN(host, ".", 2)[0])
+	}
+	if suffix != "" {
+		parts = append(parts, suffix)
+	}
+	s := strings.Join(parts, "_")
+	if strings.ContainsAny(s, "/@") || strings.IndexFunc(s, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("snapshot suffix %q must not contain '/', '@' or whitespace", s)
+	}
+	snapSuffix = s
+	return nil
+}
+
+// newSnapName returns the name of a snapshot taken at t, prefix_time or prefix_time_suffix
+func newSnapName(prefix string, t time.Time) string {
+	name := prefix + "_" + t.UTC().Format(time.RFC3339)
+	if snapSuffix != "" {
+		name += "_" + snapSuffix
+	}
+	return name
+}
+
+// snap snapshots the images matching patterns. If skipUnchanged is set, images which have not changed since
+// their newest snapshot are skipped. With dryRun it only logs the snapshots it would create.
+func snap(prefix string, onlyMapped, skipUnchanged, dryRun bool, hooks []rbd.FreezeHook, patterns ...string) error {
+	now := time.Now()
+	log := log.WithField("snapshot", newSnapName(prefix, now))
+
+	snapF := func(img *rbd.Image, settings imageSettings, log *logrus.Entry) error {
+		prefix := settings.prefix
+		snapName := newSnapName(prefix, now)
+		log = log.WithField("snapshot", snapName)
+		// changed is only measured to skip unchanged images, diffing every image just to log it is too slow
+		changed := rbd.UsageUnknown
+		var blk string
+		var err error
+		if skipUnchanged || dryRun {
+			if blk, err = img.Device(); err != nil {
+				log.WithError(err).Error("error getting device")
+				return err
+			}
+			if blk == "" && onlyMapped {
+				log.Debug("not mapped")
+				report.skipped(img, "not mapped")
+				return nil
+			}
+		}
+		if skipUnchanged {
+			var since *rbd.Snapshot
+			since, changed, err = unchangedSince(prefix, img, blk != "")
+			if err != nil {
+				log.WithError(err).Error("error getting changes since the newest snapshot")
+				return err
+			}
+			if since != nil {
+				log.WithField("since", since.Name()).Info("skipping unchanged image")
+				report.skipped(img, "unchanged since "+since.Name())
+				return nil
+			}
+		}
+		if dryRun {
+			log.WithField("blk", blk).WithField("freeze", blk != "").Info("would create snapshot")
+			return nil
+		}
+		snap, err := img.CreateConsistentSnapshot(snapName, onlyMapped, hooks...)
 		if errors.Is(err, rbd.ErrNotMapped) {
 			log.Debug("not mapped")
+			report.skipped(img, "not mapped")
 			return nil
 		}
 		if err != nil {
 			log.WithError(err).Error("error creating snapshot")
 			return err
 		}
+		report.created(img, snap.Name())
+		if changed != rbd.UsageUnknown {
+			log = log.WithField("changed", changed)
+		}
 		log.Info("snapshot complete")
 		return nil
 	}
 
-	return loopImgs(snapF, log, patterns...)
+	return loopImgsWithSettings(imageSettings{prefix: prefix}, snapF, log, patterns...)
+}
+
+// unchangedSince returns the newest snapshot rbd-snap took of img if nothing has been written to img since, otherwise
+// nil, and the bytes changed since that snapshot, or rbd.UsageUnknown if there is none
+func unchangedSince(prefix string, img *rbd.Image, mapped bool) (*rbd.Snapshot, rbd.Size, error) {
+	snaps, err := prefixedSnaps(prefix, img)
+	if err != nil || len(snaps) == 0 {
+		return nil, rbd.UsageUnknown, err
+	}
+	if mapped {
+		// writes still in the page cache have not reached the image
+		syscall.Sync()
+	}
+	changed, err := img.ChangedBytes(snaps[0].snap, nil)
+	if err != nil {
+		return nil, rbd.UsageUnknown, err
+	}
+	if changed > 0 {
+		return nil, changed, nil
+	}
+	return snaps[0].snap, 0, nil
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-rbd-plugin/rbd"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrStaleSnapshots is returned by status when an image has no snapshot newer than the threshold
+var ErrStaleSnapshots = errors.New("images without a recent snapshot")
+
+// snapStatus is the newest snapshot rbd-snap took of an image
+type snapStatus struct {
+	img    *rbd.Image
+	newest *datedSnap
+	// size is the size of the image, or empty if it could not be read
+	size string
+}
+
+// status prints the age of the newest snapshot and the size of each image matching patterns, returning
+// ErrStaleSnapshots if any has no snapshot newer than maxAge
+func status(prefix string, maxAge time.Duration, patterns ...string) error {
+	mu := &sync.Mutex{}
+	statuses := []*snapStatus{}
+
+	statusF := func(img *rbd.Image, settings imageSettings, log *log.Entry) error {
+		prefix := settings.prefix
+		snaps, err := prefixedSnaps(prefix, img)
+		if err != nil {
+			log.WithError(err).Error("error getting snapshots")
+			return err
+		}
+		s := &snapStatus{img: img}
+		if len(snaps) > 0 {
+			s.newest = snaps[0]
+		}
+		mu.Lock()
+		statuses = append(statuses, s)
+		mu.Unlock()
+		return nil
+	}
+
+	err := loopImgsWithSettings(imageSettings{prefix: prefix}, statusF, log.NewEntry(log.StandardLogger()), patterns...)
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].img.FullName() < statuses[j].img.FullName() })
+
+	// the sizes are read together after the snapshots, in parallel
+	devs := make([]rbd.Dev, len(statuses))
+	for i, s := range statuses {
+		devs[i] = s.img
+	}
+	for i, r := range rbd.InfoAll(devs, 0) {
+		if r.Err != nil {
+			log.WithField("image", r.Dev.FullName()).WithError(r.Err).Warn("error getting image size")
+			continue
+		}
+		statuses[i].size = r.Info.Size.String()
+	}
+
+	now := time.Now()
+	stale := 0
+	for _, s := range statuses {
+		size := s.size
+		if size == "" {
+			size = "-"
+		}
+		if s.newest == nil {
+			stale++
+			fmt.Printf("%v\t-\t-\tSTALE\t%v\n", s.img.FullName(), size)
+			continue
+		}
+		age := now.Sub(s.newest.created).Truncate(time.Second)
+		state := "OK"
+		if age > maxAge {
+			stale++
+			state = "STALE"
+		}
+		fmt.Printf("%v\t%v\t%v\t%v\t%v\n", s.img.FullName(), s.newest.snap.Name(), age, state, size)
+	}
+	if err != nil {
+		return err
+	}
+	if stale > 0 {
+		return fmt.Errorf("%v of %v %v, none newer than %v", stale, len(statuses), ErrStaleSnapshots, maxAge)
+	}
+	return nil
+}